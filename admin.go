@@ -0,0 +1,127 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"k8s.io/klog/v2"
+)
+
+// challengeRecordPrefix is the name of the challenge records, relative to the
+// zone, for the zone apex.
+const challengeRecordPrefix = "_acme-challenge"
+
+// adminRecord is a challenge record listed by the admin endpoint.
+type adminRecord struct {
+	Zone      string `json:"zone"`
+	ID        int64  `json:"id"`
+	SubDomain string `json:"subDomain"`
+	Target    string `json:"target"`
+	TTL       int    `json:"ttl"`
+}
+
+// adminHandler lists the challenge records of the configured zones, to audit
+// and clean up orphan records without the OVH console. Requests must provide
+// the admin token as a bearer token.
+type adminHandler struct {
+	api   *ovhAPI
+	zones []string
+	// prefixes maps the zones whose challenge records use another prefix
+	// than _acme-challenge, like the challengePrefixes option of the
+	// issuers, to the prefix of their records.
+	prefixes map[string]string
+	token    string
+}
+
+// newAdminHandler returns the admin endpoint listing the challenge records of
+// the given zones, with the challenge prefixes of the zones that have one.
+func (s *ovhDNSProviderSolver) newAdminHandler(token string, zones []string, prefixes map[string]string) (*adminHandler, error) {
+	normalized := map[string]string{}
+	for zone, prefix := range prefixes {
+		if !zoneNamePattern.MatchString(normalizeName(zone)) {
+			return nil, fmt.Errorf("invalid zone %q in ADMIN_CHALLENGE_PREFIXES", zone)
+		}
+		if !challengePrefixPattern.MatchString(prefix) {
+			return nil, fmt.Errorf("invalid challenge prefix %q for zone %s in ADMIN_CHALLENGE_PREFIXES", prefix, zone)
+		}
+		normalized[normalizeName(zone)] = strings.ToLower(prefix)
+	}
+	api, err := s.environmentAPI()
+	if err != nil {
+		return nil, err
+	}
+	return &adminHandler{api: api, zones: zones, prefixes: normalized, token: token}, nil
+}
+
+func (h *adminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(h.token)) != 1 {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	records := []adminRecord{}
+	for _, zone := range h.zones {
+		zoneRecords, err := h.challengeRecords(r, zone)
+		if err != nil {
+			klog.Warningf("Unable to list challenge records of OVH zone %s: %v", zone, err)
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		records = append(records, zoneRecords...)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(records)
+}
+
+func (h *adminHandler) challengeRecords(r *http.Request, zone string) ([]adminRecord, error) {
+	ids, err := h.api.getIDs(r.Context(), operationList, "/domain/zone/"+zone+"/record?fieldType=TXT")
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	records := []adminRecord{}
+	for _, id := range ids {
+		record, err := getRecord(r.Context(), h.api, zone, id)
+		if isAPIError(err, http.StatusNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !h.isChallengeRecord(zone, record.SubDomain) {
+			continue
+		}
+		records = append(records, adminRecord{
+			Zone:      zone,
+			ID:        record.Id,
+			SubDomain: record.SubDomain,
+			Target:    record.Target,
+			TTL:       record.TTL,
+		})
+	}
+	return records, nil
+}
+
+// isChallengeRecord returns whether subDomain is the name of a challenge
+// record of the zone: a name starting with the challenge prefix of the zone,
+// or with _acme-challenge, which the records of the delegated challenges and
+// the records created before the prefix was set keep.
+func (h *adminHandler) isChallengeRecord(zone, subDomain string) bool {
+	subDomain = strings.ToLower(subDomain)
+	for _, prefix := range []string{h.prefixes[normalizeName(zone)], challengeRecordPrefix} {
+		if prefix != "" && (subDomain == prefix || strings.HasPrefix(subDomain, prefix+".")) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAdminHandler(t *testing.T) {
+	f := newFakeOVH(t, "example.com")
+	id := f.addRecord("example.com", ovhZoneRecord{FieldType: "TXT", SubDomain: "_acme-challenge.www", Target: "key", TTL: 60})
+	f.addRecord("example.com", ovhZoneRecord{FieldType: "TXT", SubDomain: "", Target: "v=spf1 -all"})
+	prefixed := f.addRecord("example.com", ovhZoneRecord{FieldType: "TXT", SubDomain: "_acme-dev.api", Target: "other", TTL: 60})
+	f.addRecord("example.com", ovhZoneRecord{FieldType: "TXT", SubDomain: "_acme-devx", Target: "v=DKIM1"})
+	h := &adminHandler{api: f.api(), zones: []string{"example.com"}, prefixes: map[string]string{"example.com": "_acme-dev"}, token: "secret"}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/admin/records", nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("unauthenticated request got status %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/admin/records", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", rec.Code, rec.Body)
+	}
+	records := []adminRecord{}
+	if err := json.NewDecoder(rec.Body).Decode(&records); err != nil {
+		t.Fatal(err)
+	}
+	want := []adminRecord{
+		{Zone: "example.com", ID: id, SubDomain: "_acme-challenge.www", Target: "key", TTL: 60},
+		{Zone: "example.com", ID: prefixed, SubDomain: "_acme-dev.api", Target: "other", TTL: 60},
+	}
+	if len(records) != 2 || records[0] != want[0] || records[1] != want[1] {
+		t.Errorf("got %+v, want %+v", records, want)
+	}
+
+	s := &ovhDNSProviderSolver{}
+	if _, err := s.newAdminHandler("secret", []string{"example.com"}, map[string]string{"example.com": "not a prefix"}); err == nil {
+		t.Error("expected an error for an invalid challenge prefix")
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/klog/v2"
+
+	"github.com/cert-manager/cert-manager/pkg/acme/webhook/apis/acme/v1alpha1"
+)
+
+const (
+	// ttlAnnotation sets the TTL of the record of a challenge, on the
+	// Challenge or on the Certificate it was created for, when the
+	// ttlFromAnnotation option is set.
+	ttlAnnotation = "cert-manager-webhook-ovh.baarde.github.io/ttl"
+	// maxAnnotatedTTL bounds the TTL set by an annotation, which any user
+	// allowed to edit a Certificate can set: a challenge record does not need
+	// to be cached longer than a day.
+	maxAnnotatedTTL = 86400
+)
+
+var (
+	challengesResource          = schema.GroupVersionResource{Group: "acme.cert-manager.io", Version: "v1", Resource: "challenges"}
+	ordersResource              = schema.GroupVersionResource{Group: "acme.cert-manager.io", Version: "v1", Resource: "orders"}
+	certificateRequestsResource = schema.GroupVersionResource{Group: "cert-manager.io", Version: "v1", Resource: "certificaterequests"}
+	certificatesResource        = schema.GroupVersionResource{Group: "cert-manager.io", Version: "v1", Resource: "certificates"}
+)
+
+// annotatedTTL returns the TTL set by the ttlAnnotation of the Challenge of
+// ch or, when the Challenge has none, of the Certificate it was created for.
+// It returns false when neither sets a valid TTL, in which case the TTL of the
+// config applies.
+func (s *ovhDNSProviderSolver) annotatedTTL(ctx context.Context, ch *v1alpha1.ChallengeRequest) (int, bool) {
+	if s.resources == nil {
+		return 0, false
+	}
+	challenge, err := s.findChallenge(ctx, ch)
+	if err != nil {
+		klog.Warningf("Unable to find the Challenge of %s for its TTL annotation, using the configured TTL: %v", ch.ResolvedFQDN, err)
+		return 0, false
+	}
+	objects := []*unstructured.Unstructured{challenge}
+	if _, ok := challenge.GetAnnotations()[ttlAnnotation]; !ok {
+		certificate, err := s.findCertificate(ctx, challenge)
+		if err != nil {
+			klog.Warningf("Unable to find the Certificate of %s for its TTL annotation, using the configured TTL: %v", ch.ResolvedFQDN, err)
+			return 0, false
+		}
+		objects = append(objects, certificate)
+	}
+	for _, obj := range objects {
+		value, ok := obj.GetAnnotations()[ttlAnnotation]
+		if !ok {
+			continue
+		}
+		ttl, err := parseAnnotatedTTL(value)
+		if err != nil {
+			klog.Warningf("Ignoring the %s annotation of %s %s/%s, using the configured TTL: %v", ttlAnnotation, obj.GetKind(), obj.GetNamespace(), obj.GetName(), err)
+			return 0, false
+		}
+		return ttl, true
+	}
+	return 0, false
+}
+
+// parseAnnotatedTTL parses a TTL in seconds, between 0 (the default TTL of
+// the zone) and maxAnnotatedTTL.
+func parseAnnotatedTTL(value string) (int, error) {
+	ttl, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil {
+		return 0, fmt.Errorf("invalid TTL %q", value)
+	}
+	if ttl < 0 || ttl > maxAnnotatedTTL {
+		return 0, fmt.Errorf("TTL %d out of range: expected 0 to %d", ttl, maxAnnotatedTTL)
+	}
+	return ttl, nil
+}
+
+// logOrder logs the ACME order and challenge URLs of the record presented for
+// ch, to correlate a record of the OVH zone with an ACME order. OVH records
+// have no comment field and the target must be the challenge key, so the
+// record is identified by its ID in the log line instead.
+func (s *ovhDNSProviderSolver) logOrder(ctx context.Context, ch *v1alpha1.ChallengeRequest, c *challenge, id int64) {
+	if s.resources == nil {
+		return
+	}
+	challenge, err := s.findChallenge(ctx, ch)
+	if err != nil {
+		klog.Warningf("Unable to find the Challenge of %s for its ACME order: %v", ch.ResolvedFQDN, err)
+		return
+	}
+	challengeURL, _, _ := unstructured.NestedString(challenge.Object, "spec", "url")
+	order, err := s.owner(ctx, challenge, "Order", ordersResource)
+	if err != nil {
+		klog.Warningf("Unable to find the Order of %s: %v", ch.ResolvedFQDN, err)
+		return
+	}
+	orderURL, _, _ := unstructured.NestedString(order.Object, "status", "url")
+	klog.Infof("TXT record %d for %s in zone %s belongs to ACME order %s (challenge %s, Order %s/%s)", id, c.subDomain, c.domain, orderURL, challengeURL, order.GetNamespace(), order.GetName())
+}
+
+// findChallenge returns the Challenge of ch. The challenge requests do not
+// reference their Challenge, which is found by its DNS name and key instead.
+func (s *ovhDNSProviderSolver) findChallenge(ctx context.Context, ch *v1alpha1.ChallengeRequest) (*unstructured.Unstructured, error) {
+	challenges, err := s.resources.Resource(challengesResource).Namespace(ch.ResourceNamespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	for i := range challenges.Items {
+		challenge := &challenges.Items[i]
+		key, _, _ := unstructured.NestedString(challenge.Object, "spec", "key")
+		dnsName, _, _ := unstructured.NestedString(challenge.Object, "spec", "dnsName")
+		if key == ch.Key && dnsName == ch.DNSName {
+			return challenge, nil
+		}
+	}
+	return nil, fmt.Errorf("no Challenge for %s in namespace %s", ch.DNSName, ch.ResourceNamespace)
+}
+
+// findCertificate returns the Certificate a Challenge was created for,
+// through the Order and the CertificateRequest that own it.
+func (s *ovhDNSProviderSolver) findCertificate(ctx context.Context, challenge *unstructured.Unstructured) (*unstructured.Unstructured, error) {
+	order, err := s.owner(ctx, challenge, "Order", ordersResource)
+	if err != nil {
+		return nil, err
+	}
+	request, err := s.owner(ctx, order, "CertificateRequest", certificateRequestsResource)
+	if err != nil {
+		return nil, err
+	}
+	return s.owner(ctx, request, "Certificate", certificatesResource)
+}
+
+// owner returns the owner of obj of the given kind.
+func (s *ovhDNSProviderSolver) owner(ctx context.Context, obj *unstructured.Unstructured, kind string, resource schema.GroupVersionResource) (*unstructured.Unstructured, error) {
+	for _, ref := range obj.GetOwnerReferences() {
+		if ref.Kind == kind {
+			return s.resources.Resource(resource).Namespace(obj.GetNamespace()).Get(ctx, ref.Name, metav1.GetOptions{})
+		}
+	}
+	return nil, fmt.Errorf("%s %s/%s has no %s owner", obj.GetKind(), obj.GetNamespace(), obj.GetName(), kind)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+
+	"github.com/cert-manager/cert-manager/pkg/acme/webhook/apis/acme/v1alpha1"
+)
+
+func testResource(apiVersion, kind, name, ownerKind, ownerName string, annotations map[string]string) *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": apiVersion,
+		"kind":       kind,
+		"metadata": map[string]interface{}{
+			"namespace": "default",
+			"name":      name,
+		},
+	}}
+	if ownerKind != "" {
+		obj.Object["metadata"].(map[string]interface{})["ownerReferences"] = []interface{}{
+			map[string]interface{}{"apiVersion": "v1", "kind": ownerKind, "name": ownerName, "uid": ownerName},
+		}
+	}
+	obj.SetAnnotations(annotations)
+	return obj
+}
+
+func newTestResources(challengeAnnotations, certificateAnnotations map[string]string) *dynamicfake.FakeDynamicClient {
+	challenge := testResource("acme.cert-manager.io/v1", "Challenge", "www-1-2-3", "Order", "www-1-2", challengeAnnotations)
+	challenge.Object["spec"] = map[string]interface{}{"key": "key", "dnsName": "www.example.com", "url": "https://acme.example/chall/3"}
+	other := testResource("acme.cert-manager.io/v1", "Challenge", "api-1-2-3", "Order", "api-1-2", map[string]string{ttlAnnotation: "3600"})
+	other.Object["spec"] = map[string]interface{}{"key": "other", "dnsName": "api.example.com"}
+	order := testResource("acme.cert-manager.io/v1", "Order", "www-1-2", "CertificateRequest", "www-1", nil)
+	order.Object["status"] = map[string]interface{}{"url": "https://acme.example/order/2"}
+	return dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{challengesResource: "ChallengeList"},
+		challenge,
+		other,
+		order,
+		testResource("cert-manager.io/v1", "CertificateRequest", "www-1", "Certificate", "www", nil),
+		testResource("cert-manager.io/v1", "Certificate", "www", "", "", certificateAnnotations),
+	)
+}
+
+func TestAnnotatedTTL(t *testing.T) {
+	ch := &v1alpha1.ChallengeRequest{
+		ResourceNamespace: "default",
+		DNSName:           "www.example.com",
+		ResolvedFQDN:      "_acme-challenge.www.example.com.",
+		Key:               "key",
+	}
+	tests := []struct {
+		name                   string
+		challenge, certificate map[string]string
+		ttl                    int
+		ok                     bool
+	}{
+		{"challenge", map[string]string{ttlAnnotation: "120"}, map[string]string{ttlAnnotation: "300"}, 120, true},
+		{"certificate", nil, map[string]string{ttlAnnotation: " 300 "}, 300, true},
+		{"none", nil, nil, 0, false},
+		{"invalid", map[string]string{ttlAnnotation: "1m"}, map[string]string{ttlAnnotation: "300"}, 0, false},
+		{"out of range", nil, map[string]string{ttlAnnotation: "604800"}, 0, false},
+	}
+	for _, test := range tests {
+		s := &ovhDNSProviderSolver{resources: newTestResources(test.challenge, test.certificate)}
+		ttl, ok := s.annotatedTTL(context.Background(), ch)
+		if ttl != test.ttl || ok != test.ok {
+			t.Errorf("%s: annotatedTTL = %d, %v, expected %d, %v", test.name, ttl, ok, test.ttl, test.ok)
+		}
+	}
+
+	// Without the access to the cert-manager resources, the configured TTL
+	// applies.
+	if _, ok := (&ovhDNSProviderSolver{}).annotatedTTL(context.Background(), ch); ok {
+		t.Error("expected no TTL without a client")
+	}
+}
+
+func TestLogOrder(t *testing.T) {
+	logs := captureLogs(t)
+	s := &ovhDNSProviderSolver{resources: newTestResources(nil, nil)}
+	ch := &v1alpha1.ChallengeRequest{
+		ResourceNamespace: "default",
+		DNSName:           "www.example.com",
+		ResolvedFQDN:      "_acme-challenge.www.example.com.",
+		Key:               "key",
+	}
+	s.logOrder(context.Background(), ch, &challenge{domain: "example.com", subDomain: "_acme-challenge.www"}, 42)
+	expected := "TXT record 42 for _acme-challenge.www in zone example.com belongs to ACME order https://acme.example/order/2 (challenge https://acme.example/chall/3, Order default/www-1-2)"
+	if !strings.Contains(logs.String(), expected) {
+		t.Errorf("expected %q in the logs, got %s", expected, logs)
+	}
+}
@@ -0,0 +1,620 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	neturl "net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+
+	"github.com/ovh/go-ovh/ovh"
+)
+
+// operation identifies a class of OVH API calls sharing the same timeout.
+type operation string
+
+const (
+	operationList     operation = "list"
+	operationCreate   operation = "create"
+	operationDelete   operation = "delete"
+	operationRefresh  operation = "refresh"
+	operationTaskWait operation = "taskWait"
+)
+
+// ovhAPI wraps an OVH client with the policy applied to every API call made
+// on behalf of a challenge.
+type ovhAPI struct {
+	client *ovh.Client
+	// endpoint is the base URL of the OVH API targeted by client.
+	endpoint string
+	timeouts operationTimeouts
+	limiter  *rateLimiter
+	breaker  *circuitBreaker
+	// fallback, when set, replaces client for the remaining calls once a
+	// call still cannot reach the OVH API after its retries.
+	fallback *ovhAPI
+	// rotation, when set, holds the consumer keys the calls are spread
+	// across, client first, picked in turn by rotationNext.
+	rotation     []rotatedKey
+	rotationNext *atomic.Uint64
+
+	// refreshes coalesces the zone refreshes requested within refreshWindow.
+	refreshes     *refreshCoalescer
+	refreshWindow time.Duration
+	// refreshFailure is the refreshFailure option, refreshFailureFail when
+	// empty.
+	refreshFailure string
+	// autoRefresh, when set, skips the refreshes of the zones detected as
+	// deploying changes by themselves.
+	autoRefresh *autoRefreshDetector
+	// ttlRanges, when set, clamps the TTLs of the created records to the
+	// range learned for their zone.
+	ttlRanges *zoneTTLRanges
+	// records, when set, tells the records created by the webhook apart
+	// from the other records of a zone.
+	records *recordStore
+
+	// retries is the retry budget shared by the calls made for a challenge.
+	// When nil, each call gets its own budget.
+	retries *retryBudget
+
+	// headers are the OVH context headers (e.g. to act on behalf of another
+	// account) added to every request.
+	headers map[string]string
+
+	// verifySerial checks that the serial of the zone advances after each
+	// refresh.
+	verifySerial bool
+
+	// steps, when set, measures the steps of the Present the client is used
+	// for.
+	steps *stepTimer
+}
+
+// rotatedKey is a consumer key the calls are spread across, with the rate
+// limiter of its account.
+type rotatedKey struct {
+	client  *ovh.Client
+	limiter *rateLimiter
+}
+
+func newOVHAPI(client *ovh.Client, timeouts operationTimeouts, limiter *rateLimiter) *ovhAPI {
+	// Timeouts are enforced per call through the request context. The client
+	// timeout only bounds the calls made by go-ovh itself, like /auth/time.
+	client.Timeout = 0
+	for _, timeout := range timeouts {
+		if timeout > client.Timeout {
+			client.Timeout = timeout
+		}
+	}
+	return &ovhAPI{
+		client:   client,
+		endpoint: clientEndpoint(client),
+		timeouts: timeouts,
+		limiter:  limiter,
+	}
+}
+
+// clientEndpoint returns the base URL of the OVH API targeted by client,
+// which go-ovh does not expose.
+func clientEndpoint(client *ovh.Client) string {
+	req, err := client.NewRequest("GET", "", nil, false)
+	if err != nil {
+		return ""
+	}
+	return req.URL.String()
+}
+
+// account identifies the OVH account on behalf of which the calls are made:
+// the endpoint, the consumer key and the context headers.
+func (api *ovhAPI) account() string {
+	names := make([]string, 0, len(api.headers))
+	for name := range api.headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	account := api.endpoint + "\n" + api.client.ConsumerKey
+	for _, name := range names {
+		account += "\n" + http.CanonicalHeaderKey(name) + ": " + api.headers[name]
+	}
+	return account
+}
+
+func (api *ovhAPI) get(ctx context.Context, op operation, url string, resType interface{}) error {
+	return api.call(ctx, op, "GET", url, nil, resType)
+}
+
+func (api *ovhAPI) post(ctx context.Context, op operation, url string, reqBody, resType interface{}) error {
+	return api.call(ctx, op, "POST", url, reqBody, resType)
+}
+
+func (api *ovhAPI) put(ctx context.Context, op operation, url string, reqBody, resType interface{}) error {
+	return api.call(ctx, op, "PUT", url, reqBody, resType)
+}
+
+func (api *ovhAPI) delete(ctx context.Context, op operation, url string) error {
+	return api.call(ctx, op, "DELETE", url, nil, nil)
+}
+
+func (api *ovhAPI) call(ctx context.Context, op operation, method, url string, reqBody, resType interface{}) error {
+	retries := api.retries
+	if retries == nil {
+		retries = newRetryBudget(defaultRetryBudget)
+	}
+	for {
+		err := api.do(ctx, op, method, url, reqBody, resType)
+		if err == nil {
+			return nil
+		}
+		// OVH rejects the calls with a 409 Conflict while the zone is locked
+		// by another operation, and the changes while the task queue of the
+		// zone is full, so they are safe to retry.
+		class := errorClass(err)
+		if class != "" {
+			apiErrors.WithLabelValues(class).Inc()
+		}
+		delay := retryDelay
+		switch {
+		case class == errorClassAuth:
+			return fmt.Errorf("OVH API call failed: %s %s - the OVH credentials were rejected, check the application key, the consumer key and the access rules granted to it: %w", method, url, err)
+		case class == errorClassTransport:
+			if !isTransientTransportError(err, method) {
+				return fmt.Errorf("OVH API call failed: %s %s - unable to reach the OVH API: %w", method, url, err)
+			}
+			if !retries.take() {
+				if !api.useFallback(ctx, err) {
+					return fmt.Errorf("OVH API call failed: %s %s - unable to reach the OVH API: %w", method, url, err)
+				}
+				// The retries were used up on the failing endpoint.
+				retries.refill()
+				continue
+			}
+			klog.Warningf("OVH API unreachable, retrying %s %s: %v", method, url, err)
+		case isTaskQueueFull(err):
+			if !retries.take() {
+				return fmt.Errorf("OVH API call failed: %s %s - the task queue of the zone is full, too many changes are waiting to be deployed: %w", method, url, err)
+			}
+			klog.Warningf("OVH zone task queue is full, retrying %s %s in %v: %v", method, url, taskQueueRetryDelay, err)
+			delay = taskQueueRetryDelay
+		case !isAPIError(err, http.StatusConflict) || !retries.take():
+			return fmt.Errorf("OVH API call failed: %s %s - %w", method, url, err)
+		default:
+			klog.V(2).Infof("OVH zone is locked, retrying %s %s: %v", method, url, err)
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("OVH API call failed: %s %s - %w", method, url, ctx.Err())
+		case <-time.After(delay):
+		}
+	}
+}
+
+// useFallback switches the client to the fallback endpoint, if any, after
+// checking that the credentials are valid for it, and returns whether the
+// failed call can be retried there. The fallback is only tried once, and its
+// calls are paused by its own rate limit.
+func (api *ovhAPI) useFallback(ctx context.Context, cause error) bool {
+	fallback := api.fallback
+	if fallback == nil {
+		return false
+	}
+	api.fallback = nil
+	err := fallback.checkCredential(ctx)
+	if err != nil {
+		klog.Warningf("OVH API %s unreachable, and the fallback endpoint %s is unusable with the credentials of the issuer: %v", api.endpoint, fallback.endpoint, err)
+		return false
+	}
+	klog.Warningf("OVH API %s unreachable, switching to the fallback endpoint %s: %v", api.endpoint, fallback.endpoint, cause)
+	// The other consumer keys are not checked on the fallback endpoint.
+	api.rotation = nil
+	api.client = fallback.client
+	api.endpoint = fallback.endpoint
+	api.breaker = fallback.breaker
+	api.limiter = fallback.limiter
+	return true
+}
+
+// checkCredential checks that the OVH API accepts the credentials of api,
+// with a single attempt.
+func (api *ovhAPI) checkCredential(ctx context.Context) error {
+	credential := struct {
+		Status string `json:"status"`
+	}{}
+	err := api.do(ctx, operationList, http.MethodGet, "/auth/currentCredential", nil, &credential)
+	if err == nil && credential.Status != "validated" {
+		err = fmt.Errorf("%w: %s", errCredentialNotValidated, credential.Status)
+	}
+	return err
+}
+
+// errCredentialNotValidated reports a consumer key known to OVH but not
+// usable, e.g. expired or still pending validation.
+var errCredentialNotValidated = errors.New("consumer key not validated")
+
+// pick returns the client of the next call and its rate limiter. Across the
+// rotation, it takes the next key in turn with budget left, so that a key
+// whose rate limit is almost exhausted does not pause the calls the other keys
+// can make. When no key has budget left, the next key in turn is waited for.
+func (api *ovhAPI) pick() (*ovh.Client, *rateLimiter) {
+	if len(api.rotation) == 0 {
+		return api.client, api.limiter
+	}
+	n := uint64(len(api.rotation))
+	next := api.rotationNext.Add(1)
+	for i := uint64(0); i < n; i++ {
+		key := api.rotation[(next+i)%n]
+		if key.limiter.available() {
+			return key.client, key.limiter
+		}
+	}
+	key := api.rotation[next%n]
+	return key.client, key.limiter
+}
+
+// do makes a single attempt of a call. The timeout of the operation only
+// applies to the request itself, not to the rate limit pause before it.
+func (api *ovhAPI) do(ctx context.Context, op operation, method, url string, reqBody, resType interface{}) error {
+	client, limiter := api.pick()
+	err := limiter.wait(ctx)
+	if err != nil {
+		return err
+	}
+	// The circuit is checked once the call is about to be sent, so that a
+	// probe is not held while waiting for the rate limiter.
+	done, err := api.breaker.allow()
+	if err != nil {
+		return err
+	}
+	defer func() { done(err) }()
+	ctx, cancel := context.WithTimeout(ctx, api.timeouts[op])
+	defer cancel()
+	err = api.send(ctx, client, limiter, method, url, reqBody, resType)
+	return err
+}
+
+func (api *ovhAPI) send(ctx context.Context, client *ovh.Client, limiter *rateLimiter, method, url string, reqBody, resType interface{}) error {
+	req, err := client.NewRequest(method, url, reqBody, true)
+	if err != nil {
+		return err
+	}
+	for name, value := range api.headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	if limiter != nil {
+		limiter.update(resp.Header)
+	}
+	return client.UnmarshalResponse(resp, resType)
+}
+
+// getIDs lists IDs, like the records or the tasks of a zone.
+func (api *ovhAPI) getIDs(ctx context.Context, op operation, url string) ([]int64, error) {
+	ids := []ovhID{}
+	err := api.get(ctx, op, url, &ids)
+	if err != nil {
+		return nil, err
+	}
+	int64IDs := make([]int64, len(ids))
+	for i, id := range ids {
+		int64IDs[i] = int64(id)
+	}
+	return int64IDs, nil
+}
+
+// ovhID is an ID returned by the OVH API. OVH returns numbers, but strings are
+// accepted as well so that a change of representation does not break the
+// decoding of the responses.
+type ovhID int64
+
+func (id *ovhID) UnmarshalJSON(data []byte) error {
+	var value int64
+	if len(data) > 0 && data[0] == '"' {
+		var s string
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+		parsed, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid OVH ID %q: %v", s, err)
+		}
+		value = parsed
+	} else if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	*id = ovhID(value)
+	return nil
+}
+
+// The classes of the failed OVH API calls, as reported by the api_errors_total
+// metric.
+const (
+	// errorClassTransport is a call that got no response from the OVH API,
+	// e.g. because the OVH host could not be resolved or the TLS handshake
+	// failed. go-ovh returns these errors as is, not as an ovh.APIError.
+	errorClassTransport = "transport"
+	// errorClassAuth is a call rejected because of the credentials.
+	errorClassAuth = "auth"
+	// errorClassAPI is any other call rejected by the OVH API.
+	errorClassAPI = "api"
+)
+
+// errorClass returns the class of the error of a call, or "" when the call
+// was not made or was given up by the caller.
+func errorClass(err error) string {
+	var apiErr *ovh.APIError
+	var urlErr *neturl.Error
+	switch {
+	case isContextError(err):
+		return ""
+	case errors.As(err, &apiErr):
+		if apiErr.Code == http.StatusUnauthorized || apiErr.Code == http.StatusForbidden && !isTaskQueueFull(err) && !isRecordLimitReached(err) {
+			return errorClassAuth
+		}
+		return errorClassAPI
+	case errors.As(err, &urlErr):
+		// The HTTP client returns a *url.Error for any failure to get a
+		// response, including the /auth/time call made by go-ovh to sign
+		// the requests.
+		return errorClassTransport
+	}
+	return ""
+}
+
+// isTransientTransportError returns whether a call that got no response from
+// the OVH API can be retried. Certificate errors do not go away by
+// themselves. Only the connection failures are retried for the calls that are
+// not idempotent: a create that reached OVH before the connection broke would
+// otherwise leave a duplicate record.
+func isTransientTransportError(err error, method string) bool {
+	var certErr *tls.CertificateVerificationError
+	if errors.As(err, &certErr) {
+		return false
+	}
+	if method == http.MethodGet || method == http.MethodDelete {
+		return true
+	}
+	var dnsErr *net.DNSError
+	var opErr *net.OpError
+	return errors.As(err, &dnsErr) || errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// isRecordLimitReached returns whether OVH refused to create a record because
+// the zone holds its maximum number of records. Like for isTaskQueueFull, it
+// is recognized from the message of the client error.
+func isRecordLimitReached(err error) bool {
+	var apiErr *ovh.APIError
+	if !errors.As(err, &apiErr) || !isAPIError(err, http.StatusBadRequest, http.StatusForbidden) || isTaskQueueFull(err) {
+		return false
+	}
+	message := strings.ToLower(apiErr.Message)
+	return strings.Contains(message, "record") && (strings.Contains(message, "maximum") || strings.Contains(message, "limit"))
+}
+
+// isTaskQueueFull returns whether OVH rejected a call because the zone has
+// too many pending tasks. OVH has no dedicated error class for it, so it is
+// recognized from the message of the client error.
+func isTaskQueueFull(err error) bool {
+	var apiErr *ovh.APIError
+	if !errors.As(err, &apiErr) || !isAPIError(err, http.StatusForbidden, http.StatusConflict, http.StatusTooManyRequests) {
+		return false
+	}
+	message := strings.ToLower(apiErr.Message)
+	if !strings.Contains(message, "task") {
+		return false
+	}
+	for _, hint := range []string{"too many", "maximum", "limit", "queue", "full"} {
+		if strings.Contains(message, hint) {
+			return true
+		}
+	}
+	return false
+}
+
+// isAPIError returns whether err is an error returned by the OVH API with one
+// of the given HTTP status codes.
+func isAPIError(err error, codes ...int) bool {
+	var apiErr *ovh.APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	for _, code := range codes {
+		if apiErr.Code == code {
+			return true
+		}
+	}
+	return false
+}
+
+// operationTimeouts holds the timeout of each class of operations.
+type operationTimeouts map[operation]time.Duration
+
+// ovhTimeoutsConfig is the timeout configuration that can be provided in the
+// issuer config or through environment variables. Operations without a
+// specific timeout use the default one.
+type ovhTimeoutsConfig struct {
+	Default  *metav1.Duration `json:"default,omitempty"`
+	List     *metav1.Duration `json:"list,omitempty"`
+	Create   *metav1.Duration `json:"create,omitempty"`
+	Delete   *metav1.Duration `json:"delete,omitempty"`
+	Refresh  *metav1.Duration `json:"refresh,omitempty"`
+	TaskWait *metav1.Duration `json:"taskWait,omitempty"`
+}
+
+func (cfg *ovhTimeoutsConfig) byOperation() map[operation]*metav1.Duration {
+	return map[operation]*metav1.Duration{
+		operationList:     cfg.List,
+		operationCreate:   cfg.Create,
+		operationDelete:   cfg.Delete,
+		operationRefresh:  cfg.Refresh,
+		operationTaskWait: cfg.TaskWait,
+	}
+}
+
+// validate checks that the configured timeouts are positive. source names
+// where the config comes from, for the error messages.
+func (cfg *ovhTimeoutsConfig) validate(source string) error {
+	if cfg.Default != nil && cfg.Default.Duration <= 0 {
+		return fmt.Errorf("invalid default timeout in %s: %v", source, cfg.Default.Duration)
+	}
+	for op, d := range cfg.byOperation() {
+		if d != nil && d.Duration <= 0 {
+			return fmt.Errorf("invalid %s timeout in %s: %v", op, source, d.Duration)
+		}
+	}
+	return nil
+}
+
+// timeoutsFromEnv reads the timeout configuration from the OVH_API_TIMEOUT
+// and OVH_API_<OPERATION>_TIMEOUT environment variables.
+func timeoutsFromEnv() (ovhTimeoutsConfig, error) {
+	cfg := ovhTimeoutsConfig{}
+	vars := map[string]**metav1.Duration{
+		"OVH_API_TIMEOUT":           &cfg.Default,
+		"OVH_API_LIST_TIMEOUT":      &cfg.List,
+		"OVH_API_CREATE_TIMEOUT":    &cfg.Create,
+		"OVH_API_DELETE_TIMEOUT":    &cfg.Delete,
+		"OVH_API_REFRESH_TIMEOUT":   &cfg.Refresh,
+		"OVH_API_TASK_WAIT_TIMEOUT": &cfg.TaskWait,
+	}
+	for name, field := range vars {
+		d, err := durationFromEnv(name)
+		if err != nil {
+			return cfg, err
+		}
+		*field = d
+	}
+	return cfg, nil
+}
+
+// resolveTimeouts computes the timeout of each operation. The issuer config
+// takes precedence over the environment; the task wait falls back to
+// taskWaitTimeout and the other operations to the go-ovh default timeout.
+func resolveTimeouts(cfg, env ovhTimeoutsConfig) (operationTimeouts, error) {
+	if err := cfg.validate("OVH config"); err != nil {
+		return nil, err
+	}
+	if err := env.validate("the OVH_API_*TIMEOUT environment variables"); err != nil {
+		return nil, err
+	}
+	envByOp := env.byOperation()
+	timeouts := operationTimeouts{}
+	for op, d := range cfg.byOperation() {
+		var timeout time.Duration
+		if op == operationTaskWait {
+			timeout = firstDuration(taskWaitTimeout, d, envByOp[op])
+		} else {
+			timeout = firstDuration(ovh.DefaultTimeout, d, cfg.Default, envByOp[op], env.Default)
+		}
+		timeouts[op] = timeout
+	}
+	return timeouts, nil
+}
+
+func firstDuration(fallback time.Duration, durations ...*metav1.Duration) time.Duration {
+	for _, d := range durations {
+		if d != nil {
+			return d.Duration
+		}
+	}
+	return fallback
+}
+
+// reservedOVHHeaders are the headers set by go-ovh to authenticate requests.
+var reservedOVHHeaders = []string{
+	"X-Ovh-Application",
+	"X-Ovh-Consumer",
+	"X-Ovh-Signature",
+	"X-Ovh-Timestamp",
+}
+
+// validateOVHHeaders checks that the context headers are X-Ovh-* headers that
+// do not replace the authentication headers.
+func validateOVHHeaders(headers map[string]string) error {
+	for name := range headers {
+		canonical := http.CanonicalHeaderKey(name)
+		if !strings.HasPrefix(canonical, "X-Ovh-") {
+			return fmt.Errorf("invalid OVH header %q in OVH config: only X-Ovh-* headers are allowed", name)
+		}
+		for _, reserved := range reservedOVHHeaders {
+			if canonical == reserved {
+				return fmt.Errorf("invalid OVH header %q in OVH config: the header is set by the OVH client", name)
+			}
+		}
+	}
+	return nil
+}
+
+// reservedHTTPHeaders are the headers set by go-ovh or by the HTTP client,
+// besides the X-Ovh-* ones.
+var reservedHTTPHeaders = []string{
+	"Accept",
+	"Content-Length",
+	"Content-Type",
+	"Host",
+	"User-Agent",
+}
+
+// validateHTTPHeaders checks that the extra HTTP headers do not replace the
+// headers of the OVH API requests. X-Ovh-* headers are signed along with the
+// request and belong in ovhHeaders.
+func validateHTTPHeaders(headers map[string]string, source string) error {
+	for name := range headers {
+		canonical := http.CanonicalHeaderKey(name)
+		if strings.HasPrefix(canonical, "X-Ovh-") {
+			return fmt.Errorf("invalid HTTP header %q in %s: use ovhHeaders for X-Ovh-* headers", name, source)
+		}
+		for _, reserved := range reservedHTTPHeaders {
+			if canonical == reserved {
+				return fmt.Errorf("invalid HTTP header %q in %s: the header is set by the OVH client", name, source)
+			}
+		}
+	}
+	return nil
+}
+
+// mergeHeaders merges sets of headers, the last ones taking precedence.
+func mergeHeaders(sets ...map[string]string) map[string]string {
+	merged := map[string]string{}
+	for _, headers := range sets {
+		for name, value := range headers {
+			merged[http.CanonicalHeaderKey(name)] = value
+		}
+	}
+	return merged
+}
+
+// headerTransport adds static headers to the requests, e.g. for an API
+// gateway in front of the OVH API. They are added after go-ovh signed the
+// request and never replace a header already set.
+type headerTransport struct {
+	base    http.RoundTripper
+	headers map[string]string
+}
+
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	for name, value := range t.headers {
+		if req.Header.Get(name) == "" {
+			req.Header.Set(name, value)
+		}
+	}
+	base := t.base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return base.RoundTrip(req)
+}
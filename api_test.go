@@ -0,0 +1,329 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	neturl "net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/ovh/go-ovh/ovh"
+)
+
+func duration(d time.Duration) *metav1.Duration {
+	return &metav1.Duration{Duration: d}
+}
+
+func TestResolveTimeouts(t *testing.T) {
+	cfg := ovhTimeoutsConfig{
+		Default: duration(time.Minute),
+		Create:  duration(10 * time.Second),
+	}
+	env := ovhTimeoutsConfig{
+		Default:  duration(time.Hour),
+		Create:   duration(time.Hour),
+		Refresh:  duration(5 * time.Minute),
+		TaskWait: duration(3 * time.Minute),
+	}
+
+	timeouts, err := resolveTimeouts(cfg, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := operationTimeouts{
+		operationList:     time.Minute,
+		operationCreate:   10 * time.Second,
+		operationDelete:   time.Minute,
+		operationRefresh:  time.Minute,
+		operationTaskWait: 3 * time.Minute,
+	}
+	for op, timeout := range expected {
+		if timeouts[op] != timeout {
+			t.Errorf("%s timeout = %v, expected %v", op, timeouts[op], timeout)
+		}
+	}
+
+	timeouts, err = resolveTimeouts(ovhTimeoutsConfig{}, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if timeouts[operationRefresh] != 5*time.Minute || timeouts[operationList] != time.Hour {
+		t.Errorf("environment timeouts not applied: %v", timeouts)
+	}
+
+	timeouts, err = resolveTimeouts(ovhTimeoutsConfig{}, ovhTimeoutsConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if timeouts[operationList] != ovh.DefaultTimeout || timeouts[operationTaskWait] != taskWaitTimeout {
+		t.Errorf("default timeouts not applied: %v", timeouts)
+	}
+
+	_, err = resolveTimeouts(ovhTimeoutsConfig{Delete: duration(-time.Second)}, env)
+	if err == nil || !strings.Contains(err.Error(), "in OVH config") {
+		t.Errorf("expected an error for a negative timeout in the issuer config, got %v", err)
+	}
+	_, err = resolveTimeouts(ovhTimeoutsConfig{}, ovhTimeoutsConfig{Default: duration(0)})
+	if err == nil || !strings.Contains(err.Error(), "environment variables") {
+		t.Errorf("expected an error for a zero timeout in the environment, got %v", err)
+	}
+}
+
+func TestValidateOVHHeaders(t *testing.T) {
+	valid := map[string]string{"X-Ovh-Account": "xx1234-ovh", "x-ovh-custom": "value"}
+	if err := validateOVHHeaders(valid); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	for _, name := range []string{"Authorization", "x-ovh-signature", "X-Ovh-Consumer"} {
+		if err := validateOVHHeaders(map[string]string{name: "value"}); err == nil {
+			t.Errorf("expected an error for header %q", name)
+		}
+	}
+}
+
+func TestValidateHTTPHeaders(t *testing.T) {
+	valid := map[string]string{"Authorization": "Bearer token", "x-gateway-route": "dns"}
+	if err := validateHTTPHeaders(valid, "test"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	for _, name := range []string{"X-Ovh-Signature", "x-ovh-account", "content-type", "User-Agent"} {
+		if err := validateHTTPHeaders(map[string]string{name: "value"}, "test"); err == nil {
+			t.Errorf("expected an error for header %q", name)
+		}
+	}
+}
+
+func TestHeaderTransport(t *testing.T) {
+	received := make(chan http.Header, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Header
+	}))
+	defer server.Close()
+
+	headers := mergeHeaders(map[string]string{"x-route": "env", "X-Tenant": "env"}, map[string]string{"X-Route": "issuer"})
+	client := &http.Client{Transport: &headerTransport{headers: headers}}
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	req.Header.Set("X-Tenant", "request")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	header := <-received
+	if header.Get("X-Route") != "issuer" || header.Get("X-Tenant") != "request" {
+		t.Errorf("unexpected headers %v", header)
+	}
+}
+
+func TestOVHIDUnmarshal(t *testing.T) {
+	for _, body := range []string{`[12, 34]`, `["12", "34"]`} {
+		ids := []ovhID{}
+		if err := json.Unmarshal([]byte(body), &ids); err != nil {
+			t.Fatalf("%s: %v", body, err)
+		}
+		if len(ids) != 2 || ids[0] != 12 || ids[1] != 34 {
+			t.Errorf("%s: got %v", body, ids)
+		}
+	}
+	for _, body := range []string{`{"id": 12, "target": "key"}`, `{"id": "12", "target": "key"}`} {
+		record := ovhZoneRecord{}
+		if err := json.Unmarshal([]byte(body), &record); err != nil {
+			t.Fatalf("%s: %v", body, err)
+		}
+		if record.Id != 12 || record.Target != "key" {
+			t.Errorf("%s: got %+v", body, record)
+		}
+	}
+	if err := json.Unmarshal([]byte(`["abc"]`), &[]ovhID{}); err == nil {
+		t.Error("expected an error for a non-numeric ID")
+	}
+}
+
+func TestCallRetriesFullTaskQueue(t *testing.T) {
+	previous, previousTaskQueue := retryDelay, taskQueueRetryDelay
+	retryDelay, taskQueueRetryDelay = time.Hour, time.Millisecond
+	t.Cleanup(func() { retryDelay, taskQueueRetryDelay = previous, previousTaskQueue })
+	f := newFakeOVH(t, "example.com")
+	const call = "POST /domain/zone/example.com/refresh"
+	f.failWith(call, "Too many tasks pending on this zone", http.StatusForbidden, http.StatusForbidden)
+
+	// The call is retried after the task queue delay, not the lock delay.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	api := f.api()
+	if err := api.post(ctx, operationRefresh, "/domain/zone/example.com/refresh", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if n := f.countCalls(call); n != 3 {
+		t.Errorf("expected 3 calls, got %d", n)
+	}
+
+	api.retries = newRetryBudget(0)
+	f.failWith(call, "Too many tasks pending on this zone", http.StatusForbidden)
+	err := api.post(ctx, operationRefresh, "/domain/zone/example.com/refresh", nil, nil)
+	if err == nil || !strings.Contains(err.Error(), "task queue of the zone is full") {
+		t.Errorf("expected the task queue error, got %v", err)
+	}
+
+	if isTaskQueueFull(&ovh.APIError{Code: http.StatusForbidden, Message: "This call has not been granted"}) {
+		t.Error("a denied call is not a full task queue")
+	}
+}
+
+// failingTransport fails the first requests of the given method as if the
+// connection failed with err.
+type failingTransport struct {
+	method string
+	// path, when set, restricts the failures to the requests of this path.
+	path     string
+	failures int
+	err      error
+}
+
+func (t *failingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method == t.method && (t.path == "" || strings.HasSuffix(req.URL.Path, t.path)) && t.failures > 0 {
+		t.failures--
+		return nil, t.err
+	}
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestCallRetriesTransportErrors(t *testing.T) {
+	shortenRetryDelay(t, time.Millisecond)
+	f := newFakeOVH(t, "example.com")
+	api := f.api()
+	ctx := context.Background()
+	dial := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	read := &net.OpError{Op: "read", Net: "tcp", Err: errors.New("connection reset by peer")}
+	before := testutil.ToFloat64(apiErrors.WithLabelValues(errorClassTransport))
+
+	// A create that never reached OVH is retried.
+	api.client.Client.Transport = &failingTransport{method: "POST", failures: 2, err: dial}
+	record := ovhZoneRecord{FieldType: "TXT", SubDomain: "_acme-challenge", Target: "token"}
+	if err := api.post(ctx, operationCreate, "/domain/zone/example.com/record", &record, nil); err != nil {
+		t.Fatal(err)
+	}
+	if n := testutil.ToFloat64(apiErrors.WithLabelValues(errorClassTransport)) - before; n != 2 {
+		t.Errorf("expected 2 transport errors in the metric, got %v", n)
+	}
+
+	// A create that may have reached OVH is not.
+	api.client.Client.Transport = &failingTransport{method: "POST", failures: 1, err: read}
+	err := api.post(ctx, operationCreate, "/domain/zone/example.com/record", &record, nil)
+	if err == nil || !strings.Contains(err.Error(), "unable to reach the OVH API") {
+		t.Errorf("expected the transport error, got %v", err)
+	}
+	if n := len(f.zoneRecords("example.com")); n != 1 {
+		t.Errorf("expected 1 record, got %d", n)
+	}
+
+	// A list can be sent again.
+	api.client.Client.Transport = &failingTransport{method: "GET", failures: 1, err: read}
+	if _, err := api.getIDs(ctx, operationList, "/domain/zone/example.com/record"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCallFallbackEndpoint(t *testing.T) {
+	shortenRetryDelay(t, time.Millisecond)
+	primary, fallback := newFakeOVH(t, "example.com"), newFakeOVH(t, "example.com")
+	fallback.addRecord("example.com", ovhZoneRecord{FieldType: "TXT", SubDomain: "_acme-challenge", Target: "token"})
+	ctx := context.Background()
+	dial := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+
+	api := primary.api()
+	api.client.Client.Transport = &failingTransport{method: "GET", failures: 1 << 30, err: dial}
+	api.fallback = fallback.api()
+	ids, err := api.getIDs(ctx, operationList, "/domain/zone/example.com/record")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 1 {
+		t.Errorf("expected the record of the fallback endpoint, got %v", ids)
+	}
+	if n := fallback.countCalls("GET /auth/currentCredential"); n != 1 {
+		t.Errorf("expected the credentials to be checked on the fallback endpoint, got %d calls", n)
+	}
+	// The next calls go to the fallback endpoint directly.
+	if _, err := api.getIDs(ctx, operationList, "/domain/zone/example.com/record"); err != nil {
+		t.Error(err)
+	}
+
+	// A fallback endpoint rejecting the credentials is not used.
+	api = primary.api()
+	api.client.Client.Transport = &failingTransport{method: "GET", failures: 1 << 30, err: dial}
+	api.fallback = fallback.api()
+	fallback.fail("GET /auth/currentCredential", http.StatusForbidden)
+	_, err = api.getIDs(ctx, operationList, "/domain/zone/example.com/record")
+	if err == nil || !strings.Contains(err.Error(), "unable to reach the OVH API") {
+		t.Errorf("expected the transport error of the primary endpoint, got %v", err)
+	}
+	if n := fallback.countCalls("GET /domain/zone/example.com/record"); n != 2 {
+		t.Errorf("expected no call to the unusable fallback endpoint, got %d", n-2)
+	}
+}
+
+func TestCallFallbackEndpointRetries(t *testing.T) {
+	shortenRetryDelay(t, time.Millisecond)
+	primary, fallback := newFakeOVH(t, "example.com"), newFakeOVH(t, "example.com")
+	fallback.addRecord("example.com", ovhZoneRecord{FieldType: "TXT", SubDomain: "_acme-challenge", Target: "token"})
+	dial := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+
+	// The retries used up on the primary endpoint are given back to the
+	// fallback endpoint, which fails once.
+	api := primary.api()
+	api.retries = newRetryBudget(1)
+	api.client.Client.Transport = &failingTransport{method: "GET", failures: 1 << 30, err: dial}
+	api.fallback = fallback.api()
+	api.fallback.client.Client.Transport = &failingTransport{method: "GET", path: "/domain/zone/example.com/record", failures: 1, err: dial}
+	ids, err := api.getIDs(context.Background(), operationList, "/domain/zone/example.com/record")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 1 {
+		t.Errorf("expected the record of the fallback endpoint, got %v", ids)
+	}
+}
+
+func TestErrorClass(t *testing.T) {
+	tests := map[string]struct {
+		err   error
+		class string
+	}{
+		"unreachable": {err: &neturl.Error{Op: "Get", URL: "https://eu.api.ovh.com/1.0/auth/time", Err: &net.DNSError{Err: "no such host", Name: "eu.api.ovh.com"}}, class: errorClassTransport},
+		"timeout":     {err: &neturl.Error{Op: "Get", URL: "https://eu.api.ovh.com/1.0/domain/zone", Err: context.DeadlineExceeded}},
+		"invalid key": {err: &ovh.APIError{Code: http.StatusUnauthorized, Message: "Invalid application key"}, class: errorClassAuth},
+		"not granted": {err: &ovh.APIError{Code: http.StatusForbidden, Message: "This call has not been granted"}, class: errorClassAuth},
+		"task queue":  {err: &ovh.APIError{Code: http.StatusForbidden, Message: "Too many tasks pending on this zone"}, class: errorClassAPI},
+		"not found":   {err: &ovh.APIError{Code: http.StatusNotFound}, class: errorClassAPI},
+		"circuit":     {err: errCircuitOpen},
+	}
+	for name, test := range tests {
+		if class := errorClass(test.err); class != test.class {
+			t.Errorf("%s: errorClass = %q, expected %q", name, class, test.class)
+		}
+	}
+}
+
+func TestCallDoesNotRetryRejectedCredentials(t *testing.T) {
+	shortenRetryDelay(t, time.Millisecond)
+	f := newFakeOVH(t, "example.com")
+	const call = "GET /domain/zone/example.com/record"
+	f.failWith(call, "Invalid credential", http.StatusForbidden, http.StatusForbidden)
+	_, err := f.api().getIDs(context.Background(), operationList, "/domain/zone/example.com/record")
+	if err == nil || !strings.Contains(err.Error(), "credentials were rejected") {
+		t.Errorf("expected the credentials error, got %v", err)
+	}
+	if n := f.countCalls(call); n != 1 {
+		t.Errorf("expected 1 call, got %d", n)
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// autoRefreshProbeDelay is how long a new record is given to appear on the
+// OVH name servers without a refresh of the zone. Tests shorten it.
+var autoRefreshProbeDelay = 10 * time.Second
+
+// autoRefreshCacheTTL is how long the result of a detection is reused.
+const autoRefreshCacheTTL = time.Hour
+
+// autoRefreshDetector remembers which zones deploy their changes without an
+// explicit refresh. Its zero value is ready to use.
+type autoRefreshDetector struct {
+	mu    sync.Mutex
+	zones map[string]autoRefreshResult
+	used  accessTimes[string]
+	// probing holds the zones being probed, which are probed by a single
+	// challenge at a time.
+	probing map[string]bool
+}
+
+type autoRefreshResult struct {
+	auto    bool
+	expires time.Time
+}
+
+// lookup returns whether the zone deploys its changes by itself, if known.
+func (d *autoRefreshDetector) lookup(domain string) (auto, ok bool) {
+	if d == nil {
+		return false, false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	result, ok := d.zones[normalizeName(domain)]
+	d.used.touch(normalizeName(domain))
+	if !ok || time.Now().After(result.expires) {
+		return false, false
+	}
+	return result.auto, true
+}
+
+func (d *autoRefreshDetector) set(domain string, auto bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.zones == nil {
+		d.zones = map[string]autoRefreshResult{}
+	}
+	d.zones[normalizeName(domain)] = autoRefreshResult{auto: auto, expires: time.Now().Add(autoRefreshCacheTTL)}
+	d.used.touch(normalizeName(domain))
+}
+
+// prune removes the expired results. The zones being probed are kept.
+func (d *autoRefreshDetector) prune(now time.Time, max int) int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return pruneEntries(d.zones, d.used, now, max, func(result autoRefreshResult) time.Time {
+		return result.expires
+	})
+}
+
+// startProbe returns whether the zone may be probed, and then marks it as
+// being probed until the returned function is called.
+func (d *autoRefreshDetector) startProbe(domain string) (func(), bool) {
+	key := normalizeName(domain)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.probing[key] {
+		return nil, false
+	}
+	if d.probing == nil {
+		d.probing = map[string]bool{}
+	}
+	d.probing[key] = true
+	return func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		delete(d.probing, key)
+	}, true
+}
+
+// detectAutoRefresh checks, unless already known, whether a record created
+// at the given time without refreshing the zone is served by all the OVH name
+// servers after autoRefreshProbeDelay. Any doubt (a query error, a name server
+// lagging behind, a refresh of the zone made meanwhile by another challenge)
+// means the zone needs explicit refreshes, or that it is probed again later.
+// Refreshes made by other replicas of the webhook or by other tools cannot be
+// seen, so a zone may wrongly be found to deploy changes by itself: it is
+// then refreshed again after autoRefreshCacheTTL at the latest.
+func detectAutoRefresh(ctx context.Context, api *ovhAPI, domain, fqdn, target string, created time.Time) {
+	if api.autoRefresh == nil {
+		return
+	}
+	if _, ok := api.autoRefresh.lookup(domain); ok {
+		return
+	}
+	done, ok := api.autoRefresh.startProbe(domain)
+	if !ok {
+		return
+	}
+	defer done()
+
+	select {
+	case <-ctx.Done():
+		return
+	case <-time.After(autoRefreshProbeDelay):
+	}
+	zone, err := getZone(ctx, api, domain)
+	if err != nil {
+		klog.Warningf("Unable to detect whether OVH zone %s needs refreshes: %v", domain, err)
+		return
+	}
+	auto := len(zone.NameServers) > 0
+	for _, server := range zone.NameServers {
+		values, err := queryTXT(ctx, nameServerAddr(server), fqdn, dnsQueryTimeout)
+		if err != nil || !containsTarget(values, target) {
+			auto = false
+			break
+		}
+	}
+	if auto && api.refreshes.refreshedSince(domain, created) {
+		klog.V(2).Infof("OVH zone %s was refreshed during the detection of its refresh mode, detecting again later", domain)
+		return
+	}
+	klog.V(2).Infof("OVH zone %s deploys changes without refresh: %t", domain, auto)
+	api.autoRefresh.set(domain, auto)
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ovh/go-ovh/ovh"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// defaultBreakerThreshold is the default number of failed calls within
+	// the breaker window that opens the circuit.
+	defaultBreakerThreshold = 10
+	// defaultBreakerWindow is the default period over which the failed calls
+	// are counted.
+	defaultBreakerWindow = time.Minute
+	// defaultBreakerCooldown is the default time the circuit stays open
+	// before a call probes the OVH API again.
+	defaultBreakerCooldown = time.Minute
+)
+
+// The states of the circuit breaker, as reported by the
+// api_circuit_breaker_state metric.
+const (
+	breakerClosed   = 0
+	breakerHalfOpen = 1
+	breakerOpen     = 2
+)
+
+// errCircuitOpen is returned by the calls made while the circuit is open.
+var errCircuitOpen = errors.New("OVH API circuit open")
+
+// circuitBreakers holds the circuit breaker of each OVH API endpoint, so that
+// an outage of one OVH region does not fast-fail the calls made to the others.
+// Its zero value is ready to use, with the circuit breakers disabled.
+type circuitBreakers struct {
+	threshold int
+	window    time.Duration
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	breakers map[string]*circuitBreaker
+}
+
+// get returns the circuit breaker of endpoint.
+func (bs *circuitBreakers) get(endpoint string) *circuitBreaker {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	b, ok := bs.breakers[endpoint]
+	if !ok {
+		b = &circuitBreaker{endpoint: endpoint, threshold: bs.threshold, window: bs.window, cooldown: bs.cooldown}
+		if bs.breakers == nil {
+			bs.breakers = map[string]*circuitBreaker{}
+		}
+		bs.breakers[endpoint] = b
+	}
+	return b
+}
+
+// circuitBreaker fast-fails the calls to an OVH API endpoint once it looks
+// down, i.e. after threshold failed calls within window, until cooldown has
+// passed. A single call then probes the API: its success closes the circuit,
+// its failure opens it again. A probe that does not complete within cooldown
+// is replaced by another one. It is disabled when threshold is 0.
+type circuitBreaker struct {
+	endpoint  string
+	threshold int
+	window    time.Duration
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	state    int
+	failures []time.Time
+	openedAt time.Time
+	// probes counts the probes, so that the result of a probe replaced by
+	// another one is ignored.
+	probes       int
+	probing      bool
+	probeStarted time.Time
+}
+
+// allow returns an error if the call must not be made. Otherwise, the
+// returned function must be called with the result of the call.
+func (b *circuitBreaker) allow() (func(error), error) {
+	if b == nil || b.threshold == 0 {
+		return func(error) {}, nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerOpen:
+		retry := b.openedAt.Add(b.cooldown)
+		if time.Now().Before(retry) {
+			return nil, fmt.Errorf("%w for %s, retrying after %s", errCircuitOpen, b.endpoint, retry.Format(time.RFC3339))
+		}
+		b.setState(breakerHalfOpen)
+		return b.startProbe(), nil
+	case breakerHalfOpen:
+		if b.probing && time.Since(b.probeStarted) < b.cooldown {
+			return nil, fmt.Errorf("%w for %s, waiting for the probe call", errCircuitOpen, b.endpoint)
+		}
+		return b.startProbe(), nil
+	}
+	return b.record, nil
+}
+
+func (b *circuitBreaker) startProbe() func(error) {
+	b.probes++
+	probe := b.probes
+	b.probing = true
+	b.probeStarted = time.Now()
+	return func(err error) {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if b.probes != probe || b.state != breakerHalfOpen {
+			return
+		}
+		b.probing = false
+		switch {
+		case errors.Is(err, context.Canceled):
+			// The caller gave up: the next call probes the API.
+		case isOutage(err):
+			klog.Warningf("OVH API %s is still failing, opening the circuit again for %v: %v", b.endpoint, b.cooldown, err)
+			b.open()
+		default:
+			klog.Infof("OVH API %s is reachable again, closing the circuit", b.endpoint)
+			b.failures = nil
+			b.setState(breakerClosed)
+		}
+	}
+}
+
+// record counts the result of a call made while the circuit was closed.
+func (b *circuitBreaker) record(err error) {
+	if !isOutage(err) {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state != breakerClosed {
+		return
+	}
+	now := time.Now()
+	recent := b.failures[:0]
+	for _, failed := range b.failures {
+		if now.Sub(failed) < b.window {
+			recent = append(recent, failed)
+		}
+	}
+	b.failures = append(recent, now)
+	if len(b.failures) >= b.threshold {
+		klog.Warningf("OVH API %s failed %d times within %v, opening the circuit for %v: %v", b.endpoint, len(b.failures), b.window, b.cooldown, err)
+		b.open()
+	}
+}
+
+func (b *circuitBreaker) open() {
+	b.failures = nil
+	b.openedAt = time.Now()
+	b.setState(breakerOpen)
+}
+
+func (b *circuitBreaker) setState(state int) {
+	b.state = state
+	circuitBreakerState.WithLabelValues(sensitiveLabel(b.endpoint)).Set(float64(state))
+}
+
+// isOutage returns whether a call failed because OVH is unavailable, rather
+// than because of the request itself or of the caller giving up.
+func isOutage(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	var apiErr *ovh.APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.Code >= http.StatusInternalServerError
+	}
+	return true
+}
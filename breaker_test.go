@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	f := newFakeOVH(t, "example.com")
+	api := f.api()
+	api.breaker = &circuitBreaker{threshold: 2, window: time.Hour, cooldown: time.Hour}
+	const call = "GET /domain/zone/example.com/status"
+	f.fail(call, http.StatusServiceUnavailable, http.StatusServiceUnavailable)
+
+	status := ovhZoneStatus{}
+	for i := 0; i < 2; i++ {
+		if err := api.get(context.Background(), operationList, "/domain/zone/example.com/status", &status); err == nil {
+			t.Fatal("expected the injected failure")
+		}
+	}
+	err := api.get(context.Background(), operationList, "/domain/zone/example.com/status", &status)
+	if !errors.Is(err, errCircuitOpen) {
+		t.Fatalf("expected the circuit to be open, got %v", err)
+	}
+	if n := f.countCalls(call); n != 2 {
+		t.Errorf("expected no call while the circuit is open, got %d calls", n)
+	}
+
+	// Once the cooldown has passed, a successful probe closes the circuit.
+	api.breaker.openedAt = time.Now().Add(-2 * time.Hour)
+	for i := 0; i < 2; i++ {
+		if err := api.get(context.Background(), operationList, "/domain/zone/example.com/status", &status); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCircuitBreakerCountsFailuresWithinWindow(t *testing.T) {
+	b := &circuitBreaker{threshold: 2, window: time.Minute, cooldown: time.Hour}
+	outage := errors.New("connection refused")
+
+	// A success between two failures does not close the circuit.
+	for _, err := range []error{outage, nil, outage} {
+		done, allowErr := b.allow()
+		if allowErr != nil {
+			t.Fatal(allowErr)
+		}
+		done(err)
+	}
+	if _, err := b.allow(); !errors.Is(err, errCircuitOpen) {
+		t.Fatalf("expected the circuit to be open, got %v", err)
+	}
+
+	// Failures older than the window are not counted.
+	b = &circuitBreaker{threshold: 2, window: time.Minute, cooldown: time.Hour}
+	b.failures = []time.Time{time.Now().Add(-2 * time.Minute)}
+	done, err := b.allow()
+	if err != nil {
+		t.Fatal(err)
+	}
+	done(outage)
+	if _, err := b.allow(); err != nil {
+		t.Errorf("expected the circuit to stay closed, got %v", err)
+	}
+}
+
+func TestCircuitBreakerProbe(t *testing.T) {
+	b := &circuitBreaker{threshold: 1, window: time.Minute, cooldown: time.Minute}
+	b.open()
+	b.openedAt = time.Now().Add(-time.Hour)
+
+	// A probe abandoned by its caller lets the next call probe the API.
+	done, err := b.allow()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.allow(); !errors.Is(err, errCircuitOpen) {
+		t.Fatalf("expected a single probe, got %v", err)
+	}
+	done(context.Canceled)
+	done, err = b.allow()
+	if err != nil {
+		t.Fatalf("expected a new probe after a canceled one, got %v", err)
+	}
+
+	// A probe that does not complete within the cooldown is replaced.
+	b.probeStarted = time.Now().Add(-time.Hour)
+	replacement, err := b.allow()
+	if err != nil {
+		t.Fatalf("expected a new probe after a stuck one, got %v", err)
+	}
+	done(errors.New("connection refused"))
+	if b.state != breakerHalfOpen {
+		t.Errorf("the result of a replaced probe was recorded, state %d", b.state)
+	}
+	replacement(nil)
+	if b.state != breakerClosed {
+		t.Errorf("a successful probe did not close the circuit, state %d", b.state)
+	}
+}
+
+func TestCircuitBreakerProbeWaitsForRateLimiter(t *testing.T) {
+	f := newFakeOVH(t, "example.com")
+	api := f.api()
+	api.breaker = &circuitBreaker{threshold: 1, window: time.Minute, cooldown: time.Minute}
+	api.breaker.open()
+	api.breaker.openedAt = time.Now().Add(-time.Hour)
+	api.limiter = &rateLimiter{known: true, reset: time.Now().Add(time.Hour)}
+
+	// A call that gives up while waiting for the rate limiter does not
+	// take the probe.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	status := ovhZoneStatus{}
+	if err := api.get(ctx, operationList, "/domain/zone/example.com/status", &status); errors.Is(err, errCircuitOpen) || err == nil {
+		t.Fatalf("expected the rate limiter to fail the call, got %v", err)
+	}
+	if api.breaker.probing {
+		t.Error("the probe was taken before the rate limiter")
+	}
+	api.limiter = nil
+	if err := api.get(context.Background(), operationList, "/domain/zone/example.com/status", &status); err != nil {
+		t.Fatal(err)
+	}
+	if api.breaker.state != breakerClosed {
+		t.Errorf("a successful probe did not close the circuit, state %d", api.breaker.state)
+	}
+}
+
+func TestCircuitBreakersPerEndpoint(t *testing.T) {
+	breakers := &circuitBreakers{threshold: 1, window: time.Minute, cooldown: time.Hour}
+	eu := breakers.get("https://eu.api.ovh.com/1.0")
+	if breakers.get("https://eu.api.ovh.com/1.0") != eu {
+		t.Error("expected a single circuit breaker per endpoint")
+	}
+	done, err := eu.allow()
+	if err != nil {
+		t.Fatal(err)
+	}
+	done(errors.New("connection refused"))
+	if _, err := eu.allow(); !errors.Is(err, errCircuitOpen) {
+		t.Fatalf("expected the circuit to be open, got %v", err)
+	}
+	if _, err := breakers.get("https://ca.api.ovh.com/1.0").allow(); err != nil {
+		t.Errorf("the circuit of another endpoint is open: %v", err)
+	}
+}
+
+func TestIsOutage(t *testing.T) {
+	f := newFakeOVH(t, "example.com")
+	api := f.api()
+	f.fail("GET /domain/zone/example.com/status", http.StatusForbidden)
+	err := api.get(context.Background(), operationList, "/domain/zone/example.com/status", &ovhZoneStatus{})
+	if err == nil || isOutage(err) {
+		t.Errorf("a 403 is not an outage: %v", err)
+	}
+	if isOutage(context.Canceled) || !isOutage(context.DeadlineExceeded) {
+		t.Error("unexpected outage classification of context errors")
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"golang.org/x/sync/semaphore"
+)
+
+// The operations sharing the challengeLimiter, as reported by its metrics.
+const (
+	challengePresent = "present"
+	challengeCleanUp = "cleanup"
+)
+
+// challengeLimiter bounds the number of Present and CleanUp calls running at
+// the same time, across all the issuers, so that a mass renewal and a mass
+// expiry together do not exceed the capacity of the OVH accounts. The calls
+// get their slot in the order they asked for it. A nil challengeLimiter does
+// not limit anything.
+type challengeLimiter struct {
+	size int64
+	sem  *semaphore.Weighted
+}
+
+// newChallengeLimiter returns a limiter of size concurrent calls, or nil when
+// size is 0.
+func newChallengeLimiter(size int64) *challengeLimiter {
+	if size == 0 {
+		return nil
+	}
+	return &challengeLimiter{size: size, sem: semaphore.NewWeighted(size)}
+}
+
+// acquire waits for a slot for a call of the given operation and returns the
+// function releasing it.
+func (l *challengeLimiter) acquire(ctx context.Context, operation string) (func(), error) {
+	if l == nil {
+		return func() {}, nil
+	}
+	start := time.Now()
+	err := l.sem.Acquire(ctx, 1)
+	challengeQueueWait.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+	if err != nil {
+		return nil, fmt.Errorf("no free slot among the %d concurrent challenges allowed by MAX_CONCURRENT_CHALLENGES: %w", l.size, err)
+	}
+	challengesInFlight.WithLabelValues(operation).Inc()
+	return func() {
+		challengesInFlight.WithLabelValues(operation).Dec()
+		l.sem.Release(1)
+	}, nil
+}
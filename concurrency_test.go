@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	extapi "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+
+	"github.com/cert-manager/cert-manager/pkg/acme/webhook/apis/acme/v1alpha1"
+)
+
+func TestChallengeLimiterSharedByPresentAndCleanUp(t *testing.T) {
+	l := newChallengeLimiter(1)
+	release, err := l.acquire(context.Background(), challengePresent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := testutil.ToFloat64(challengesInFlight.WithLabelValues(challengePresent)); n != 1 {
+		t.Errorf("expected 1 Present in flight, got %v", n)
+	}
+
+	// A CleanUp waits for the slot of the Present.
+	acquired := make(chan func())
+	go func() {
+		release, err := l.acquire(context.Background(), challengeCleanUp)
+		if err != nil {
+			t.Error(err)
+		}
+		acquired <- release
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("CleanUp did not wait for the Present")
+	case <-time.After(50 * time.Millisecond):
+	}
+	release()
+	select {
+	case release := <-acquired:
+		release()
+	case <-time.After(5 * time.Second):
+		t.Fatal("CleanUp did not get the slot once released")
+	}
+	if n := testutil.ToFloat64(challengesInFlight.WithLabelValues(challengeCleanUp)); n != 0 {
+		t.Errorf("expected no CleanUp in flight, got %v", n)
+	}
+
+	if l := newChallengeLimiter(0); l != nil {
+		t.Error("expected no limiter for a size of 0")
+	}
+}
+
+func TestPresentTimesOutWaitingForChallengeSlot(t *testing.T) {
+	f := newFakeOVH(t, "example.com")
+	s := &ovhDNSProviderSolver{
+		challenges: newChallengeLimiter(1),
+		credentialSources: []credentialSource{staticCredentials{creds: ovhCredentials{
+			endpoint:          f.server.URL,
+			applicationKey:    "key",
+			applicationSecret: "secret",
+			consumerKey:       "consumer",
+		}}},
+	}
+	release, err := s.challenges.acquire(context.Background(), challengeCleanUp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+
+	err = s.Present(&v1alpha1.ChallengeRequest{
+		ResolvedZone:            "example.com.",
+		ResolvedFQDN:            "_acme-challenge.example.com.",
+		Key:                     "key",
+		AllowAmbientCredentials: true,
+		Config:                  &extapi.JSON{Raw: []byte(`{"presentTimeout": "50ms"}`)},
+	})
+	if err == nil || !strings.Contains(err.Error(), "MAX_CONCURRENT_CHALLENGES") {
+		t.Errorf("expected the concurrency limit error, got %v", err)
+	}
+	if records := f.zoneRecords("example.com"); len(records) != 0 {
+		t.Errorf("expected no record, got %v", records)
+	}
+}
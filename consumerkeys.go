@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// consumerKeyCheckTTL is how long the result of the check of a consumer key
+// is used, so that a key revoked or granted again is eventually noticed.
+const consumerKeyCheckTTL = time.Hour
+
+// consumerKeyChecks holds the result of the checks of the additional consumer
+// keys of the issuers, and the position of the rotation across the keys of
+// each issuer, shared by its challenges so that their calls are spread evenly.
+// Its zero value is ready to use.
+type consumerKeyChecks struct {
+	mu        sync.Mutex
+	checks    map[string]consumerKeyCheck
+	used      accessTimes[string]
+	positions map[string]*atomic.Uint64
+}
+
+type consumerKeyCheck struct {
+	valid   bool
+	expires time.Time
+}
+
+// valid returns whether the OVH API accepts the consumer key of candidate,
+// checking it unless it was checked within consumerKeyCheckTTL. A key that
+// could not be checked, e.g. because the OVH API is unreachable, is not used
+// for the challenge, and checked again by the next one.
+func (c *consumerKeyChecks) valid(ctx context.Context, candidate *ovhAPI) bool {
+	sum := sha256.Sum256([]byte(candidate.endpoint + "\n" + candidate.client.AppKey + "\n" + candidate.client.ConsumerKey))
+	key := hex.EncodeToString(sum[:])
+	now := time.Now()
+	c.mu.Lock()
+	check, ok := c.checks[key]
+	c.used.touch(key)
+	c.mu.Unlock()
+	if ok && now.Before(check.expires) {
+		return check.valid
+	}
+
+	err := candidate.checkCredential(ctx)
+	masked := maskedConsumerKey(candidate.client.ConsumerKey)
+	switch {
+	case err == nil:
+		klog.Infof("Consumer key %s is active, spreading the OVH API calls across it", masked)
+	case errorClass(err) == errorClassAuth || errors.Is(err, errCredentialNotValidated):
+		klog.Warningf("Consumer key %s is rejected by the OVH API, skipping it: %v", masked, err)
+	default:
+		klog.Warningf("Unable to check consumer key %s, skipping it for this challenge: %v", masked, err)
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.checks == nil {
+		c.checks = map[string]consumerKeyCheck{}
+	}
+	c.checks[key] = consumerKeyCheck{valid: err == nil, expires: now.Add(consumerKeyCheckTTL)}
+	c.used.touch(key)
+	return err == nil
+}
+
+// position returns the position of the rotation across the consumer keys of
+// the issuer making its calls on behalf of account.
+func (c *consumerKeyChecks) position(account string) *atomic.Uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	position, ok := c.positions[account]
+	if !ok {
+		position = &atomic.Uint64{}
+		if c.positions == nil {
+			c.positions = map[string]*atomic.Uint64{}
+		}
+		c.positions[account] = position
+	}
+	return position
+}
+
+func (c *consumerKeyChecks) prune(now time.Time, max int) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return pruneEntries(c.checks, c.used, now, max, func(check consumerKeyCheck) time.Time {
+		return check.expires
+	})
+}
+
+// rotateConsumerKeys spreads the calls of api across its consumer key and the
+// additional consumer keys of the issuer accepted by the OVH API, so that
+// mass renewals stay within the rate limit of each key. The keys are checked
+// by the first challenge of the issuer rather than at startup, as the issuers
+// are only known from their challenges.
+func (s *ovhDNSProviderSolver) rotateConsumerKeys(ctx context.Context, api *ovhAPI, creds ovhCredentials, cfg *ovhDNSProviderConfig, timeouts operationTimeouts) error {
+	api.rotation = append(api.rotation[:0], rotatedKey{client: api.client, limiter: api.limiter})
+	active := []string{maskedConsumerKey(api.client.ConsumerKey)}
+	for _, consumerKey := range cfg.ConsumerKeys {
+		keyCreds := creds
+		keyCreds.consumerKey = consumerKey
+		client, err := s.newClient(keyCreds, api.endpoint, cfg)
+		if err != nil {
+			return err
+		}
+		candidate := newOVHAPI(client, timeouts, s.limiters.get(client))
+		candidate.breaker = api.breaker
+		candidate.headers = api.headers
+		if s.consumerKeys.valid(ctx, candidate) {
+			api.rotation = append(api.rotation, rotatedKey{client: client, limiter: candidate.limiter})
+			active = append(active, maskedConsumerKey(consumerKey))
+		}
+	}
+	api.rotationNext = s.consumerKeys.position(api.account())
+	klog.V(2).Infof("Spreading the OVH API calls across %d consumer keys: %s", len(active), strings.Join(active, ", "))
+	return nil
+}
+
+// maskedConsumerKey returns the start of a consumer key, enough to tell the
+// keys apart in the logs.
+func maskedConsumerKey(key string) string {
+	if len(key) > 4 {
+		key = key[:4]
+	}
+	return key + "..."
+}
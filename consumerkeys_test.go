@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	extapi "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+)
+
+func TestRotateConsumerKeys(t *testing.T) {
+	f := newFakeOVH(t, "example.com")
+	f.rejectedKeys["bad"] = true
+	ctx := context.Background()
+	s := &ovhDNSProviderSolver{}
+	creds := ovhCredentials{applicationKey: "key", applicationSecret: "secret", consumerKey: "consumer"}
+	cfg := &ovhDNSProviderConfig{ConsumerKeys: []string{"second", "bad"}}
+
+	api := f.api()
+	if err := s.rotateConsumerKeys(ctx, api, creds, cfg, api.timeouts); err != nil {
+		t.Fatal(err)
+	}
+	if len(api.rotation) != 2 {
+		t.Fatalf("expected the rejected consumer key to be skipped, got %d keys", len(api.rotation))
+	}
+	for i := 0; i < 4; i++ {
+		if _, err := getZone(ctx, api, "example.com"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if f.consumerKeys["consumer"] != 2 || f.consumerKeys["second"] != 3 || f.consumerKeys["bad"] != 1 {
+		t.Errorf("expected the calls to be spread across the accepted consumer keys, got %v", f.consumerKeys)
+	}
+
+	// The checks are cached across the challenges.
+	api = f.api()
+	if err := s.rotateConsumerKeys(ctx, api, creds, cfg, api.timeouts); err != nil {
+		t.Fatal(err)
+	}
+	if len(api.rotation) != 2 || f.consumerKeys["second"] != 3 || f.consumerKeys["bad"] != 1 {
+		t.Errorf("expected the consumer keys not to be checked again, got %d keys and calls %v", len(api.rotation), f.consumerKeys)
+	}
+
+	// A key whose rate limit is almost exhausted is passed over.
+	header := http.Header{}
+	header.Set(rateLimitRemainingHeader, "0")
+	header.Set(rateLimitResetHeader, "3600")
+	api.rotation[1].limiter.update(header)
+	for i := 0; i < 4; i++ {
+		if _, err := getZone(ctx, api, "example.com"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if f.consumerKeys["consumer"] != 6 || f.consumerKeys["second"] != 3 {
+		t.Errorf("expected the calls to avoid the exhausted consumer key, got %v", f.consumerKeys)
+	}
+	if s.consumerKeys.position(api.account()) == s.consumerKeys.position("other issuer") {
+		t.Error("expected a rotation per issuer")
+	}
+
+	if _, err := loadConfig(&extapi.JSON{Raw: []byte(`{"consumerKeys": ["second", ""]}`)}); err == nil {
+		t.Error("expected an error for an empty consumer key")
+	}
+}
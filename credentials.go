@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cert-manager/cert-manager/pkg/acme/webhook/apis/acme/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ovhCredentials are the values used to authenticate the OVH API calls. Empty
+// values are loaded by go-ovh from the environment and the ovh.conf files.
+type ovhCredentials struct {
+	endpoint          string
+	applicationKey    string
+	applicationSecret string
+	consumerKey       string
+	origins           credentialOrigins
+}
+
+// credentialOrigins names where each value of ovhCredentials was read from,
+// for the logs. The origin of a value left empty is empty.
+type credentialOrigins struct {
+	endpoint          string
+	applicationKey    string
+	applicationSecret string
+	consumerKey       string
+}
+
+// String lists the origins of the values, never the values themselves. The
+// empty values are loaded by go-ovh from the webhook environment.
+func (o credentialOrigins) String() string {
+	parts := []string{}
+	for _, value := range []struct{ name, origin string }{
+		{"endpoint", o.endpoint},
+		{"application key", o.applicationKey},
+		{"application secret", o.applicationSecret},
+		{"consumer key", o.consumerKey},
+	} {
+		origin := value.origin
+		if origin == "" {
+			origin = "the webhook environment (OVH_* variables or ovh.conf)"
+		}
+		parts = append(parts, value.name+" from "+origin)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// merge fills the values missing from c with the values of other.
+func (c *ovhCredentials) merge(other ovhCredentials) {
+	if c.endpoint == "" {
+		c.endpoint, c.origins.endpoint = other.endpoint, other.origins.endpoint
+	}
+	if c.applicationKey == "" {
+		c.applicationKey, c.origins.applicationKey = other.applicationKey, other.origins.applicationKey
+	}
+	if c.applicationSecret == "" {
+		c.applicationSecret, c.origins.applicationSecret = other.applicationSecret, other.origins.applicationSecret
+	}
+	if c.consumerKey == "" {
+		c.consumerKey, c.origins.consumerKey = other.consumerKey, other.origins.consumerKey
+	}
+}
+
+// originOf returns origin for a non-empty value.
+func originOf(value, origin string) string {
+	if value == "" {
+		return ""
+	}
+	return origin
+}
+
+// credentialSource provides the OVH credentials of a challenge request.
+//
+// The issuer config and the files of the credentialsDir option are the only
+// sources for now. Other sources, like the exchange of a projected service
+// account token for an OVH OAuth2 token once OVH supports identity
+// federation, can be added without changing ovhClient.
+type credentialSource interface {
+	credentials(ctx context.Context, ch *v1alpha1.ChallengeRequest, cfg *ovhDNSProviderConfig) (ovhCredentials, error)
+}
+
+// The keys of the secret of applicationSecretRef that set the options of the
+// challenges using it, unless set in the issuer config.
+const (
+	secretSettingTTL           = "ttl"
+	secretSettingRefreshWindow = "refreshWindow"
+)
+
+// applySecretSettings sets the options of cfg missing from the issuer config
+// to the values of the setting keys of the application secret, so that they
+// can be kept with the credentials.
+func applySecretSettings(cfg *ovhDNSProviderConfig, secret *corev1.Secret, namespace string) error {
+	source := func(key string) string {
+		return fmt.Sprintf("key %q of secret '%s/%s'", key, namespace, secret.Name)
+	}
+	if value, ok := secret.Data[secretSettingTTL]; ok && cfg.TTL == nil {
+		ttl, err := strconv.Atoi(strings.TrimSpace(string(value)))
+		if err != nil || ttl < 0 {
+			return fmt.Errorf("invalid TTL %q in %s: expected a number of seconds", value, source(secretSettingTTL))
+		}
+		cfg.TTL = &ttl
+	}
+	if value, ok := secret.Data[secretSettingRefreshWindow]; ok && cfg.RefreshWindow == nil {
+		window, err := time.ParseDuration(strings.TrimSpace(string(value)))
+		if err != nil || window < 0 {
+			return fmt.Errorf("invalid refresh window %q in %s: expected a duration like 2s", value, source(secretSettingRefreshWindow))
+		}
+		cfg.RefreshWindow = &metav1.Duration{Duration: window}
+	}
+	return nil
+}
+
+// defaultApplicationSecretKey is the key of the secret read when the
+// applicationSecretRef of the issuer config has none, the one used in the
+// examples of the README.
+const defaultApplicationSecretKey = "applicationSecret"
+
+// issuerCredentials reads the credentials from the issuer config and the
+// application secret it references.
+type issuerCredentials struct {
+	solver *ovhDNSProviderSolver
+}
+
+func (src issuerCredentials) credentials(ctx context.Context, ch *v1alpha1.ChallengeRequest, cfg *ovhDNSProviderConfig) (ovhCredentials, error) {
+	applicationSecret, secret, err := src.solver.secret(ctx, cfg.ApplicationSecretRef, ch.ResourceNamespace, defaultApplicationSecretKey)
+	if err != nil {
+		return ovhCredentials{}, err
+	}
+	if secret != nil {
+		err = applySecretSettings(cfg, secret, ch.ResourceNamespace)
+		if err != nil {
+			return ovhCredentials{}, err
+		}
+	}
+	key := cfg.ApplicationSecretRef.Key
+	if key == "" {
+		key = defaultApplicationSecretKey
+	}
+	return ovhCredentials{
+		endpoint:          cfg.Endpoint,
+		applicationKey:    cfg.ApplicationKey,
+		applicationSecret: applicationSecret,
+		consumerKey:       cfg.ConsumerKey,
+		origins: credentialOrigins{
+			endpoint:          originOf(cfg.Endpoint, "the issuer config"),
+			applicationKey:    originOf(cfg.ApplicationKey, "the issuer config"),
+			applicationSecret: originOf(applicationSecret, fmt.Sprintf("key %q of secret '%s/%s'", key, ch.ResourceNamespace, cfg.ApplicationSecretRef.Name)),
+			consumerKey:       originOf(cfg.ConsumerKey, "the issuer config"),
+		},
+	}, nil
+}
+
+// fileCredentials reads the credentials from a directory holding one file per
+// value, as mounted by the Secrets Store CSI driver. A missing file leaves the
+// value empty.
+type fileCredentials struct {
+	dir string
+}
+
+func (src fileCredentials) credentials(ctx context.Context, ch *v1alpha1.ChallengeRequest, cfg *ovhDNSProviderConfig) (ovhCredentials, error) {
+	creds := ovhCredentials{}
+	files := []struct {
+		name   string
+		value  *string
+		origin *string
+	}{
+		{"endpoint", &creds.endpoint, &creds.origins.endpoint},
+		{"application_key", &creds.applicationKey, &creds.origins.applicationKey},
+		{"application_secret", &creds.applicationSecret, &creds.origins.applicationSecret},
+		{"consumer_key", &creds.consumerKey, &creds.origins.consumerKey},
+	}
+	for _, file := range files {
+		path := filepath.Join(src.dir, file.name)
+		data, err := os.ReadFile(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return ovhCredentials{}, fmt.Errorf("unable to read the OVH credentials: %v", err)
+		}
+		*file.value = strings.TrimSpace(string(data))
+		*file.origin = originOf(*file.value, "file "+path)
+	}
+	if creds.endpoint != "" {
+		endpoint, err := normalizeEndpoint(creds.endpoint)
+		if err != nil {
+			return ovhCredentials{}, fmt.Errorf("invalid endpoint file in %s: %v", src.dir, err)
+		}
+		creds.endpoint = endpoint
+	}
+	return creds, nil
+}
+
+// loadCredentials queries the credential sources in order. Each source only
+// provides the values that the previous ones left empty.
+func (s *ovhDNSProviderSolver) loadCredentials(ctx context.Context, ch *v1alpha1.ChallengeRequest, cfg *ovhDNSProviderConfig) (ovhCredentials, error) {
+	sources := s.credentialSources
+	if len(sources) == 0 && cfg.CredentialsDir != "" {
+		sources = []credentialSource{fileCredentials{dir: cfg.CredentialsDir}}
+	}
+	if len(sources) == 0 {
+		sources = []credentialSource{issuerCredentials{solver: s}}
+	}
+	creds := ovhCredentials{}
+	for _, src := range sources {
+		c, err := src.credentials(ctx, ch, cfg)
+		if err != nil {
+			return ovhCredentials{}, err
+		}
+		creds.merge(c)
+	}
+	return creds, nil
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/cert-manager/cert-manager/pkg/acme/webhook/apis/acme/v1alpha1"
+)
+
+type staticCredentials struct {
+	creds ovhCredentials
+	err   error
+}
+
+func (src staticCredentials) credentials(context.Context, *v1alpha1.ChallengeRequest, *ovhDNSProviderConfig) (ovhCredentials, error) {
+	return src.creds, src.err
+}
+
+func TestLoadCredentials(t *testing.T) {
+	s := &ovhDNSProviderSolver{credentialSources: []credentialSource{
+		staticCredentials{creds: ovhCredentials{endpoint: "ovh-eu", consumerKey: "first"}},
+		staticCredentials{creds: ovhCredentials{applicationKey: "key", applicationSecret: "secret", consumerKey: "second"}},
+	}}
+	creds, err := s.loadCredentials(context.Background(), &v1alpha1.ChallengeRequest{}, &ovhDNSProviderConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := ovhCredentials{endpoint: "ovh-eu", applicationKey: "key", applicationSecret: "secret", consumerKey: "first"}
+	if creds != want {
+		t.Errorf("got %+v, want %+v", creds, want)
+	}
+
+	s.credentialSources = append(s.credentialSources, staticCredentials{err: errors.New("unavailable")})
+	if _, err := s.loadCredentials(context.Background(), &v1alpha1.ChallengeRequest{}, &ovhDNSProviderConfig{}); err == nil {
+		t.Error("expected the error of the failing source")
+	}
+}
+
+func TestSecretSettings(t *testing.T) {
+	client := fake.NewSimpleClientset(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "ovh"},
+		Data: map[string][]byte{
+			"applicationSecret": []byte("secret"),
+			"ttl":               []byte("300\n"),
+			"refreshWindow":     []byte("5s"),
+		},
+	})
+	s := &ovhDNSProviderSolver{client: client}
+	ch := &v1alpha1.ChallengeRequest{ResourceNamespace: "default"}
+	ref := corev1.SecretKeySelector{LocalObjectReference: corev1.LocalObjectReference{Name: "ovh"}}
+
+	cfg := ovhDNSProviderConfig{ApplicationSecretRef: ref}
+	if _, err := (issuerCredentials{solver: s}).credentials(context.Background(), ch, &cfg); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.recordTTL() != 300 || cfg.RefreshWindow == nil || cfg.RefreshWindow.Duration != 5*time.Second {
+		t.Errorf("got TTL %d and refresh window %v, expected the values of the secret", cfg.recordTTL(), cfg.RefreshWindow)
+	}
+
+	// The issuer config overrides the secret.
+	ttl := 60
+	cfg = ovhDNSProviderConfig{ApplicationSecretRef: ref, TTL: &ttl}
+	if _, err := (issuerCredentials{solver: s}).credentials(context.Background(), ch, &cfg); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.recordTTL() != 60 {
+		t.Errorf("got TTL %d, expected the TTL of the issuer config", cfg.recordTTL())
+	}
+
+	for key, value := range map[string]string{"ttl": "-1", "refreshWindow": "soon"} {
+		secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "ovh"}, Data: map[string][]byte{key: []byte(value)}}
+		if err := applySecretSettings(&ovhDNSProviderConfig{}, secret, "default"); err == nil || !strings.Contains(err.Error(), key) {
+			t.Errorf("expected an error for %s %q, got %v", key, value, err)
+		}
+	}
+}
+
+func TestFileCredentials(t *testing.T) {
+	dir := t.TempDir()
+	for name, value := range map[string]string{
+		"endpoint":           "ovh-eu\n",
+		"application_key":    "key",
+		"application_secret": "secret\n",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(value), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := &ovhDNSProviderSolver{}
+	cfg := &ovhDNSProviderConfig{CredentialsDir: dir}
+	creds, err := s.loadCredentials(context.Background(), &v1alpha1.ChallengeRequest{}, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The missing consumer key is left to the ambient credentials.
+	want := ovhCredentials{endpoint: "ovh-eu", applicationKey: "key", applicationSecret: "secret", origins: credentialOrigins{
+		endpoint:          "file " + filepath.Join(dir, "endpoint"),
+		applicationKey:    "file " + filepath.Join(dir, "application_key"),
+		applicationSecret: "file " + filepath.Join(dir, "application_secret"),
+	}}
+	if creds != want {
+		t.Errorf("got %+v, want %+v", creds, want)
+	}
+	if logged := creds.origins.String(); !strings.Contains(logged, "consumer key from the webhook environment") {
+		t.Errorf("unexpected origins %q", logged)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "endpoint"), []byte("unknown"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.loadCredentials(context.Background(), &v1alpha1.ChallengeRequest{}, cfg); err == nil {
+		t.Error("expected an error for an invalid endpoint file")
+	}
+}
+
+func TestValidateCredentialsDir(t *testing.T) {
+	s := &ovhDNSProviderSolver{}
+	tests := []struct {
+		cfg     ovhDNSProviderConfig
+		ambient bool
+		valid   bool
+	}{
+		{ovhDNSProviderConfig{CredentialsDir: "/mnt/ovh"}, true, true},
+		{ovhDNSProviderConfig{CredentialsDir: "/mnt/ovh"}, false, false},
+		{ovhDNSProviderConfig{CredentialsDir: "mnt/ovh"}, true, false},
+		{ovhDNSProviderConfig{CredentialsDir: "/mnt/ovh", ApplicationKey: "key"}, true, false},
+	}
+	for _, test := range tests {
+		err := s.validate(&test.cfg, test.ambient)
+		if (err == nil) != test.valid {
+			t.Errorf("validate(%+v, ambient %v) = %v, expected valid %v", test.cfg, test.ambient, err, test.valid)
+		}
+	}
+}
+
+func TestValidateReportsAllMissingFields(t *testing.T) {
+	s := &ovhDNSProviderSolver{}
+	cfg := ovhDNSProviderConfig{Endpoint: "unknown", ApplicationSecretRef: corev1.SecretKeySelector{LocalObjectReference: corev1.LocalObjectReference{Name: "ovh"}}}
+	err := s.validate(&cfg, false)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	for _, want := range []string{`unknown endpoint "unknown"`, "missing in OVH config: applicationKey, consumerKey"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("%q not reported in %q", want, err)
+		}
+	}
+
+	// Ambient credentials fill the missing fields.
+	if err := s.validate(&ovhDNSProviderConfig{}, true); err != nil {
+		t.Errorf("unexpected error with ambient credentials: %v", err)
+	}
+}
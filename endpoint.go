@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/ovh/go-ovh/ovh"
+	"k8s.io/klog/v2"
+)
+
+// deprecatedEndpoints maps the endpoints OVH has since renamed to their
+// current alias, so that the issuers written for them keep working.
+var deprecatedEndpoints = map[string]string{
+	// The EU API was first served by api.ovh.com.
+	"https://api.ovh.com/1.0": "ovh-eu",
+	// The US API moved from api.ovhcloud.com to api.us.ovhcloud.com.
+	"https://api.ovhcloud.com/1.0": "ovh-us",
+}
+
+// removedEndpoints are the aliases of the APIs OVH shut down, which go-ovh no
+// longer knows.
+var removedEndpoints = map[string]string{
+	"runabove-ca": "the RunAbove API was shut down",
+}
+
+// normalizeEndpoint validates the endpoint of the OVH config, which is either
+// an alias known by go-ovh (e.g. "ovh-eu") or the base URL of the API (e.g.
+// "https://eu.api.ovh.com/1.0"), possibly behind a path prefix (e.g.
+// "https://gw.internal/ovh/1.0"): go-ovh appends the API paths to the base
+// URL. Base URLs are returned without their trailing slash, which go-ovh
+// rejects. Deprecated endpoints are replaced by their current alias.
+func normalizeEndpoint(endpoint string) (string, error) {
+	if _, ok := ovh.Endpoints[endpoint]; ok {
+		return endpoint, nil
+	}
+	if current, ok := deprecatedEndpoints[strings.TrimRight(endpoint, "/")]; ok {
+		klog.Warningf("The endpoint %q in OVH config is deprecated, using %s (%s) instead: update the issuer", endpoint, current, ovh.Endpoints[current])
+		return current, nil
+	}
+	if reason, ok := removedEndpoints[endpoint]; ok {
+		return "", fmt.Errorf("unsupported endpoint %q in OVH config: %s", endpoint, reason)
+	}
+	if !strings.Contains(endpoint, "/") {
+		return "", fmt.Errorf("unknown endpoint %q in OVH config: expected one of %s or a base URL", endpoint, endpointAliases())
+	}
+
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", fmt.Errorf("invalid endpoint %q in OVH config: %v", endpoint, err)
+	}
+	if u.Scheme != "https" && u.Scheme != "http" {
+		return "", fmt.Errorf("invalid endpoint %q in OVH config: the URL scheme must be https or http", endpoint)
+	}
+	if u.Host == "" {
+		return "", fmt.Errorf("invalid endpoint %q in OVH config: the URL has no host", endpoint)
+	}
+	if u.RawQuery != "" || u.Fragment != "" || u.User != nil {
+		return "", fmt.Errorf("invalid endpoint %q in OVH config: the URL must not have credentials, a query or a fragment", endpoint)
+	}
+	return strings.TrimRight(endpoint, "/"), nil
+}
+
+func endpointAliases() string {
+	aliases := []string{}
+	for alias := range ovh.Endpoints {
+		aliases = append(aliases, alias)
+	}
+	sort.Strings(aliases)
+	return strings.Join(aliases, ", ")
+}
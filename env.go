@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// listFromEnv reads a comma-separated list from an environment variable.
+func listFromEnv(name string) []string {
+	list := []string{}
+	for _, item := range strings.Split(os.Getenv(name), ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// mapFromEnv reads comma-separated name=value pairs from an environment
+// variable.
+func mapFromEnv(name string) (map[string]string, error) {
+	m := map[string]string{}
+	for _, item := range listFromEnv(name) {
+		key, value, ok := strings.Cut(item, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid %s: expected name=value pairs, got %q", name, item)
+		}
+		m[key] = strings.TrimSpace(value)
+	}
+	return m, nil
+}
+
+// boolFromEnv reads a boolean from an environment variable, defaulting to
+// false when it is not set.
+func boolFromEnv(name string) (bool, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s: %v", name, err)
+	}
+	return b, nil
+}
+
+// intFromEnv reads a non-negative integer from an environment variable,
+// defaulting to fallback when it is not set.
+func intFromEnv(name string, fallback int) (int, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %v", name, err)
+	}
+	if n < 0 {
+		return 0, fmt.Errorf("invalid %s: %d", name, n)
+	}
+	return n, nil
+}
+
+// durationFromEnv reads a non-negative duration from an environment variable.
+// It returns nil when the variable is not set.
+func durationFromEnv(name string) (*metav1.Duration, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return nil, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", name, err)
+	}
+	if d < 0 {
+		return nil, fmt.Errorf("invalid %s: %v", name, d)
+	}
+	return &metav1.Duration{Duration: d}, nil
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// defaultStatusEventsInterval is the default delay between two status
+	// events.
+	defaultStatusEventsInterval = time.Hour
+	// statusEventsComponent is the source of the status events.
+	statusEventsComponent = "cert-manager-webhook-ovh"
+)
+
+// challengeStats counts the Present and CleanUp calls served since the last
+// status event. Its zero value is ready to use.
+type challengeStats struct {
+	mu     sync.Mutex
+	served map[string]int
+	failed map[string]int
+}
+
+// note counts a call of the given operation, which failed if err is not nil.
+func (st *challengeStats) note(operation string, err error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.served == nil {
+		st.served = map[string]int{}
+		st.failed = map[string]int{}
+	}
+	st.served[operation]++
+	if err != nil {
+		st.failed[operation]++
+	}
+}
+
+// take returns the counts of calls by operation and resets them.
+func (st *challengeStats) take() (served, failed map[string]int) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	served, failed = st.served, st.failed
+	st.served, st.failed = nil, nil
+	return served, failed
+}
+
+// statusEvents emits the Kubernetes Events summarizing the activity of the
+// webhook on a ConfigMap, so that `kubectl describe` tells how the webhook
+// fares without scraping its metrics. The ConfigMap only carries the events:
+// it is created empty when missing and never modified.
+type statusEvents struct {
+	client    kubernetes.Interface
+	namespace string
+	name      string
+	// instance identifies the replica emitting the events.
+	instance string
+}
+
+// newStatusEvents returns the status events of the ConfigMap identified by
+// ref ("<namespace>/<name>"), or nil if ref is empty.
+func newStatusEvents(client kubernetes.Interface, ref string) (*statusEvents, error) {
+	if ref == "" {
+		return nil, nil
+	}
+	namespace, name, ok := strings.Cut(ref, "/")
+	if !ok || namespace == "" || name == "" {
+		return nil, fmt.Errorf("invalid STATUS_EVENTS_CONFIGMAP %q: expected <namespace>/<name>", ref)
+	}
+	instance, err := os.Hostname()
+	if err != nil {
+		instance = "unknown"
+	}
+	return &statusEvents{client: client, namespace: namespace, name: name, instance: instance}, nil
+}
+
+// runStatusEvents emits a status event every interval until stopCh is closed.
+func (s *ovhDNSProviderSolver) runStatusEvents(events *statusEvents, interval time.Duration, stopCh <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			if err := s.emitStatusEvent(ctx, events, interval); err != nil {
+				klog.Warningf("Unable to emit the status event on ConfigMap %s/%s: %v", events.namespace, events.name, err)
+			}
+			cancel()
+		}
+	}
+}
+
+// emitStatusEvent emits an event summarizing the calls served over the last
+// interval, the pauses for the OVH API rate limit and the leftover records
+// known by this replica. The event is a warning if a call failed.
+func (s *ovhDNSProviderSolver) emitStatusEvent(ctx context.Context, events *statusEvents, interval time.Duration) error {
+	served, failed := s.stats.take()
+	pauses := s.limiters.takePauses()
+	leftovers := s.records.leftoverCount()
+	configMap, err := events.object(ctx)
+	if err != nil {
+		return err
+	}
+
+	eventType := corev1.EventTypeNormal
+	if failed[challengePresent]+failed[challengeCleanUp] > 0 {
+		eventType = corev1.EventTypeWarning
+	}
+	message := fmt.Sprintf("Over the last %v: %d Present calls (%d failed), %d CleanUp calls (%d failed), %d pauses for the OVH API rate limit, %d leftover records",
+		interval, served[challengePresent], failed[challengePresent], served[challengeCleanUp], failed[challengeCleanUp], pauses, leftovers)
+	now := metav1.Now()
+	event := &corev1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("%s.%x", configMap.Name, now.UnixNano()),
+			Namespace: configMap.Namespace,
+		},
+		InvolvedObject: corev1.ObjectReference{
+			APIVersion:      "v1",
+			Kind:            "ConfigMap",
+			Namespace:       configMap.Namespace,
+			Name:            configMap.Name,
+			UID:             configMap.UID,
+			ResourceVersion: configMap.ResourceVersion,
+		},
+		Reason:              "ChallengeStats",
+		Message:             message,
+		Type:                eventType,
+		Source:              corev1.EventSource{Component: statusEventsComponent, Host: events.instance},
+		FirstTimestamp:      now,
+		LastTimestamp:       now,
+		Count:               1,
+		ReportingController: statusEventsComponent,
+		ReportingInstance:   events.instance,
+	}
+	_, err = events.client.CoreV1().Events(configMap.Namespace).Create(ctx, event, metav1.CreateOptions{})
+	return err
+}
+
+// object returns the ConfigMap the events are emitted on, creating it if
+// needed.
+func (e *statusEvents) object(ctx context.Context) (*corev1.ConfigMap, error) {
+	configMaps := e.client.CoreV1().ConfigMaps(e.namespace)
+	configMap, err := configMaps.Get(ctx, e.name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		configMap = &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: e.namespace, Name: e.name}}
+		configMap, err = configMaps.Create(ctx, configMap, metav1.CreateOptions{})
+		if apierrors.IsAlreadyExists(err) {
+			configMap, err = configMaps.Get(ctx, e.name, metav1.GetOptions{})
+		}
+	}
+	return configMap, err
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ovh/go-ovh/ovh"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestStatusEvents(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	ctx := context.Background()
+	events, err := newStatusEvents(client, "cert-manager/webhook-status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, err := newRecordStore(nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	records.put(ctx, "old", 1)
+	records.release(ctx, "old", true)
+	s := &ovhDNSProviderSolver{records: records}
+	s.stats.note(challengePresent, nil)
+	s.stats.note(challengePresent, errors.New("failed"))
+	s.stats.note(challengeCleanUp, nil)
+	account, err := ovh.NewClient("https://eu.api.ovh.com/1.0", "key", "secret", "consumer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.limiters.get(account).pauses = 3
+
+	if err := s.emitStatusEvent(ctx, events, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	configMap, err := client.CoreV1().ConfigMaps("cert-manager").Get(ctx, "webhook-status", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("expected the ConfigMap to be created: %v", err)
+	}
+	list, err := client.CoreV1().Events("cert-manager").List(ctx, metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Items) != 1 {
+		t.Fatalf("expected 1 event, got %d", len(list.Items))
+	}
+	event := list.Items[0]
+	if event.InvolvedObject.Kind != "ConfigMap" || event.InvolvedObject.Name != configMap.Name || event.Type != corev1.EventTypeWarning {
+		t.Errorf("unexpected event %+v", event)
+	}
+	for _, want := range []string{"2 Present calls (1 failed)", "1 CleanUp calls (0 failed)", "3 pauses", "1 leftover records"} {
+		if !strings.Contains(event.Message, want) {
+			t.Errorf("%q not reported in %q", want, event.Message)
+		}
+	}
+
+	// The counts are reset by each event.
+	if err := s.emitStatusEvent(ctx, events, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	list, err = client.CoreV1().Events("cert-manager").List(ctx, metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, event := range list.Items {
+		if event.Type == corev1.EventTypeNormal && !strings.Contains(event.Message, "0 Present calls (0 failed)") {
+			t.Errorf("expected the counts to be reset, got %q", event.Message)
+		}
+	}
+	if len(list.Items) != 2 {
+		t.Errorf("expected 2 events, got %d", len(list.Items))
+	}
+
+	if _, err := newStatusEvents(client, "webhook-status"); err == nil {
+		t.Error("expected an error for a ConfigMap without namespace")
+	}
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ovh/go-ovh/ovh"
+)
+
+// fakeOVH is an in-memory implementation of the subset of the OVH DNS API
+// used by the webhook.
+type fakeOVH struct {
+	t      *testing.T
+	server *httptest.Server
+
+	mu      sync.Mutex
+	nextID  int64
+	records map[string]map[int64]ovhZoneRecord
+	calls   []string
+	// userAgent is the User-Agent header of the last call.
+	userAgent string
+	// consumerKeys counts the calls by consumer key, and rejectedKeys holds
+	// the consumer keys whose calls are rejected.
+	consumerKeys map[string]int
+	rejectedKeys map[string]bool
+	// undeployed maps a zone to the number of status calls reporting that it
+	// is not deployed yet.
+	undeployed map[string]int
+	// pendingTasks maps a zone to the number of task list calls reporting a
+	// pending task.
+	pendingTasks map[string]int
+	// maxRecords maps a zone to the number of records it holds at most.
+	maxRecords map[string]int
+	// minTTL maps a zone to the minimum TTL of its records, to which lower
+	// TTLs are raised like OVH does.
+	minTTL map[string]int
+	// nameServers maps a zone to its name servers, dns10.ovh.net and
+	// ns10.ovh.net when missing.
+	nameServers map[string][]string
+	// unlisted maps a record ID to the number of record list calls omitting
+	// it, like OVH shortly after its creation.
+	unlisted map[int64]int
+	// dnssec maps a zone to its DNSSEC status, "disabled" when missing.
+	dnssec map[string]string
+	// serials maps a zone to the serial of its SOA record, which each
+	// refresh advances unless the zone is in ignoredRefreshes.
+	serials          map[string]int64
+	ignoredRefreshes map[string]bool
+	// failures maps a call ("METHOD /path") to the HTTP status codes returned
+	// by its next invocations.
+	failures map[string][]int
+	// failureMessages maps a call to the message of its injected failures,
+	// "injected failure" when missing.
+	failureMessages map[string]string
+}
+
+func newFakeOVH(t *testing.T, zones ...string) *fakeOVH {
+	f := &fakeOVH{
+		t:                t,
+		records:          map[string]map[int64]ovhZoneRecord{},
+		failures:         map[string][]int{},
+		failureMessages:  map[string]string{},
+		undeployed:       map[string]int{},
+		pendingTasks:     map[string]int{},
+		dnssec:           map[string]string{},
+		serials:          map[string]int64{},
+		ignoredRefreshes: map[string]bool{},
+		minTTL:           map[string]int{},
+		maxRecords:       map[string]int{},
+		consumerKeys:     map[string]int{},
+		rejectedKeys:     map[string]bool{},
+		unlisted:         map[int64]int{},
+		nameServers:      map[string][]string{},
+	}
+	for _, zone := range zones {
+		f.records[zone] = map[int64]ovhZoneRecord{}
+	}
+	f.server = httptest.NewServer(http.HandlerFunc(f.serveHTTP))
+	t.Cleanup(f.server.Close)
+	return f
+}
+
+// api returns an OVH API wrapper targeting the fake server.
+func (f *fakeOVH) api() *ovhAPI {
+	client, err := ovh.NewClient(f.server.URL, "key", "secret", "consumer")
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	timeouts, err := resolveTimeouts(ovhTimeoutsConfig{}, ovhTimeoutsConfig{})
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	return newOVHAPI(client, timeouts, nil)
+}
+
+func (f *fakeOVH) addRecord(zone string, record ovhZoneRecord) int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.nextID++
+	record.Id = f.nextID
+	f.records[zone][record.Id] = record
+	return record.Id
+}
+
+func (f *fakeOVH) zoneRecords(zone string) []ovhZoneRecord {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	records := []ovhZoneRecord{}
+	for _, record := range f.records[zone] {
+		records = append(records, record)
+	}
+	return records
+}
+
+// fail makes the next invocations of a call return the given status codes.
+func (f *fakeOVH) fail(call string, codes ...int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failures[call] = append(f.failures[call], codes...)
+}
+
+// failWith makes the next invocations of a call return the given status codes
+// with message.
+func (f *fakeOVH) failWith(call, message string, codes ...int) {
+	f.fail(call, codes...)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failureMessages[call] = message
+}
+
+// countCalls returns the number of invocations of the calls starting with
+// prefix (e.g. "POST /domain/zone/example.com/refresh").
+func (f *fakeOVH) countCalls(prefix string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := 0
+	for _, call := range f.calls {
+		if strings.HasPrefix(call, prefix) {
+			n++
+		}
+	}
+	return n
+}
+
+func (f *fakeOVH) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/auth/time" {
+		writeJSON(w, http.StatusOK, time.Now().Unix())
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	call := r.Method + " " + r.URL.Path
+	f.calls = append(f.calls, call)
+	f.userAgent = r.UserAgent()
+	consumerKey := r.Header.Get("X-Ovh-Consumer")
+	f.consumerKeys[consumerKey]++
+	if f.rejectedKeys[consumerKey] {
+		writeJSON(w, http.StatusForbidden, map[string]string{"message": "This credential does not exist"})
+		return
+	}
+	if codes := f.failures[call]; len(codes) > 0 {
+		f.failures[call] = codes[1:]
+		message := f.failureMessages[call]
+		if message == "" {
+			message = "injected failure"
+		}
+		writeJSON(w, codes[0], map[string]string{"message": message})
+		return
+	}
+
+	if r.URL.Path == "/auth/currentCredential" && r.Method == http.MethodGet {
+		writeJSON(w, http.StatusOK, map[string]string{"status": "validated"})
+		return
+	}
+
+	if r.URL.Path == "/domain/zone" && r.Method == http.MethodGet {
+		zones := []string{}
+		for zone := range f.records {
+			zones = append(zones, zone)
+		}
+		writeJSON(w, http.StatusOK, zones)
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/domain/zone/"), "/")
+	records, ok := f.records[parts[0]]
+	if !ok {
+		writeJSON(w, http.StatusNotFound, map[string]string{"message": "zone not found"})
+		return
+	}
+
+	switch {
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		servers, ok := f.nameServers[parts[0]]
+		if !ok {
+			servers = []string{"dns10.ovh.net", "ns10.ovh.net"}
+		}
+		writeJSON(w, http.StatusOK, ovhZone{Name: parts[0], NameServers: servers})
+	case len(parts) == 2 && parts[1] == "status" && r.Method == http.MethodGet:
+		deployed := f.undeployed[parts[0]] == 0
+		if !deployed {
+			f.undeployed[parts[0]]--
+		}
+		writeJSON(w, http.StatusOK, ovhZoneStatus{IsDeployed: deployed})
+	case len(parts) == 2 && parts[1] == "dnssec" && r.Method == http.MethodGet:
+		status := f.dnssec[parts[0]]
+		if status == "" {
+			status = "disabled"
+		}
+		writeJSON(w, http.StatusOK, ovhZoneDNSSEC{Status: status})
+	case len(parts) == 2 && parts[1] == "task" && r.Method == http.MethodGet:
+		ids := []int64{}
+		if f.pendingTasks[parts[0]] > 0 {
+			f.pendingTasks[parts[0]]--
+			ids = append(ids, 1)
+		}
+		writeJSON(w, http.StatusOK, ids)
+	case len(parts) == 2 && parts[1] == "refresh" && r.Method == http.MethodPost:
+		if !f.ignoredRefreshes[parts[0]] {
+			f.serials[parts[0]]++
+		}
+		writeJSON(w, http.StatusOK, nil)
+	case len(parts) == 2 && parts[1] == "soa" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, zoneSOA{Serial: f.serials[parts[0]], NXDomainTTL: f.minTTL[parts[0]]})
+	case len(parts) == 2 && parts[1] == "record" && r.Method == http.MethodGet:
+		query := r.URL.Query()
+		ids := []int64{}
+		for id, record := range records {
+			if fieldType := query.Get("fieldType"); fieldType != "" && record.FieldType != fieldType {
+				continue
+			}
+			if subDomain := query.Get("subDomain"); subDomain != "" && record.SubDomain != subDomain {
+				continue
+			}
+			if f.unlisted[id] > 0 {
+				f.unlisted[id]--
+				continue
+			}
+			ids = append(ids, id)
+		}
+		writeJSON(w, http.StatusOK, ids)
+	case len(parts) == 2 && parts[1] == "record" && r.Method == http.MethodPost:
+		record := ovhZoneRecord{}
+		if err := json.NewDecoder(r.Body).Decode(&record); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"message": err.Error()})
+			return
+		}
+		if max, ok := f.maxRecords[parts[0]]; ok && len(records) >= max {
+			writeJSON(w, http.StatusForbidden, map[string]string{"message": "The maximum number of records for this zone has been reached"})
+			return
+		}
+		// A record without a TTL has the default TTL of the zone.
+		if record.TTL != 0 && record.TTL < f.minTTL[parts[0]] {
+			record.TTL = f.minTTL[parts[0]]
+		}
+		f.nextID++
+		record.Id = f.nextID
+		records[record.Id] = record
+		writeJSON(w, http.StatusOK, record)
+	case len(parts) == 3 && parts[1] == "record":
+		id, _ := strconv.ParseInt(parts[2], 10, 64)
+		record, ok := records[id]
+		if !ok {
+			writeJSON(w, http.StatusNotFound, map[string]string{"message": "record not found"})
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, http.StatusOK, record)
+		case http.MethodPut:
+			update := ovhZoneRecord{}
+			if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"message": err.Error()})
+				return
+			}
+			record.Target = update.Target
+			if update.TTL != 0 {
+				record.TTL = update.TTL
+			}
+			records[id] = record
+			writeJSON(w, http.StatusOK, nil)
+		case http.MethodDelete:
+			delete(records, id)
+			writeJSON(w, http.StatusOK, nil)
+		default:
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"message": "method not allowed"})
+		}
+	default:
+		writeJSON(w, http.StatusNotFound, map[string]string{"message": "not found"})
+	}
+}
+
+func writeJSON(w http.ResponseWriter, code int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if body != nil {
+		json.NewEncoder(w).Encode(body)
+	}
+}
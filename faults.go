@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ovh/go-ovh/ovh"
+	"k8s.io/klog/v2"
+)
+
+// faultInjectionConfirmation is the value OVH_FAULT_INJECTION_CONFIRM must
+// have for OVH_FAULT_INJECTION to be applied, so that the injection of faults
+// is never enabled by mistake.
+const faultInjectionConfirmation = "I-understand-this-breaks-challenges"
+
+// faultInjector makes the OVH API calls fail or slow down, to exercise the
+// retries, the circuit breaker and the timeouts in tests of the webhook
+// against an OVH API which does not fail on demand. A nil faultInjector does
+// not inject anything.
+type faultInjector struct {
+	// rate is the probability that a call fails.
+	rate float64
+	// status is the HTTP status of the failed calls, 0 for a connection
+	// failure.
+	status int
+	// latency delays every call.
+	latency time.Duration
+	// path restricts the faults to the calls whose path starts with it.
+	path string
+}
+
+// faultInjectionFromEnv returns the fault injector set by OVH_FAULT_INJECTION,
+// as a comma-separated list of rate (between 0 and 1, default 1), status
+// (default 503, 0 for a connection failure), latency and path settings, e.g.
+// "rate=0.2,status=409,latency=500ms,path=/domain/zone". It is only applied
+// when OVH_FAULT_INJECTION_CONFIRM is also set to faultInjectionConfirmation.
+func faultInjectionFromEnv() (*faultInjector, error) {
+	spec := os.Getenv("OVH_FAULT_INJECTION")
+	if spec == "" {
+		return nil, nil
+	}
+	if os.Getenv("OVH_FAULT_INJECTION_CONFIRM") != faultInjectionConfirmation {
+		klog.Warningf("Ignoring OVH_FAULT_INJECTION, which is only applied when OVH_FAULT_INJECTION_CONFIRM is set to %s", faultInjectionConfirmation)
+		return nil, nil
+	}
+	faults, err := parseFaultInjection(spec)
+	if err != nil {
+		return nil, err
+	}
+	klog.Warningf("OVH_FAULT_INJECTION is enabled: %d%% of the OVH API calls to %s* fail with status %d, all of them delayed by %v. Never use this setting in production.", int(faults.rate*100), faults.path, faults.status, faults.latency)
+	return faults, nil
+}
+
+func parseFaultInjection(spec string) (*faultInjector, error) {
+	faults := &faultInjector{rate: 1, status: http.StatusServiceUnavailable, path: "/"}
+	for _, setting := range strings.Split(spec, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(setting), "=")
+		var err error
+		switch name {
+		case "rate":
+			faults.rate, err = strconv.ParseFloat(value, 64)
+			if err == nil && (faults.rate < 0 || faults.rate > 1) {
+				err = errors.New("expected a rate between 0 and 1")
+			}
+		case "status":
+			faults.status, err = strconv.Atoi(value)
+			if err == nil && faults.status != 0 && (faults.status < 400 || faults.status > 599) {
+				err = errors.New("expected an error status or 0")
+			}
+		case "latency":
+			faults.latency, err = time.ParseDuration(value)
+			if err == nil && faults.latency < 0 {
+				err = errors.New("expected a positive duration")
+			}
+		case "path":
+			faults.path = value
+			if !strings.HasPrefix(value, "/") {
+				err = errors.New("expected a path starting with /")
+			}
+		default:
+			err = errors.New("expected rate, status, latency or path")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid OVH_FAULT_INJECTION setting %q: %v", setting, err)
+		}
+	}
+	return faults, nil
+}
+
+// injectFaults makes the calls of client fail or slow down as set by faults,
+// when not nil.
+func injectFaults(client *ovh.Client, faults *faultInjector) {
+	if faults == nil {
+		return
+	}
+	prefix := ""
+	if u, err := url.Parse(clientEndpoint(client)); err == nil {
+		prefix = strings.TrimSuffix(u.Path, "/")
+	}
+	base := client.Client.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	client.Client.Transport = &faultTransport{base: base, faults: faults, prefix: prefix}
+}
+
+// faultTransport injects the faults of its injector into the requests
+// matching its path. The path is relative to the endpoint, e.g.
+// /domain/zone for https://eu.api.ovh.com/1.0/domain/zone.
+type faultTransport struct {
+	base   http.RoundTripper
+	faults *faultInjector
+	// prefix is the path of the endpoint.
+	prefix string
+}
+
+func (t *faultTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !strings.HasPrefix(strings.TrimPrefix(req.URL.Path, t.prefix), t.faults.path) {
+		return t.base.RoundTrip(req)
+	}
+	if t.faults.latency > 0 {
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(t.faults.latency):
+		}
+	}
+	if rand.Float64() >= t.faults.rate {
+		return t.base.RoundTrip(req)
+	}
+	if t.faults.status == 0 {
+		return nil, &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("injected connection failure")}
+	}
+	body := fmt.Sprintf(`{"message": "injected failure with status %d"}`, t.faults.status)
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", t.faults.status, http.StatusText(t.faults.status)),
+		StatusCode:    t.faults.status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": []string{"application/json"}},
+		Body:          io.NopCloser(bytes.NewBufferString(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}, nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestFaultInjection(t *testing.T) {
+	shortenRetryDelay(t, time.Millisecond)
+	f := newFakeOVH(t, "example.com")
+	ctx := context.Background()
+
+	faults, err := parseFaultInjection("status=409,path=/domain/zone/example.com/record")
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := f.api()
+	injectFaults(api.client, faults)
+	if _, err := listRecords(ctx, api, "example.com", "TXT", "_acme-challenge"); !isAPIError(err, http.StatusConflict) {
+		t.Errorf("expected the injected conflict, got %v", err)
+	}
+	if n := f.countCalls(""); n != 0 {
+		t.Errorf("expected the failed calls not to reach OVH, got %d calls", n)
+	}
+	// The calls to other paths are not affected.
+	if _, err := getZone(ctx, api, "example.com"); err != nil {
+		t.Error(err)
+	}
+
+	// A connection failure is retried like one to the OVH API.
+	faults, err = parseFaultInjection("status=0,latency=1ms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	api = f.api()
+	injectFaults(api.client, faults)
+	_, err = listRecords(ctx, api, "example.com", "TXT", "_acme-challenge")
+	if errorClass(err) != errorClassTransport {
+		t.Errorf("expected an injected connection failure, got %v", err)
+	}
+
+	for _, spec := range []string{"rate=2", "status=200", "latency=-1s", "path=domain", "ratio=0.5"} {
+		if _, err := parseFaultInjection(spec); err == nil {
+			t.Errorf("expected an error for %s", spec)
+		}
+	}
+}
+
+func TestFaultInjectionRequiresConfirmation(t *testing.T) {
+	t.Setenv("OVH_FAULT_INJECTION", "rate=0.5")
+	if faults, err := faultInjectionFromEnv(); err != nil || faults != nil {
+		t.Errorf("expected the unconfirmed faults to be ignored, got %v, %v", faults, err)
+	}
+	t.Setenv("OVH_FAULT_INJECTION_CONFIRM", "true")
+	if faults, err := faultInjectionFromEnv(); err != nil || faults != nil {
+		t.Errorf("expected the faults to require the confirmation value, got %v, %v", faults, err)
+	}
+	t.Setenv("OVH_FAULT_INJECTION_CONFIRM", faultInjectionConfirmation)
+	if faults, err := faultInjectionFromEnv(); err != nil || faults == nil || faults.rate != 0.5 {
+		t.Errorf("expected the confirmed faults, got %v, %v", faults, err)
+	}
+}
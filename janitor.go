@@ -0,0 +1,117 @@
+package main
+
+import (
+	"sort"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+const (
+	// defaultCachePruneInterval is the default delay between two prunes of
+	// the in-memory caches.
+	defaultCachePruneInterval = 10 * time.Minute
+	// defaultCacheMaxEntries is the default number of entries each cache
+	// keeps after a prune.
+	defaultCacheMaxEntries = 10000
+)
+
+// prunableCache is an in-memory cache of the solver whose entries expire.
+type prunableCache interface {
+	// prune removes the entries expired at now and, when the cache holds
+	// more than max entries, the ones used the longest ago, and returns the
+	// number of entries left. A max of 0 does not bound the entries.
+	prune(now time.Time, max int) int
+}
+
+// caches returns the in-memory caches of the solver, by the name reported in
+// the cache_entries metric. The circuit breakers and the proxy transports, of
+// which there is one per distinct configuration, are not pruned.
+func (s *ovhDNSProviderSolver) caches() map[string]prunableCache {
+	return map[string]prunableCache{
+		"records":        s.records,
+		"secrets":        &s.secrets,
+		"zone_lists":     &s.zones,
+		"name_servers":   &s.propagation,
+		"ttl_ranges":     &s.ttlRanges,
+		"auto_refresh":   &s.autoRefresh,
+		"zone_refreshes": &s.refreshes,
+		"presented":      &s.presented,
+		"consumer_keys":  &s.consumerKeys,
+		"rate_limiters":  &s.limiters,
+	}
+}
+
+// runCacheJanitor prunes the caches every interval until stopCh is closed, so
+// that the entries of the zones and issuers no longer used do not pile up
+// over a long uptime.
+func (s *ovhDNSProviderSolver) runCacheJanitor(interval time.Duration, max int, stopCh <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+			s.pruneCaches(time.Now(), max)
+		}
+	}
+}
+
+// pruneCaches prunes each cache and reports their sizes.
+func (s *ovhDNSProviderSolver) pruneCaches(now time.Time, max int) {
+	for name, cache := range s.caches() {
+		n := cache.prune(now, max)
+		cacheEntries.WithLabelValues(name).Set(float64(n))
+		klog.V(2).Infof("Pruned the %s cache, %d entries left", name, n)
+	}
+}
+
+// accessTimes holds the time of the last use of the entries of a cache, for
+// pruneEntries. Its zero value is ready to use.
+type accessTimes[K comparable] map[K]time.Time
+
+// touch records a use of the entry of key.
+func (a *accessTimes[K]) touch(key K) {
+	if *a == nil {
+		*a = accessTimes[K]{}
+	}
+	(*a)[key] = time.Now()
+}
+
+// pruneEntries removes the entries expired at now and, beyond max entries,
+// the least recently used ones according to used. The entries never used are
+// evicted first, the ones expiring first among them. The access times of the
+// removed entries are removed as well.
+func pruneEntries[K comparable, V any](entries map[K]V, used accessTimes[K], now time.Time, max int, expires func(V) time.Time) int {
+	for key, entry := range entries {
+		if now.After(expires(entry)) {
+			delete(entries, key)
+		}
+	}
+	defer func() {
+		for key := range used {
+			if _, ok := entries[key]; !ok {
+				delete(used, key)
+			}
+		}
+	}()
+	if max == 0 || len(entries) <= max {
+		return len(entries)
+	}
+	keys := make([]K, 0, len(entries))
+	for key := range entries {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		ui, uj := used[keys[i]], used[keys[j]]
+		if !ui.Equal(uj) {
+			return ui.Before(uj)
+		}
+		return expires(entries[keys[i]]).Before(expires(entries[keys[j]]))
+	})
+	for _, key := range keys[:len(keys)-max] {
+		delete(entries, key)
+	}
+	return len(entries)
+}
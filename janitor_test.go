@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestPruneCaches(t *testing.T) {
+	s := &ovhDNSProviderSolver{presented: presentCache{ttl: time.Minute}}
+	s.presented.presented = map[string]time.Time{}
+	for i := 0; i < 3; i++ {
+		s.presented.presented[fmt.Sprint("record", i)] = time.Now().Add(time.Duration(i-3) * time.Second)
+		s.refreshes.noteRefresh(fmt.Sprintf("zone%d.example.com", i))
+	}
+	s.autoRefresh.set("example.com", true)
+
+	// Nothing is expired yet: the cap applies, keeping the newest entries.
+	s.pruneCaches(time.Now(), 2)
+	if n := testutil.ToFloat64(cacheEntries.WithLabelValues("presented")); n != 2 {
+		t.Errorf("expected 2 presented entries, got %v", n)
+	}
+	if _, ok := s.presented.recent("record0"); ok {
+		t.Error("expected the oldest presented entry to be evicted")
+	}
+	if _, ok := s.presented.recent("record2"); !ok {
+		t.Error("expected the newest presented entry to be kept")
+	}
+	if n := testutil.ToFloat64(cacheEntries.WithLabelValues("auto_refresh")); n != 1 {
+		t.Errorf("expected 1 auto refresh entry, got %v", n)
+	}
+
+	// Once expired, all the entries are removed.
+	s.pruneCaches(time.Now().Add(2*autoRefreshCacheTTL), 0)
+	for name := range s.caches() {
+		if n := testutil.ToFloat64(cacheEntries.WithLabelValues(name)); n != 0 {
+			t.Errorf("expected the %s cache to be empty, got %v entries", name, n)
+		}
+	}
+	if s.refreshes.refreshedSince("zone2.example.com", time.Time{}) {
+		t.Error("expected the refresh times to be pruned")
+	}
+}
+
+func TestPruneEntriesLeastRecentlyUsed(t *testing.T) {
+	pc := presentCache{ttl: time.Minute}
+	for i := 0; i < 3; i++ {
+		pc.put(fmt.Sprint("record", i))
+	}
+	// The oldest entry is the most recently used one.
+	if _, ok := pc.recent("record0"); !ok {
+		t.Fatal("expected record0 to be cached")
+	}
+	if n := pc.prune(time.Now(), 2); n != 2 {
+		t.Errorf("expected 2 entries left, got %d", n)
+	}
+	if len(pc.used) != 2 {
+		t.Errorf("expected the access time of the evicted entry to be removed, got %v", pc.used)
+	}
+	if _, ok := pc.recent("record0"); !ok {
+		t.Error("expected the frequently read entry to be kept")
+	}
+	if _, ok := pc.recent("record1"); ok {
+		t.Error("expected the least recently used entry to be evicted")
+	}
+
+	// The record store is pruned as well.
+	ctx := context.Background()
+	records, err := newRecordStore(nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	records.put(ctx, "running", 1)
+	records.put(ctx, "finished", 2)
+	records.release(ctx, "finished", true)
+	records.put(ctx, "other", 3)
+	records.get(ctx, "running")
+	if n := records.prune(time.Now(), 1); n != 2 {
+		t.Errorf("expected 1 entry and 1 leftover left, got %d", n)
+	}
+	if _, ok := records.get(ctx, "running"); !ok {
+		t.Error("expected the frequently read record to be kept")
+	}
+	if n := records.prune(time.Now().Add(recordMaxAge+time.Minute), 0); n != 0 || len(records.leftovers) != 0 {
+		t.Errorf("expected the old records to be pruned, got %d entries and leftovers %v", n, records.leftovers)
+	}
+}
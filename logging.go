@@ -0,0 +1,25 @@
+package main
+
+import "fmt"
+
+// maskedTargetPrefix is the number of characters of a challenge target kept
+// in the logs.
+const maskedTargetPrefix = 8
+
+// logFullTargets disables the masking of the challenge targets in the logs. It
+// is set from the LOG_FULL_TARGETS environment variable.
+var logFullTargets bool
+
+// logTarget returns the challenge target as written in the logs: by default,
+// its first characters and its length, which is enough to correlate the log
+// lines of a challenge without shipping the ACME key to shared log sinks.
+func logTarget(target string) string {
+	if logFullTargets {
+		return fmt.Sprintf("%q", target)
+	}
+	prefix := len(target) / 2
+	if prefix > maskedTargetPrefix {
+		prefix = maskedTargetPrefix
+	}
+	return fmt.Sprintf("%q (%d chars)", target[:prefix]+"...", len(target))
+}
@@ -0,0 +1,19 @@
+package main
+
+import "testing"
+
+func TestLogTarget(t *testing.T) {
+	target := "LHDhK3oGRvkiefQnx7OOczTY5Tic_xZ6HcMOc_gmtoM"
+	if actual, expected := logTarget(target), `"LHDhK3oG..." (43 chars)`; actual != expected {
+		t.Errorf("logTarget = %s, expected %s", actual, expected)
+	}
+	if actual, expected := logTarget("key"), `"k..." (3 chars)`; actual != expected {
+		t.Errorf("logTarget = %s, expected %s", actual, expected)
+	}
+
+	logFullTargets = true
+	defer func() { logFullTargets = false }()
+	if actual, expected := logTarget(target), `"`+target+`"`; actual != expected {
+		t.Errorf("logTarget = %s, expected %s", actual, expected)
+	}
+}
@@ -2,18 +2,28 @@ package main
 
 import (
 	"context"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
+	"unicode"
 
 	corev1 "k8s.io/api/core/v1"
 	extapi "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
+	"k8s.io/klog/v2"
 
 	"github.com/cert-manager/cert-manager/pkg/acme/webhook/apis/acme/v1alpha1"
 	"github.com/cert-manager/cert-manager/pkg/acme/webhook/cmd"
@@ -23,6 +33,43 @@ import (
 
 var GroupName = os.Getenv("GROUP_NAME")
 
+// taskPollInterval is the delay between two checks of the zone tasks, of
+// the zone status or of the listing of a created record. Tests shorten it.
+var taskPollInterval = 2 * time.Second
+
+// listWaitTimeout is the maximum time spent waiting for a created record to
+// be listed, with the verifyListed option. Tests shorten it.
+var listWaitTimeout = 10 * time.Second
+
+// serialWaitTimeout is the maximum time spent waiting for the serial of a
+// zone to advance after its refresh, with the verifySerial option. Tests
+// shorten it.
+var serialWaitTimeout = time.Minute
+
+const (
+	// taskWaitTimeout is the default maximum time spent waiting for the zone
+	// tasks.
+	taskWaitTimeout = 2 * time.Minute
+	// zoneCheckEnforce, zoneCheckWarn and zoneCheckSkip are the values of the
+	// zoneCheck option, which controls what happens when OVH reports that the
+	// zone is not deployed.
+	zoneCheckEnforce = "enforce"
+	zoneCheckWarn    = "warn"
+	zoneCheckSkip    = "skip"
+	// defaultTTL is the TTL of the challenge records when none is configured.
+	defaultTTL = 60
+	// defaultMaxCleanupDeletions is the default number of records a CleanUp
+	// deletes at most. A challenge has a single record, and a few more when
+	// retried Present calls created duplicates.
+	defaultMaxCleanupDeletions = 10
+	// defaultPresentTimeout bounds a whole Present call, including the zone
+	// tasks wait, when no presentTimeout is configured.
+	defaultPresentTimeout = 5 * time.Minute
+	// cleanUpTimeout bounds a whole CleanUp call, including the cleanup
+	// grace period.
+	cleanUpTimeout = 5 * time.Minute
+)
+
 func main() {
 	if GroupName == "" {
 		panic("GROUP_NAME must be specified")
@@ -43,7 +90,60 @@ func main() {
 // To do so, it must implement the `github.com/cert-manager/cert-manager/pkg/acme/webhook.Solver`
 // interface.
 type ovhDNSProviderSolver struct {
-	client *kubernetes.Clientset
+	client kubernetes.Interface
+	// secrets stands in for the Secret fetches failing after secretRetries
+	// retries.
+	secrets       secretCache
+	secretRetries int
+	// started is the start time of the webhook. The Secret fetches keep being
+	// retried for secretStartupWindow after it.
+	started             time.Time
+	secretStartupWindow time.Duration
+	// resources reads the cert-manager resources of the challenges.
+	resources    dynamic.Interface
+	timeouts     ovhTimeoutsConfig
+	allowedZones []string
+	// deniedSubDomains lists the record names that must never be modified.
+	deniedSubDomains []string
+	limiters         rateLimiters
+	breakers         circuitBreakers
+	userAgent        string
+	refreshes        refreshCoalescer
+	refreshWindow    *metav1.Duration
+	presentTimeout   *metav1.Duration
+	autoRefresh      autoRefreshDetector
+	// presented answers the repeated Present calls of a presented record.
+	presented   presentCache
+	ttlRanges   zoneTTLRanges
+	httpHeaders map[string]string
+	proxies     proxyTransports
+	propagation propagationChecker
+	// propagationResolver, when set by PROPAGATION_RESOLVER, is queried
+	// instead of the OVH name servers by the propagation checks.
+	propagationResolver *dnsResolver
+	zones               zoneListCache
+	// challenges bounds the number of concurrent Present and CleanUp calls,
+	// when MAX_CONCURRENT_CHALLENGES is set.
+	challenges *challengeLimiter
+	// presents collapses the concurrent Present calls of a same challenge,
+	// unless DISABLE_PRESENT_COALESCING is set.
+	presents *presentFlights
+	// consumerKeys checks the additional consumer keys of the issuers.
+	consumerKeys consumerKeyChecks
+	// stopCh is closed when the webhook stops, which cancels the running
+	// challenges.
+	stopCh <-chan struct{}
+	// stats counts the calls served, for the status events.
+	stats challengeStats
+	// faults makes the OVH API calls fail, for resilience tests, when
+	// OVH_FAULT_INJECTION is confirmed.
+	faults *faultInjector
+	// skipCleanup leaves the challenge records in place, for debugging.
+	skipCleanup bool
+	records     *recordStore
+	// credentialSources provide the OVH credentials, the issuer config when
+	// empty.
+	credentialSources []credentialSource
 }
 
 // ovhDNSProviderConfig is a structure that is used to decode into when
@@ -61,16 +161,134 @@ type ovhDNSProviderSolver struct {
 // be used by your provider here, you should reference a Kubernetes Secret
 // resource and fetch these credentials using a Kubernetes clientset.
 type ovhDNSProviderConfig struct {
-	Endpoint             string                   `json:"endpoint"`
-	ApplicationKey       string                   `json:"applicationKey"`
-	ApplicationSecretRef corev1.SecretKeySelector `json:"applicationSecretRef"`
-	ConsumerKey          string                   `json:"consumerKey"`
+	Endpoint             string                     `json:"endpoint"`
+	FallbackEndpoint     string                     `json:"fallbackEndpoint"`
+	ApplicationKey       string                     `json:"applicationKey"`
+	ApplicationSecretRef corev1.SecretKeySelector   `json:"applicationSecretRef"`
+	ConsumerKey          string                     `json:"consumerKey"`
+	ConsumerKeys         []string                   `json:"consumerKeys"`
+	CredentialsDir       string                     `json:"credentialsDir"`
+	WaitForTask          bool                       `json:"waitForTask"`
+	Timeouts             ovhTimeoutsConfig          `json:"timeouts"`
+	TTL                  *int                       `json:"ttl"`
+	TTLFromAnnotation    bool                       `json:"ttlFromAnnotation"`
+	TTLZeroMeansMinimum  bool                       `json:"ttlZeroMeansMinimum"`
+	LogOrder             bool                       `json:"logOrder"`
+	VerifyTTL            bool                       `json:"verifyTTL"`
+	VerifyListed         bool                       `json:"verifyListed"`
+	VerifySerial         bool                       `json:"verifySerial"`
+	AllowedZones         []string                   `json:"allowedZones"`
+	DeniedSubDomains     []string                   `json:"deniedSubDomains"`
+	RefreshWindow        *metav1.Duration           `json:"refreshWindow"`
+	OVHHeaders           map[string]string          `json:"ovhHeaders"`
+	VerbatimTarget       bool                       `json:"verbatimTarget"`
+	CheckAuthoritative   bool                       `json:"checkAuthoritative"`
+	WaitForAuthoritative bool                       `json:"waitForAuthoritative"`
+	PropagationPolling   ovhPollingConfig           `json:"propagationPolling"`
+	PropagationResolver  string                     `json:"propagationResolver"`
+	PropagationWait      *metav1.Duration           `json:"propagationWait"`
+	ZonePropagationWaits map[string]metav1.Duration `json:"zonePropagationWaits"`
+	ZoneCheck            string                     `json:"zoneCheck"`
+	RefreshFailure       string                     `json:"refreshFailure"`
+	ZoneCheckSkipZones   []string                   `json:"zoneCheckSkipZones"`
+	ZoneDeployTimeout    *metav1.Duration           `json:"zoneDeployTimeout"`
+	Upsert               bool                       `json:"upsert"`
+	Reconcile            bool                       `json:"reconcile"`
+	PresentTimeout       *metav1.Duration           `json:"presentTimeout"`
+	RetryBudget          *int                       `json:"retryBudget"`
+	MaxCleanupDeletions  *int                       `json:"maxCleanupDeletions"`
+	CleanupGracePeriod   *metav1.Duration           `json:"cleanupGracePeriod"`
+	SettleDelay          *metav1.Duration           `json:"settleDelay"`
+	ZoneSelection        string                     `json:"zoneSelection"`
+	CheckAccountZone     bool                       `json:"checkAccountZone"`
+	SweepOnRecordLimit   bool                       `json:"sweepOnRecordLimit"`
+	ChallengePrefixes    map[string]string          `json:"challengePrefixes"`
+	Zone                 string                     `json:"zone"`
+	IgnoreCleanupErrors  bool                       `json:"ignoreCleanupErrors"`
+	DetectAutoRefresh    bool                       `json:"detectAutoRefresh"`
+	HTTPHeaders          map[string]string          `json:"httpHeaders"`
+	HTTPProxy            string                     `json:"httpProxy"`
+}
+
+// targetMatches returns whether a target stored by OVH is the challenge
+// target. Unless verbatimTarget is set, the stored target is normalized first
+// since some zones store TXT values quoted or fully-qualified.
+func (cfg *ovhDNSProviderConfig) targetMatches(stored, target string) bool {
+	if cfg.VerbatimTarget {
+		return stored == target || stored == txtRecordTarget(target)
+	}
+	return normalizeTarget(stored) == normalizeTarget(target)
+}
+
+// normalizeTarget removes the surrounding whitespace, quotes and trailing dot
+// from a TXT target, and joins the character-strings of a split target.
+func normalizeTarget(target string) string {
+	target = strings.TrimSpace(target)
+	if joined, ok := joinTXTStrings(target); ok {
+		target = joined
+	} else if len(target) >= 2 && strings.HasPrefix(target, `"`) && strings.HasSuffix(target, `"`) {
+		target = target[1 : len(target)-1]
+	}
+	return strings.TrimSuffix(target, ".")
+}
+
+// zoneCheckMode returns the zone check mode of the zone: skip for the zones of
+// zoneCheckSkipZones, which always report that they are not deployed, and the
+// zoneCheck option otherwise.
+func (cfg *ovhDNSProviderConfig) zoneCheckMode(domain string) string {
+	for _, zone := range cfg.ZoneCheckSkipZones {
+		if normalizeName(zone) == normalizeName(domain) {
+			klog.V(2).Infof("Skipping the status check of OVH zone %s, listed in zoneCheckSkipZones", domain)
+			return zoneCheckSkip
+		}
+	}
+	return cfg.ZoneCheck
+}
+
+// propagationWait returns how long Present waits for the propagation of the
+// records of the zone: the wait set for the zone in zonePropagationWaits, and
+// the propagationWait option otherwise.
+func (cfg *ovhDNSProviderConfig) propagationWait(domain string) time.Duration {
+	for zone, wait := range cfg.ZonePropagationWaits {
+		if normalizeName(zone) == normalizeName(domain) {
+			return wait.Duration
+		}
+	}
+	return firstDuration(0, cfg.PropagationWait)
+}
+
+// maxCleanupDeletions returns the number of records a CleanUp deletes at most,
+// 0 meaning no limit.
+func (cfg *ovhDNSProviderConfig) maxCleanupDeletions() int {
+	if cfg.MaxCleanupDeletions == nil {
+		return defaultMaxCleanupDeletions
+	}
+	return *cfg.MaxCleanupDeletions
+}
+
+// recordTTL returns the TTL of the challenge records. A TTL of 0 is not sent
+// to OVH, which then applies the default TTL of the zone, unless the
+// ttlZeroMeansMinimum option replaces it with the minimum TTL of the zone.
+func (cfg *ovhDNSProviderConfig) recordTTL() int {
+	if cfg.TTL == nil {
+		return defaultTTL
+	}
+	return *cfg.TTL
 }
 
 type ovhZoneStatus struct {
 	IsDeployed bool `json:"isDeployed"`
 }
 
+type ovhZoneDNSSEC struct {
+	Status string `json:"status"`
+}
+
+type ovhZone struct {
+	Name        string   `json:"name"`
+	NameServers []string `json:"nameServers"`
+}
+
 type ovhZoneRecord struct {
 	Id        int64  `json:"id,omitempty"`
 	FieldType string `json:"fieldType"`
@@ -79,6 +297,19 @@ type ovhZoneRecord struct {
 	TTL       int    `json:"ttl,omitempty"`
 }
 
+func (r *ovhZoneRecord) UnmarshalJSON(data []byte) error {
+	type plain ovhZoneRecord
+	aux := struct {
+		*plain
+		Id ovhID `json:"id"`
+	}{plain: (*plain)(r)}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	r.Id = int64(aux.Id)
+	return nil
+}
+
 // Name is used as the name for this DNS solver when referencing it on the ACME
 // Issuer resource.
 // This should be unique **within the group name**, i.e. you can have two
@@ -89,61 +320,267 @@ func (s *ovhDNSProviderSolver) Name() string {
 	return "ovh"
 }
 
+// validate checks the credentials of the config and reports all the problems
+// found at once, so that they can be fixed in a single pass.
 func (s *ovhDNSProviderSolver) validate(cfg *ovhDNSProviderConfig, allowAmbientCredentials bool) error {
+	errs := []error{}
+	if cfg.Endpoint != "" {
+		endpoint, err := normalizeEndpoint(cfg.Endpoint)
+		if err != nil {
+			errs = append(errs, err)
+		} else {
+			cfg.Endpoint = endpoint
+		}
+	}
+	if cfg.FallbackEndpoint != "" {
+		endpoint, err := normalizeEndpoint(cfg.FallbackEndpoint)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("fallbackEndpoint: %w", err))
+		} else {
+			cfg.FallbackEndpoint = endpoint
+		}
+	}
+	if cfg.CredentialsDir != "" {
+		// The files belong to the webhook, like the ambient credentials.
+		if !allowAmbientCredentials {
+			errs = append(errs, errors.New("credentialsDir in OVH config requires ambient credentials, which cert-manager only allows for ClusterIssuers by default"))
+		}
+		if !filepath.IsAbs(cfg.CredentialsDir) {
+			errs = append(errs, fmt.Errorf("invalid credentialsDir %q in OVH config: the path must be absolute", cfg.CredentialsDir))
+		}
+		if cfg.Endpoint != "" || cfg.ApplicationKey != "" || cfg.ApplicationSecretRef.Name != "" || cfg.ConsumerKey != "" {
+			errs = append(errs, errors.New("credentialsDir cannot be combined with endpoint, applicationKey, applicationSecretRef or consumerKey in OVH config"))
+		}
+		return errors.Join(errs...)
+	}
 	if allowAmbientCredentials {
 		// When allowAmbientCredentials is true, OVH client can load missing config
 		// values from the environment variables and the ovh.conf files.
-		return nil
+		return errors.Join(errs...)
 	}
+	missing := []string{}
 	if cfg.Endpoint == "" {
-		return errors.New("no endpoint provided in OVH config")
+		missing = append(missing, "endpoint")
 	}
 	if cfg.ApplicationKey == "" {
-		return errors.New("no application key provided in OVH config")
+		missing = append(missing, "applicationKey")
 	}
 	if cfg.ApplicationSecretRef.Name == "" {
-		return errors.New("no application secret provided in OVH config")
+		missing = append(missing, "applicationSecretRef")
 	}
 	if cfg.ConsumerKey == "" {
-		return errors.New("no consumer key provided in OVH config")
+		missing = append(missing, "consumerKey")
 	}
-	return nil
+	if len(missing) > 0 {
+		errs = append(errs, fmt.Errorf("missing in OVH config: %s", strings.Join(missing, ", ")))
+	}
+	return errors.Join(errs...)
 }
 
-func (s *ovhDNSProviderSolver) ovhClient(ch *v1alpha1.ChallengeRequest) (*ovh.Client, error) {
-	cfg, err := loadConfig(ch.Config)
+func (s *ovhDNSProviderSolver) ovhClient(ctx context.Context, ch *v1alpha1.ChallengeRequest, cfg *ovhDNSProviderConfig) (*ovhAPI, error) {
+	err := s.validate(cfg, ch.AllowAmbientCredentials)
 	if err != nil {
 		return nil, err
 	}
 
-	err = s.validate(&cfg, ch.AllowAmbientCredentials)
+	timeouts, err := resolveTimeouts(cfg.Timeouts, s.timeouts)
 	if err != nil {
 		return nil, err
 	}
 
-	applicationSecret, err := s.secret(cfg.ApplicationSecretRef, ch.ResourceNamespace)
+	creds, err := s.loadCredentials(ctx, ch, cfg)
 	if err != nil {
 		return nil, err
 	}
+	klog.V(2).Infof("OVH credentials for %s: %s", ch.ResolvedFQDN, creds.origins)
 
-	return ovh.NewClient(cfg.Endpoint, cfg.ApplicationKey, applicationSecret, cfg.ConsumerKey)
+	client, err := s.newClient(creds, creds.endpoint, cfg)
+	if err != nil {
+		return nil, err
+	}
+	api := newOVHAPI(client, timeouts, s.limiters.get(client))
+	api.breaker = s.breakers.get(api.endpoint)
+	if cfg.FallbackEndpoint != "" {
+		client, err := s.newClient(creds, cfg.FallbackEndpoint, cfg)
+		if err != nil {
+			return nil, err
+		}
+		api.fallback = newOVHAPI(client, timeouts, s.limiters.get(client))
+		api.fallback.breaker = s.breakers.get(api.fallback.endpoint)
+	}
+	api.refreshes = &s.refreshes
+	api.ttlRanges = &s.ttlRanges
+	api.records = s.records
+	api.refreshWindow = firstDuration(defaultRefreshWindow, cfg.RefreshWindow, s.refreshWindow)
+	api.headers = cfg.OVHHeaders
+	api.verifySerial = cfg.VerifySerial
+	api.refreshFailure = cfg.RefreshFailure
+	// The client is created for a single Present or CleanUp, which thus
+	// share a single budget across their calls.
+	retryBudget := defaultRetryBudget
+	if cfg.RetryBudget != nil {
+		retryBudget = *cfg.RetryBudget
+	}
+	api.retries = newRetryBudget(retryBudget)
+	if cfg.DetectAutoRefresh {
+		api.autoRefresh = &s.autoRefresh
+	}
+	if len(cfg.ConsumerKeys) > 0 {
+		err = s.rotateConsumerKeys(ctx, api, creds, cfg, timeouts)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return api, nil
 }
 
-func (s *ovhDNSProviderSolver) secret(ref corev1.SecretKeySelector, namespace string) (string, error) {
+// newClient returns an OVH client of the endpoint authenticated with creds.
+func (s *ovhDNSProviderSolver) newClient(creds ovhCredentials, endpoint string, cfg *ovhDNSProviderConfig) (*ovh.Client, error) {
+	client, err := ovh.NewClient(endpoint, creds.applicationKey, creds.applicationSecret, creds.consumerKey)
+	if err != nil {
+		return nil, err
+	}
+	client.UserAgent = s.userAgent
+	transport, err := s.proxies.get(cfg.HTTPProxy, "OVH config")
+	if err != nil {
+		return nil, err
+	}
+	client.Client.Transport = transport
+	if headers := mergeHeaders(s.httpHeaders, cfg.HTTPHeaders); len(headers) > 0 {
+		client.Client.Transport = &headerTransport{base: client.Client.Transport, headers: headers}
+	}
+	injectFaults(client, s.faults)
+	return client, nil
+}
+
+// secret returns the value of the key of the secret referenced by ref, or of
+// defaultKey when ref has no key, along with the secret.
+func (s *ovhDNSProviderSolver) secret(ctx context.Context, ref corev1.SecretKeySelector, namespace, defaultKey string) (string, *corev1.Secret, error) {
 	if ref.Name == "" {
-		return "", nil
+		return "", nil, nil
 	}
 
-	secret, err := s.client.CoreV1().Secrets(namespace).Get(context.TODO(), ref.Name, metav1.GetOptions{})
+	secret, err := s.getSecret(ctx, namespace, ref.Name)
+	if err != nil {
+		return "", nil, err
+	}
+	value, err := secretValue(secret, namespace, ref, defaultKey)
 	if err != nil {
-		return "", err
+		return "", nil, err
 	}
+	return value, secret, nil
+}
 
-	bytes, ok := secret.Data[ref.Key]
+// secretValue returns the value of the key of ref, or of defaultKey, in the
+// fetched secret.
+func secretValue(secret *corev1.Secret, namespace string, ref corev1.SecretKeySelector, defaultKey string) (string, error) {
+	key := ref.Key
+	if key == "" {
+		key = defaultKey
+	}
+	bytes, ok := secret.Data[key]
+	if !ok && ref.Key == "" {
+		return "", fmt.Errorf("key not found %q in secret '%s/%s': the secret reference has no key, set it to the key of the secret holding the value", key, namespace, ref.Name)
+	}
 	if !ok {
-		return "", fmt.Errorf("key not found %q in secret '%s/%s'", ref.Key, namespace, ref.Name)
+		return "", fmt.Errorf("key not found %q in secret '%s/%s'", key, namespace, ref.Name)
+	}
+	return credentialValue(string(bytes), fmt.Sprintf("key %q of secret '%s/%s'", key, namespace, ref.Name)), nil
+}
+
+// credentialPattern matches the OVH credentials, which are alphanumeric
+// strings.
+var credentialPattern = regexp.MustCompile(`^[A-Za-z0-9]+$`)
+
+// credentialValue cleans up a credential read from a secret. Values created
+// with `kubectl create secret --from-file` often end with a newline, which
+// makes the authentication fail, so trailing whitespace is removed. A value
+// that is the base64 encoding of a valid credential was probably encoded
+// twice: this only produces a warning since the value could be legitimate.
+func credentialValue(value, source string) string {
+	trimmed := strings.TrimRightFunc(value, unicode.IsSpace)
+	if trimmed != value {
+		klog.V(2).Infof("Removed trailing whitespace from %s", source)
+	}
+	if decoded, err := base64.StdEncoding.DecodeString(trimmed); err == nil && credentialPattern.Match(decoded) {
+		klog.Warningf("Value of %s looks base64-encoded twice", source)
 	}
-	return string(bytes), nil
+	return trimmed
+}
+
+// challenge holds the configuration and the record of a challenge request.
+type challenge struct {
+	cfg       ovhDNSProviderConfig
+	domain    string
+	subDomain string
+	target    string
+	// delegated is set when cert-manager followed a CNAME of the
+	// _acme-challenge record (cnameStrategy: Follow): the record must be
+	// presented at the CNAME target, under its exact name.
+	delegated bool
+}
+
+// newChallenge decodes the config of the challenge request and checks that
+// the webhook is allowed to manage its record.
+func (s *ovhDNSProviderSolver) newChallenge(ch *v1alpha1.ChallengeRequest) (*challenge, error) {
+	cfg, err := loadConfig(ch.Config)
+	if err != nil {
+		return nil, err
+	}
+	c := &challenge{
+		cfg:       cfg,
+		domain:    util.UnFqdn(ch.ResolvedZone),
+		target:    ch.Key,
+		delegated: isDelegated(ch),
+	}
+	name := normalizeName(ch.ResolvedFQDN)
+	if c.delegated {
+		klog.V(2).Infof("cert-manager followed the CNAME of _acme-challenge.%s, presenting the record at %s", util.UnFqdn(ch.DNSName), ch.ResolvedFQDN)
+	}
+	if cfg.Zone != "" {
+		// The OVH zone holding the record differs from the zone resolved by
+		// cert-manager.
+		c.domain = normalizeName(cfg.Zone)
+		if name != c.domain && !hasDomainSuffix(name, c.domain) {
+			if c.delegated {
+				return nil, fmt.Errorf("%s, the CNAME target of _acme-challenge.%s, is not in the OVH zone %s set in OVH config", ch.ResolvedFQDN, util.UnFqdn(ch.DNSName), c.domain)
+			}
+			return nil, fmt.Errorf("%s is not in the OVH zone %s set in OVH config", ch.ResolvedFQDN, c.domain)
+		}
+	} else if domain := normalizeName(c.domain); name != domain && !hasDomainSuffix(name, domain) {
+		return nil, fmt.Errorf("%s is not in the zone %s resolved by cert-manager", ch.ResolvedFQDN, ch.ResolvedZone)
+	}
+	err = c.setSubDomain(ch.ResolvedFQDN)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.checkPolicies(c)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// checkPolicies checks that the zone and the subdomain of the challenge are
+// allowed.
+func (s *ovhDNSProviderSolver) checkPolicies(c *challenge) error {
+	err := checkZoneAllowed(c.domain, s.allowedZones, c.cfg.AllowedZones)
+	if err != nil {
+		return err
+	}
+	return checkSubDomainAllowed(c.domain, c.subDomain, s.deniedSubDomains, c.cfg.DeniedSubDomains)
+}
+
+// presentKey identifies the record of the challenge among the records of all
+// the OVH accounts, for the coalescing and the cache of the Present calls.
+func (c *challenge) presentKey(api *ovhAPI) string {
+	return api.account() + "\n" + normalizeName(c.domain) + "\n" + c.subDomain + "\n" + c.target
+}
+
+// recordKey identifies the record of the challenge in the record store.
+func (c *challenge) recordKey() string {
+	return recordKey(c.domain, c.subDomain, c.target)
 }
 
 // Present is responsible for actually presenting the DNS record with the
@@ -151,15 +588,118 @@ func (s *ovhDNSProviderSolver) secret(ref corev1.SecretKeySelector, namespace st
 // This method should tolerate being called multiple times with the same value.
 // cert-manager itself will later perform a self check to ensure that the
 // solver has correctly configured the DNS provider.
-func (s *ovhDNSProviderSolver) Present(ch *v1alpha1.ChallengeRequest) error {
-	ovhClient, err := s.ovhClient(ch)
+func (s *ovhDNSProviderSolver) Present(ch *v1alpha1.ChallengeRequest) (err error) {
+	defer func() { s.stats.note(challengePresent, err) }()
+	c, err := s.newChallenge(ch)
+	if err != nil {
+		return err
+	}
+	timeout := firstDuration(defaultPresentTimeout, c.cfg.PresentTimeout, s.presentTimeout)
+	ctx, cancel := s.challengeContext(timeout)
+	defer cancel()
+	release, err := s.challenges.acquire(ctx, challengePresent)
+	if err == nil {
+		err = s.present(ctx, ch, c)
+		release()
+	}
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("presenting TXT record for %s did not complete within %v: %w", ch.ResolvedFQDN, timeout, err)
+	}
+	return err
+}
+
+func (s *ovhDNSProviderSolver) present(ctx context.Context, ch *v1alpha1.ChallengeRequest, c *challenge) (err error) {
+	steps := newStepTimer(time.Now())
+	defer func() {
+		result := "succeeded"
+		if err != nil {
+			steps.done("failed step")
+			result = "failed"
+		}
+		klog.V(2).Infof("Present for %s %s after %v: %s", ch.ResolvedFQDN, result, steps.total().Round(time.Millisecond), steps)
+	}()
+	api, err := s.ovhClient(ctx, ch, &c.cfg)
+	if err != nil {
+		return err
+	}
+	api.steps = steps
+	steps.done("client construction")
+	err = s.selectZone(ctx, api, ch.ResolvedFQDN, c)
+	if err != nil {
+		return err
+	}
+	steps.done("zone selection")
+	key := c.presentKey(api)
+	if age, ok := s.presented.recent(key); ok {
+		klog.V(2).Infof("TXT record %s for %s in zone %s was presented %v ago, skipping the OVH calls", logTarget(c.target), c.subDomain, c.domain, age.Round(time.Second))
+		return nil
+	}
+	if c.cfg.TTLFromAnnotation {
+		if ttl, ok := s.annotatedTTL(ctx, ch); ok {
+			c.cfg.TTL = &ttl
+		}
+		steps.done("TTL annotation")
+	}
+	var claim func(ctx context.Context, ids []int64) (int64, error)
+	if c.cfg.Upsert {
+		claim = func(ctx context.Context, ids []int64) (int64, error) {
+			return s.records.claim(ctx, c.recordKey(), ids)
+		}
+	}
+	id, err := s.presents.do(ctx, key, func(ctx context.Context) (int64, error) {
+		if c.cfg.Reconcile {
+			err := reconcileTXTRecords(ctx, api, &c.cfg, c.domain, c.subDomain, c.target, s.records.takeLeftovers)
+			api.steps.done("reconciliation")
+			if err != nil {
+				return 0, err
+			}
+		}
+		return addTXTRecord(ctx, api, &c.cfg, c.domain, c.subDomain, c.target, claim)
+	})
+	// A joined call spends its time waiting for the record of the first one.
+	steps.done("record creation")
 	if err != nil {
 		return err
 	}
-	domain := util.UnFqdn(ch.ResolvedZone)
-	subDomain := getSubDomain(domain, ch.ResolvedFQDN)
-	target := ch.Key
-	return addTXTRecord(ovhClient, domain, subDomain, target)
+	// The ID is recorded even past the deadline so that CleanUp finds it.
+	s.records.put(context.WithoutCancel(ctx), c.recordKey(), id)
+	if c.cfg.LogOrder {
+		s.logOrder(ctx, ch, c, id)
+		steps.done("order lookup")
+	}
+	logDNSSECStatus(ctx, api, c.domain)
+	steps.done("DNSSEC status")
+	if c.cfg.WaitForTask {
+		err = waitForTasks(ctx, api, c.domain)
+		steps.done("task wait")
+		if err != nil {
+			return err
+		}
+	}
+	if wait := c.cfg.propagationWait(c.domain); wait > 0 {
+		klog.V(2).Infof("Waiting %v for the propagation of the record for %s in zone %s", wait, c.subDomain, c.domain)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("propagation wait of the record for %s in OVH zone %s interrupted: %w", c.subDomain, c.domain, ctx.Err())
+		case <-time.After(wait):
+		}
+		steps.done("zone propagation wait")
+	}
+	resolver := s.propagationResolver
+	if c.cfg.PropagationResolver != "" {
+		// The resolver was validated by loadConfig.
+		resolver, _ = parseResolver(c.cfg.PropagationResolver, "OVH config")
+	}
+	if c.cfg.WaitForAuthoritative {
+		s.propagation.wait(ctx, api, c.domain, ch.ResolvedFQDN, c.target, c.cfg.PropagationPolling, resolver)
+		steps.done("propagation wait")
+	}
+	if c.cfg.CheckAuthoritative {
+		s.propagation.check(ctx, api, c.domain, ch.ResolvedFQDN, c.target, resolver)
+		steps.done("authoritative check")
+	}
+	s.presented.put(key)
+	return nil
 }
 
 // CleanUp should delete the relevant TXT record from the DNS provider console.
@@ -168,15 +708,108 @@ func (s *ovhDNSProviderSolver) Present(ch *v1alpha1.ChallengeRequest) error {
 // value provided on the ChallengeRequest should be cleaned up.
 // This is in order to facilitate multiple DNS validations for the same domain
 // concurrently.
-func (s *ovhDNSProviderSolver) CleanUp(ch *v1alpha1.ChallengeRequest) error {
-	ovhClient, err := s.ovhClient(ch)
+func (s *ovhDNSProviderSolver) CleanUp(ch *v1alpha1.ChallengeRequest) (err error) {
+	defer func() { s.stats.note(challengeCleanUp, err) }()
+	if s.skipCleanup {
+		klog.Infof("Skipping cleanup of TXT record for %s (SKIP_CLEANUP is enabled)", ch.ResolvedFQDN)
+		if c, err := s.newChallenge(ch); err == nil {
+			// The record is left in the zone. Present stored its ID under
+			// the zone it selected, which is not selected again so that
+			// skipping the cleanup makes no OVH API call.
+			ctx, cancel := s.challengeContext(cleanUpTimeout)
+			defer cancel()
+			for _, key := range c.recordKeys(ch.ResolvedFQDN) {
+				if _, ok := s.records.get(ctx, key); ok {
+					s.records.release(ctx, key, true)
+				}
+			}
+		}
+		return nil
+	}
+	c, err := s.newChallenge(ch)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := s.challengeContext(cleanUpTimeout)
+	defer cancel()
+	release, err := s.challenges.acquire(ctx, challengeCleanUp)
+	if err != nil {
+		return err
+	}
+	err = s.cleanUp(ctx, ch, c)
+	release()
+	if errors.Is(err, errPresentedAgain) {
+		// The record belongs to the new challenge now.
+		klog.Infof("Keeping TXT record for %s, presented again during the cleanup grace period", ch.ResolvedFQDN)
+		return nil
+	}
+	if err != nil && !c.cfg.IgnoreCleanupErrors {
+		return err
+	}
+	if err != nil {
+		klog.Errorf("Ignoring failed cleanup of TXT record for %s, the record may have to be deleted manually: %v", ch.ResolvedFQDN, err)
+		ignoredCleanupErrors.WithLabelValues(sensitiveLabel(c.domain)).Inc()
+	}
+	// The record is released even once ctx is done, e.g. after an ignored
+	// error of an interrupted cleanup.
+	s.records.release(context.WithoutCancel(ctx), c.recordKey(), err != nil)
+	return nil
+}
+
+// challengeContext returns the context of a Present or CleanUp call, done
+// after timeout or when the webhook stops. The Solver interface passes no
+// context of the webhook request: the calls to OVH are abandoned on shutdown
+// instead, when the request is cancelled anyway.
+func (s *ovhDNSProviderSolver) challengeContext(timeout time.Duration) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	if s.stopCh != nil {
+		go func() {
+			select {
+			case <-s.stopCh:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+	}
+	return ctx, cancel
+}
+
+// errPresentedAgain reports a record left in place by its CleanUp because a
+// new challenge presented it during the cleanup grace period.
+var errPresentedAgain = errors.New("TXT record presented again")
+
+// cleanUp deletes the TXT record of the challenge c. With a cleanup grace
+// period, it returns errPresentedAgain instead if Present recorded the record
+// during the grace period.
+func (s *ovhDNSProviderSolver) cleanUp(ctx context.Context, ch *v1alpha1.ChallengeRequest, c *challenge) error {
+	api, err := s.ovhClient(ctx, ch, &c.cfg)
+	if err != nil {
+		return err
+	}
+	err = s.selectZone(ctx, api, ch.ResolvedFQDN, c)
 	if err != nil {
 		return err
 	}
-	domain := util.UnFqdn(ch.ResolvedZone)
-	subDomain := getSubDomain(domain, ch.ResolvedFQDN)
-	target := ch.Key
-	return removeTXTRecord(ovhClient, domain, subDomain, target)
+	s.presented.forget(c.presentKey(api))
+	if grace := firstDuration(0, c.cfg.CleanupGracePeriod); grace > 0 {
+		// The record is forgotten first, so that a Present of the record
+		// during the grace period calls OVH and records it again.
+		start := time.Now()
+		klog.V(2).Infof("Waiting %v before the cleanup of the TXT record for %s in zone %s", grace, c.subDomain, c.domain)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("cleanup grace period of the record for %s in OVH zone %s interrupted: %w", c.subDomain, c.domain, ctx.Err())
+		case <-time.After(grace):
+		}
+		if s.records.putSince(c.recordKey(), start) {
+			return errPresentedAgain
+		}
+	}
+	knownIDs := []int64{}
+	if id, ok := s.records.get(ctx, c.recordKey()); ok {
+		knownIDs = append(knownIDs, id)
+	}
+	return removeTXTRecord(ctx, api, &c.cfg, c.domain, c.subDomain, c.target, knownIDs)
 }
 
 // Initialize will be called when the webhook first starts.
@@ -189,12 +822,226 @@ func (s *ovhDNSProviderSolver) CleanUp(ch *v1alpha1.ChallengeRequest) error {
 // The stopCh can be used to handle early termination of the webhook, in cases
 // where a SIGTERM or similar signal is sent to the webhook process.
 func (s *ovhDNSProviderSolver) Initialize(kubeClientConfig *rest.Config, stopCh <-chan struct{}) error {
+	kubeDirect, err := boolFromEnv("KUBE_API_NO_PROXY")
+	if err != nil {
+		return err
+	}
+	if kubeDirect {
+		// The proxy environment variables then only apply to the OVH API.
+		kubeClientConfig = rest.CopyConfig(kubeClientConfig)
+		kubeClientConfig.Proxy = func(*http.Request) (*url.URL, error) { return nil, nil }
+	}
+
 	client, err := kubernetes.NewForConfig(kubeClientConfig)
 	if err != nil {
 		return err
 	}
+	resources, err := dynamic.NewForConfig(kubeClientConfig)
+	if err != nil {
+		return err
+	}
+
+	timeouts, err := timeoutsFromEnv()
+	if err != nil {
+		return err
+	}
+
+	maxIdleConnsPerHost, err := intFromEnv("OVH_MAX_IDLE_CONNS_PER_HOST", 0)
+	if err != nil {
+		return err
+	}
+	idleConnTimeout, err := durationFromEnv("OVH_IDLE_CONN_TIMEOUT")
+	if err != nil {
+		return err
+	}
+
+	refreshWindow, err := durationFromEnv("REFRESH_WINDOW")
+	if err != nil {
+		return err
+	}
+
+	breakerThreshold, err := intFromEnv("CIRCUIT_BREAKER_THRESHOLD", defaultBreakerThreshold)
+	if err != nil {
+		return err
+	}
+	secretRetries, err := intFromEnv("SECRET_FETCH_RETRIES", defaultSecretFetchRetries)
+	if err != nil {
+		return err
+	}
+	secretStartupWindow, err := durationFromEnv("SECRET_STARTUP_WINDOW")
+	if err != nil {
+		return err
+	}
+	presentCacheTTL, err := durationFromEnv("PRESENT_CACHE_TTL")
+	if err != nil {
+		return err
+	}
+	maxChallenges, err := intFromEnv("MAX_CONCURRENT_CHALLENGES", 0)
+	if err != nil {
+		return err
+	}
+	cachePruneInterval, err := durationFromEnv("CACHE_PRUNE_INTERVAL")
+	if err != nil {
+		return err
+	}
+	cacheMaxEntries, err := intFromEnv("CACHE_MAX_ENTRIES", defaultCacheMaxEntries)
+	if err != nil {
+		return err
+	}
+
+	breakerWindow, err := durationFromEnv("CIRCUIT_BREAKER_WINDOW")
+	if err != nil {
+		return err
+	}
+	if breakerWindow != nil && breakerWindow.Duration == 0 {
+		return fmt.Errorf("invalid CIRCUIT_BREAKER_WINDOW: %v", breakerWindow.Duration)
+	}
+	breakerCooldown, err := durationFromEnv("CIRCUIT_BREAKER_COOLDOWN")
+	if err != nil {
+		return err
+	}
+
+	logFullTargets, err = boolFromEnv("LOG_FULL_TARGETS")
+	if err != nil {
+		return err
+	}
+
+	metricsLabels, metricsLabelSalt, err = metricsLabelsFromEnv()
+	if err != nil {
+		return err
+	}
+
+	presentTimeout, err := durationFromEnv("PRESENT_TIMEOUT")
+	if err != nil {
+		return err
+	}
+	if presentTimeout != nil && presentTimeout.Duration == 0 {
+		return fmt.Errorf("invalid PRESENT_TIMEOUT: %v", presentTimeout.Duration)
+	}
+
+	skipCleanup, err := boolFromEnv("SKIP_CLEANUP")
+	if err != nil {
+		return err
+	}
+	disablePresentCoalescing, err := boolFromEnv("DISABLE_PRESENT_COALESCING")
+	if err != nil {
+		return err
+	}
+	faults, err := faultInjectionFromEnv()
+	if err != nil {
+		return err
+	}
+	if skipCleanup {
+		klog.Warning("SKIP_CLEANUP is enabled: challenge records will NOT be deleted. Never use this setting in production.")
+	}
+
+	var propagationResolver *dnsResolver
+	if resolver := os.Getenv("PROPAGATION_RESOLVER"); resolver != "" {
+		propagationResolver, err = parseResolver(resolver, "PROPAGATION_RESOLVER")
+		if err != nil {
+			return err
+		}
+	}
+
+	httpHeaders, err := mapFromEnv("OVH_HTTP_HEADERS")
+	if err != nil {
+		return err
+	}
+	if err := validateHTTPHeaders(httpHeaders, "OVH_HTTP_HEADERS"); err != nil {
+		return err
+	}
+
+	records, err := newRecordStore(client, os.Getenv("RECORD_STORE_CONFIGMAP"))
+	if err != nil {
+		return err
+	}
+	statusEvents, err := newStatusEvents(client, os.Getenv("STATUS_EVENTS_CONFIGMAP"))
+	if err != nil {
+		return err
+	}
+	statusEventsInterval, err := durationFromEnv("STATUS_EVENTS_INTERVAL")
+	if err != nil {
+		return err
+	}
 
 	s.client = client
+	s.secretRetries = secretRetries
+	s.started = time.Now()
+	s.secretStartupWindow = firstDuration(defaultSecretStartupWindow, secretStartupWindow)
+	s.resources = resources
+	s.records = records
+	s.stopCh = stopCh
+	s.timeouts = timeouts
+	s.allowedZones = listFromEnv("ALLOWED_ZONES")
+	s.deniedSubDomains = listFromEnv("DENIED_SUBDOMAINS")
+	s.userAgent = userAgent()
+	s.refreshWindow = refreshWindow
+	s.presentTimeout = presentTimeout
+	s.httpHeaders = httpHeaders
+	s.propagationResolver = propagationResolver
+	s.skipCleanup = skipCleanup
+	s.faults = faults
+	s.challenges = newChallengeLimiter(int64(maxChallenges))
+	s.presented.ttl = firstDuration(defaultPresentCacheTTL, presentCacheTTL)
+	if !disablePresentCoalescing {
+		s.presents = &presentFlights{}
+	}
+	s.proxies.maxIdleConnsPerHost = maxIdleConnsPerHost
+	s.proxies.idleConnTimeout = firstDuration(0, idleConnTimeout)
+	s.breakers.threshold = breakerThreshold
+	s.breakers.window = firstDuration(defaultBreakerWindow, breakerWindow)
+	s.breakers.cooldown = firstDuration(defaultBreakerCooldown, breakerCooldown)
+	if interval := firstDuration(defaultCachePruneInterval, cachePruneInterval); interval != 0 {
+		go s.runCacheJanitor(interval, cacheMaxEntries, stopCh)
+	}
+	if interval := firstDuration(defaultStatusEventsInterval, statusEventsInterval); statusEvents != nil && interval != 0 {
+		go s.runStatusEvents(statusEvents, interval, stopCh)
+	}
+
+	proxy, checkProxy, err := proxyCheckFromEnv()
+	if err != nil {
+		return err
+	}
+	if checkProxy {
+		ctx, cancel := context.WithTimeout(context.Background(), proxyCheckTimeout)
+		err = s.checkProxy(ctx, proxy)
+		cancel()
+		if err != nil {
+			return err
+		}
+	}
+
+	if zone := os.Getenv("SELF_TEST_ZONE"); zone != "" {
+		api, err := s.environmentAPI()
+		if err != nil {
+			return fmt.Errorf("unable to run the self-test: %v", err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), selfTestTimeout)
+		err = selfTest(ctx, api, util.UnFqdn(zone))
+		cancel()
+		if err != nil {
+			return err
+		}
+	}
+
+	if addr := os.Getenv("METRICS_BIND_ADDRESS"); addr != "" {
+		var admin http.Handler
+		if token := os.Getenv("ADMIN_TOKEN"); token != "" {
+			prefixes, err := mapFromEnv("ADMIN_CHALLENGE_PREFIXES")
+			if err != nil {
+				return err
+			}
+			handler, err := s.newAdminHandler(token, listFromEnv("ADMIN_ZONES"), prefixes)
+			if err != nil {
+				return fmt.Errorf("unable to create the admin endpoint: %v", err)
+			}
+			admin = handler
+		}
+		err = startMetricsServer(addr, stopCh, admin)
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -209,120 +1056,734 @@ func loadConfig(cfgJSON *extapi.JSON) (ovhDNSProviderConfig, error) {
 	if err := json.Unmarshal(cfgJSON.Raw, &cfg); err != nil {
 		return cfg, fmt.Errorf("error decoding OVH config: %v", err)
 	}
+	for _, consumerKey := range cfg.ConsumerKeys {
+		if consumerKey == "" {
+			return cfg, errors.New("invalid consumerKeys in OVH config: empty consumer key")
+		}
+	}
+	if cfg.TTL != nil && *cfg.TTL < 0 {
+		return cfg, fmt.Errorf("invalid TTL in OVH config: %d", *cfg.TTL)
+	}
+	if cfg.RefreshWindow != nil && cfg.RefreshWindow.Duration < 0 {
+		return cfg, fmt.Errorf("invalid refresh window in OVH config: %v", cfg.RefreshWindow.Duration)
+	}
+	if cfg.ZoneDeployTimeout != nil && cfg.ZoneDeployTimeout.Duration < 0 {
+		return cfg, fmt.Errorf("invalid zone deploy timeout in OVH config: %v", cfg.ZoneDeployTimeout.Duration)
+	}
+	if err := cfg.PropagationPolling.validate(); err != nil {
+		return cfg, err
+	}
+	if cfg.PropagationResolver != "" {
+		if _, err := parseResolver(cfg.PropagationResolver, "OVH config"); err != nil {
+			return cfg, err
+		}
+	}
+	if cfg.SettleDelay != nil && cfg.SettleDelay.Duration < 0 {
+		return cfg, fmt.Errorf("invalid settle delay in OVH config: %v", cfg.SettleDelay.Duration)
+	}
+	if cfg.CleanupGracePeriod != nil && cfg.CleanupGracePeriod.Duration < 0 {
+		return cfg, fmt.Errorf("invalid cleanup grace period in OVH config: %v", cfg.CleanupGracePeriod.Duration)
+	}
+	if cfg.MaxCleanupDeletions != nil && *cfg.MaxCleanupDeletions < 0 {
+		return cfg, fmt.Errorf("invalid max cleanup deletions in OVH config: %d", *cfg.MaxCleanupDeletions)
+	}
+	if cfg.RetryBudget != nil && *cfg.RetryBudget < 0 {
+		return cfg, fmt.Errorf("invalid retry budget in OVH config: %d", *cfg.RetryBudget)
+	}
+	if cfg.PresentTimeout != nil && cfg.PresentTimeout.Duration <= 0 {
+		return cfg, fmt.Errorf("invalid present timeout in OVH config: %v", cfg.PresentTimeout.Duration)
+	}
+	if err := validateOVHHeaders(cfg.OVHHeaders); err != nil {
+		return cfg, err
+	}
+	if err := validateHTTPHeaders(cfg.HTTPHeaders, "OVH config"); err != nil {
+		return cfg, err
+	}
+	if cfg.HTTPProxy != "" {
+		if _, err := parseProxyURL(cfg.HTTPProxy, "OVH config"); err != nil {
+			return cfg, err
+		}
+	}
+	if cfg.Zone != "" && cfg.ZoneSelection != "" {
+		return cfg, errors.New("zone and zoneSelection cannot be combined in OVH config")
+	}
+	if cfg.Zone != "" && !zoneNamePattern.MatchString(normalizeName(cfg.Zone)) {
+		return cfg, fmt.Errorf("invalid zone %q in OVH config", cfg.Zone)
+	}
+	for _, zone := range cfg.ZoneCheckSkipZones {
+		if !zoneNamePattern.MatchString(normalizeName(zone)) {
+			return cfg, fmt.Errorf("invalid zone %q in the zone check skip list of OVH config", zone)
+		}
+	}
+	if cfg.PropagationWait != nil && cfg.PropagationWait.Duration < 0 {
+		return cfg, fmt.Errorf("invalid propagation wait in OVH config: %v", cfg.PropagationWait.Duration)
+	}
+	for zone, wait := range cfg.ZonePropagationWaits {
+		if !zoneNamePattern.MatchString(normalizeName(zone)) {
+			return cfg, fmt.Errorf("invalid zone %q in the zone propagation waits of OVH config", zone)
+		}
+		if wait.Duration < 0 {
+			return cfg, fmt.Errorf("invalid propagation wait %v for zone %s in OVH config", wait.Duration, zone)
+		}
+	}
+	for zone, prefix := range cfg.ChallengePrefixes {
+		if !zoneNamePattern.MatchString(normalizeName(zone)) {
+			return cfg, fmt.Errorf("invalid zone %q in the challenge prefixes of OVH config", zone)
+		}
+		if !challengePrefixPattern.MatchString(prefix) {
+			return cfg, fmt.Errorf("invalid challenge prefix %q for zone %s in OVH config", prefix, zone)
+		}
+	}
+	switch cfg.ZoneSelection {
+	case "":
+		cfg.ZoneSelection = zoneSelectionLongest
+	case zoneSelectionResolved, zoneSelectionLongest, zoneSelectionShortest:
+	default:
+		return cfg, fmt.Errorf("invalid zone selection %q in OVH config: expected %s, %s or %s", cfg.ZoneSelection, zoneSelectionResolved, zoneSelectionLongest, zoneSelectionShortest)
+	}
+	switch cfg.ZoneCheck {
+	case "":
+		cfg.ZoneCheck = zoneCheckEnforce
+	case zoneCheckEnforce, zoneCheckWarn, zoneCheckSkip:
+	default:
+		return cfg, fmt.Errorf("invalid zone check %q in OVH config: expected %s, %s or %s", cfg.ZoneCheck, zoneCheckEnforce, zoneCheckWarn, zoneCheckSkip)
+	}
+	switch cfg.RefreshFailure {
+	case "":
+		cfg.RefreshFailure = refreshFailureFail
+	case refreshFailureFail, refreshFailureTolerate:
+	default:
+		return cfg, fmt.Errorf("invalid refresh failure %q in OVH config: expected %s or %s", cfg.RefreshFailure, refreshFailureFail, refreshFailureTolerate)
+	}
 
 	return cfg, nil
 }
 
+// getSubDomain returns the name of the record relative to the zone. Names are
+// lowercased, as DNS names are case-insensitive and OVH stores them in lower
+// case: Present and CleanUp thus use the same subdomain whatever the case of
+// the FQDN. The subdomain keeps all the labels above the zone, e.g.
+// _acme-challenge.foo.bar for _acme-challenge.foo.bar.example.com and the zone
+// example.com. The stray dots of a zone or name joined with an extra dot, like
+// .example.com or _acme-challenge..example.com, are ignored.
 func getSubDomain(domain, fqdn string) string {
-	if idx := strings.Index(fqdn, "."+domain); idx != -1 {
-		return fqdn[:idx]
+	domain = strings.TrimLeft(normalizeName(domain), ".")
+	fqdn = normalizeName(fqdn)
+	if fqdn == domain {
+		return ""
+	}
+	if strings.HasSuffix(fqdn, "."+domain) {
+		return strings.TrimRight(strings.TrimSuffix(fqdn, "."+domain), ".")
 	}
 
-	return util.UnFqdn(fqdn)
+	return fqdn
 }
 
-func addTXTRecord(ovhClient *ovh.Client, domain, subDomain, target string) error {
-	err := validateZone(ovhClient, domain)
+// addTXTRecord presents the challenge record and returns its ID. With the
+// upsert option, a leftover record of the subdomain, as claimed by claim among
+// the records of the subdomain, is updated instead of creating a new one.
+func addTXTRecord(ctx context.Context, api *ovhAPI, cfg *ovhDNSProviderConfig, domain, subDomain, target string, claim func(ctx context.Context, ids []int64) (int64, error)) (int64, error) {
+	// OVH accepts empty TXT records, which never solve a challenge: an empty
+	// key is a bug of the caller, reported instead of creating the record.
+	if target == "" {
+		emptyTargetsRefused.WithLabelValues(sensitiveLabel(domain)).Inc()
+		return 0, fmt.Errorf("refusing to create an empty TXT record for %s in OVH zone %s: the challenge has no key", subDomain, domain)
+	}
+	err := validateTXTTarget(target)
 	if err != nil {
-		return err
+		return 0, err
+	}
+	err = validateZone(ctx, api, domain, cfg.zoneCheckMode(domain), firstDuration(0, cfg.ZoneDeployTimeout))
+	api.steps.done("zone validation")
+	if err != nil {
+		return 0, err
 	}
 
-	_, err = createRecord(ovhClient, domain, "TXT", subDomain, target)
+	// The OVH API has no idempotency key for record creation: the record is
+	// identified by the (zone, subdomain, target) triple instead, so that a
+	// retried Present does not create a duplicate record.
+	existing, others, err := matchTXTRecords(ctx, api, cfg, domain, subDomain, target)
 	if err != nil {
-		return err
+		return 0, err
+	}
+	if len(existing) == 0 {
+		warnUnmanagedTXTRecords(api, domain, subDomain, others)
 	}
-	return refreshRecords(ovhClient, domain)
+	if len(existing) > 0 {
+		klog.V(2).Infof("TXT record %s for %s in zone %s already exists: %v", logTarget(target), subDomain, domain, existing)
+		api.steps.done("record creation")
+		_, err = refreshRecords(ctx, api, domain)
+		api.steps.done("refresh")
+		return existing[0], err
+	}
+
+	ttl := cfg.recordTTL()
+	if ttl == 0 && cfg.TTLZeroMeansMinimum {
+		ttl = zoneMinimumTTL(ctx, api, domain)
+	}
+	ttl = api.ttlRanges.clamp(domain, ttl)
+	created := time.Now()
+	var id int64
+	if cfg.Upsert && claim != nil {
+		id, err = replaceTXTRecord(ctx, api, domain, subDomain, target, ttl, claim)
+		if err != nil {
+			return 0, err
+		}
+	}
+	if id == 0 {
+		record, err := createRecord(ctx, api, domain, "TXT", subDomain, txtRecordTarget(target), ttl)
+		if err != nil && ttl != 0 && isTTLRejected(err) {
+			klog.Warningf("OVH rejected the TTL %d in zone %s, creating the record for %s with the default TTL of the zone: %v", ttl, domain, subDomain, err)
+			ttl = 0
+			record, err = createRecord(ctx, api, domain, "TXT", subDomain, txtRecordTarget(target), ttl)
+		}
+		if isRecordLimitReached(err) {
+			record, err = createAfterRecordLimit(ctx, api, cfg, domain, subDomain, target, ttl, err)
+		}
+		if isAPIError(err, http.StatusConflict) {
+			// An equivalent record is being created concurrently, e.g. by
+			// another replica of the webhook.
+			id, err = conflictingTXTRecord(ctx, api, cfg, domain, subDomain, target, err)
+		} else if err == nil {
+			api.ttlRanges.learn(domain, ttl, record.TTL)
+			id = record.Id
+			klog.V(2).Infof("Created TXT record %d %s for %s in zone %s", id, logTarget(target), subDomain, domain)
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	if cfg.VerifyTTL && ttl != 0 {
+		verifyRecordTTL(ctx, api, domain, id, ttl)
+	}
+	fqdn := domain
+	if subDomain != "" {
+		fqdn = subDomain + "." + domain
+	}
+	api.steps.done("record creation")
+	err = settle(ctx, api, cfg, "creation", domain, subDomain)
+	if err != nil {
+		return id, err
+	}
+	detectAutoRefresh(ctx, api, domain, fqdn, target, created)
+	_, err = refreshRecords(ctx, api, domain)
+	api.steps.done("refresh")
+	if err == nil {
+		err = settle(ctx, api, cfg, "refresh", domain, subDomain)
+	}
+	if err == nil && cfg.VerifyListed {
+		err = waitForListedRecord(ctx, api, domain, subDomain, id)
+		api.steps.done("list verification")
+	}
+	return id, err
+}
+
+// settle waits for the settleDelay option after the creation of the record
+// for subDomain or the refresh of its zone, named by step, for the zones
+// whose refresh misses a record created a moment before.
+func settle(ctx context.Context, api *ovhAPI, cfg *ovhDNSProviderConfig, step, domain, subDomain string) error {
+	delay := firstDuration(0, cfg.SettleDelay)
+	if delay <= 0 {
+		return nil
+	}
+	klog.V(2).Infof("Waiting %v after the %s of the record for %s in zone %s", delay, step, subDomain, domain)
+	select {
+	case <-ctx.Done():
+		return fmt.Errorf("settle delay after the %s of the record for %s in OVH zone %s interrupted: %w", step, subDomain, domain, ctx.Err())
+	case <-time.After(delay):
+	}
+	api.steps.done(step + " settle delay")
+	return nil
+}
+
+// conflictingTXTRecord returns the ID of the record matching the target whose
+// concurrent creation made OVH reject the creation of the record with a
+// conflict. It returns the conflict error if there is no such record.
+func conflictingTXTRecord(ctx context.Context, api *ovhAPI, cfg *ovhDNSProviderConfig, domain, subDomain, target string, conflict error) (int64, error) {
+	existing, err := findTXTRecords(ctx, api, cfg, domain, subDomain, target)
+	if err != nil {
+		return 0, err
+	}
+	if len(existing) == 0 {
+		return 0, conflict
+	}
+	klog.V(2).Infof("Creation of TXT record %s for %s in zone %s conflicted with the creation of record %d: %v", logTarget(target), subDomain, domain, existing[0], conflict)
+	return existing[0], nil
 }
 
-func removeTXTRecord(ovhClient *ovh.Client, domain, subDomain, target string) error {
-	ids, err := listRecords(ovhClient, domain, "TXT", subDomain)
+// replaceTXTRecord updates the target of a leftover record of the subdomain,
+// i.e. a record of a finished challenge whose cleanup was skipped or failed.
+// The records are claimed one at a time, so that concurrent challenges for the
+// same name (like a wildcard and its apex) never update the same record, and
+// the records the webhook did not create are never modified. It returns 0
+// when there is no leftover record.
+func replaceTXTRecord(ctx context.Context, api *ovhAPI, domain, subDomain, target string, ttl int, claim func(ctx context.Context, ids []int64) (int64, error)) (int64, error) {
+	ids, err := listRecords(ctx, api, domain, "TXT", subDomain)
+	if err != nil {
+		return 0, err
+	}
+	for len(ids) > 0 {
+		id, err := claim(ctx, ids)
+		if err != nil || id == 0 {
+			return 0, err
+		}
+		err = updateRecord(ctx, api, domain, id, txtRecordTarget(target), ttl)
+		if isAPIError(err, http.StatusNotFound) {
+			// The record was deleted in the meantime.
+			ids = removeID(ids, id)
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		klog.V(2).Infof("Replaced target of TXT record %d for %s in zone %s with %s", id, subDomain, domain, logTarget(target))
+		return id, nil
+	}
+	return 0, nil
+}
+
+// reconcileTXTRecords deletes the stale records of the subdomain, i.e. the
+// leftover records, as taken by take among the records of the subdomain, whose
+// target is not the current one. A leftover record with the current target is
+// kept for addTXTRecord to reuse. The records of the running challenges and
+// the records the webhook did not create are never deleted. The deletions are
+// deployed by the refresh of addTXTRecord.
+func reconcileTXTRecords(ctx context.Context, api *ovhAPI, cfg *ovhDNSProviderConfig, domain, subDomain, target string, take func(ctx context.Context, ids []int64) ([]int64, error)) error {
+	ids, err := listRecords(ctx, api, domain, "TXT", subDomain)
+	if err != nil || len(ids) == 0 {
+		return err
+	}
+	leftovers, err := take(ctx, ids)
 	if err != nil {
 		return err
 	}
+	for _, id := range leftovers {
+		record, err := getRecord(ctx, api, domain, id)
+		if isAPIError(err, http.StatusNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if cfg.targetMatches(record.Target, target) {
+			continue
+		}
+		err = deleteRecord(ctx, api, domain, id)
+		if err != nil && !isAPIError(err, http.StatusNotFound) {
+			return fmt.Errorf("deletion of stale TXT record %d for %s in OVH zone %s: %w", id, subDomain, domain, err)
+		}
+		klog.V(2).Infof("Deleted stale TXT record %d for %s in zone %s", id, subDomain, domain)
+	}
+	return nil
+}
+
+func removeID(ids []int64, id int64) []int64 {
+	kept := []int64{}
+	for _, other := range ids {
+		if other != id {
+			kept = append(kept, other)
+		}
+	}
+	return kept
+}
 
+// findTXTRecords returns the IDs of the TXT records of the subdomain whose
+// target matches the given one. The OVH API only filters the records by type
+// and subdomain, so each of them is fetched to match its target. The cleanup
+// avoids these calls when the record store knows the ID of the record.
+func findTXTRecords(ctx context.Context, api *ovhAPI, cfg *ovhDNSProviderConfig, domain, subDomain, target string) ([]int64, error) {
+	matching, _, err := matchTXTRecords(ctx, api, cfg, domain, subDomain, target)
+	return matching, err
+}
+
+// matchTXTRecords returns the IDs of the TXT records of the subdomain whose
+// target matches the given one, and the other TXT records of the subdomain.
+func matchTXTRecords(ctx context.Context, api *ovhAPI, cfg *ovhDNSProviderConfig, domain, subDomain, target string) ([]int64, []*ovhZoneRecord, error) {
+	ids, err := listRecords(ctx, api, domain, "TXT", subDomain)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	matching := []int64{}
+	others := []*ovhZoneRecord{}
 	for _, id := range ids {
-		record, err := getRecord(ovhClient, domain, id)
+		record, err := getRecord(ctx, api, domain, id)
 		if err != nil {
-			return err
+			return nil, nil, err
+		}
+		if cfg.targetMatches(record.Target, target) {
+			matching = append(matching, id)
+		} else {
+			others = append(others, record)
 		}
-		if record.Target != target {
+	}
+	return matching, others, nil
+}
+
+// warnUnmanagedTXTRecords logs the TXT records of the subdomain that the
+// webhook did not create, e.g. records created by hand, which the challenge
+// record is added next to. CleanUp only deletes the records matching the
+// target of its challenge, so these records are never deleted; the warning
+// tells who created them when they are noticed later. Without a record store,
+// the records cannot be told apart and nothing is logged.
+func warnUnmanagedTXTRecords(api *ovhAPI, domain, subDomain string, others []*ovhZoneRecord) {
+	if api.records == nil {
+		return
+	}
+	for _, record := range others {
+		if !api.records.managed(record.Id) {
+			klog.Warningf("TXT record %d %s for %s in zone %s was not created by the webhook: adding the challenge record next to it, the webhook never deletes it", record.Id, logTarget(record.Target), subDomain, domain)
+		}
+	}
+}
+
+// knownTXTRecords returns the known IDs that still identify a record of the
+// subdomain matching the target. It returns nil if the records must be looked
+// up instead, because no ID is known or one of them identifies another record.
+func knownTXTRecords(ctx context.Context, api *ovhAPI, cfg *ovhDNSProviderConfig, domain, subDomain, target string, knownIDs []int64) ([]int64, error) {
+	if len(knownIDs) == 0 {
+		return nil, nil
+	}
+	ids := []int64{}
+	for _, id := range knownIDs {
+		record, err := getRecord(ctx, api, domain, id)
+		if isAPIError(err, http.StatusNotFound) {
 			continue
 		}
-		err = deleteRecord(ovhClient, domain, id)
+		if err != nil {
+			return nil, err
+		}
+		if record.FieldType != "TXT" || record.SubDomain != subDomain || !cfg.targetMatches(record.Target, target) {
+			return nil, nil
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// verifyRecordTTL fetches the record back and reports, in the logs and the
+// record_ttl_mismatches_total metric, when its TTL differs from the requested
+// one, e.g. because OVH clamped it to the bounds of the zone.
+func verifyRecordTTL(ctx context.Context, api *ovhAPI, domain string, id int64, ttl int) {
+	record, err := getRecord(ctx, api, domain, id)
+	if err != nil {
+		klog.Warningf("Unable to verify TTL of record %d in zone %s: %v", id, domain, err)
+		return
+	}
+	if record.TTL != ttl {
+		klog.Warningf("TTL of record %d in zone %s is %d instead of the requested %d", id, domain, record.TTL, ttl)
+		ttlMismatches.WithLabelValues(sensitiveLabel(domain)).Inc()
+		api.ttlRanges.learn(domain, ttl, record.TTL)
+	}
+}
+
+// waitForListedRecord waits until the TXT records of the subdomain listed by
+// OVH include the created record, which they may miss for a short while after
+// its creation. It fails if the record is still missing after listWaitTimeout,
+// so that cert-manager retries the Present.
+func waitForListedRecord(ctx context.Context, api *ovhAPI, domain, subDomain string, id int64) error {
+	deadline := time.Now().Add(listWaitTimeout)
+	for {
+		ids, err := listRecords(ctx, api, domain, "TXT", subDomain)
+		if err != nil {
+			return err
+		}
+		for _, listed := range ids {
+			if listed == id {
+				return nil
+			}
+		}
+		if !time.Now().Add(taskPollInterval).Before(deadline) {
+			return fmt.Errorf("TXT record %d for %s is not listed in OVH zone %s %v after its creation", id, subDomain, domain, listWaitTimeout)
+		}
+		klog.V(2).Infof("TXT record %d for %s is not listed in OVH zone %s yet, waiting", id, subDomain, domain)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("TXT record %d for %s is not listed in OVH zone %s: %w", id, subDomain, domain, ctx.Err())
+		case <-time.After(taskPollInterval):
+		}
+	}
+}
+
+// removeTXTRecord deletes the TXT records of the subdomain matching the
+// target. When the IDs of the records created by Present are known, only
+// these records are deleted.
+func removeTXTRecord(ctx context.Context, api *ovhAPI, cfg *ovhDNSProviderConfig, domain, subDomain, target string, knownIDs []int64) error {
+	ids, err := knownTXTRecords(ctx, api, cfg, domain, subDomain, target, knownIDs)
+	if err != nil {
+		return err
+	}
+	if ids == nil {
+		ids, err = findTXTRecords(ctx, api, cfg, domain, subDomain, target)
 		if err != nil {
 			return err
 		}
 	}
 
-	return refreshRecords(ovhClient, domain)
+	// Records are deleted in a predictable order. If the deletion is
+	// interrupted, a later CleanUp resumes with the remaining records.
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	if max := cfg.maxCleanupDeletions(); max != 0 && len(ids) > max {
+		// So many matching records rather points at a bug in the matching
+		// of the targets, which must not wipe out the records of the zone.
+		klog.Warningf("CLEANUP LIMIT REACHED: %d TXT records %s match %s in zone %s, deleting only the first %d of them (maxCleanupDeletions); check and delete the others manually: %v", len(ids), logTarget(target), subDomain, domain, max, ids[max:])
+		ids = ids[:max]
+	}
+	deleted := []int64{}
+	for _, id := range ids {
+		err = ctx.Err()
+		if err == nil {
+			err = deleteRecord(ctx, api, domain, id)
+		}
+		if err != nil {
+			break
+		}
+		deleted = append(deleted, id)
+		klog.V(2).Infof("Deleted TXT record %d %s for %s in zone %s (%d/%d)", id, logTarget(target), subDomain, domain, len(deleted), len(ids))
+	}
+	if err != nil {
+		if len(deleted) > 0 {
+			// Deploy the deletions done so far, even if ctx is done.
+			if _, refreshErr := refreshRecords(context.WithoutCancel(ctx), api, domain); refreshErr != nil {
+				klog.Warningf("Refresh of OVH zone %s %s after a partial cleanup, ignoring: %v", domain, refreshFailed, refreshErr)
+			}
+		}
+		return fmt.Errorf("cleanup of %s in OVH zone %s stopped after %d of %d records: %w", subDomain, domain, len(deleted), len(ids), err)
+	}
+
+	if len(deleted) == 0 {
+		// Nothing changed in the zone, e.g. a concurrent CleanUp already
+		// removed the record: a refresh would only use up the rate limit.
+		klog.V(2).Infof("No TXT record %s to delete for %s in zone %s, cleanup is a no-op", logTarget(target), subDomain, domain)
+		return nil
+	}
+
+	verifyRecordsDeleted(ctx, api, domain, subDomain, deleted)
+	_, err = refreshRecords(ctx, api, domain)
+	return err
 }
 
-func validateZone(ovhClient *ovh.Client, domain string) error {
-	url := "/domain/zone/" + domain + "/status"
-	zoneStatus := ovhZoneStatus{}
-	err := ovhClient.Get(url, &zoneStatus)
+// verifyRecordsDeleted lists the records again after deletion and logs the
+// ones that are still present. OVH may accept a DELETE call and yet keep the
+// record because of an internal error.
+func verifyRecordsDeleted(ctx context.Context, api *ovhAPI, domain, subDomain string, deleted []int64) {
+	ids, err := listRecords(ctx, api, domain, "TXT", subDomain)
 	if err != nil {
-		return fmt.Errorf("OVH API call failed: GET %s - %v", url, err)
+		klog.Warningf("Unable to verify deletion of TXT records for %s in zone %s: %v", subDomain, domain, err)
+		return
+	}
+
+	remaining := []int64{}
+	for _, id := range ids {
+		for _, deletedID := range deleted {
+			if id == deletedID {
+				remaining = append(remaining, id)
+			}
+		}
 	}
-	if !zoneStatus.IsDeployed {
-		return fmt.Errorf("OVH zone not deployed for domain %s", domain)
+	if len(remaining) > 0 {
+		klog.Warningf("TXT records %v for %s in zone %s still exist after deletion", remaining, subDomain, domain)
 	}
+}
 
-	return nil
+// validateZone checks that the zone is deployed. Depending on mode, a zone
+// that is not deployed is an error, a warning, or is not checked at all. In
+// enforce mode, the zone is polled for up to wait, since new zones briefly
+// report that they are not deployed.
+func validateZone(ctx context.Context, api *ovhAPI, domain, mode string, wait time.Duration) error {
+	if mode == zoneCheckSkip {
+		return nil
+	}
+
+	url := "/domain/zone/" + domain + "/status"
+	deadline := time.Now().Add(wait)
+	for {
+		zoneStatus := ovhZoneStatus{}
+		err := api.get(ctx, operationList, url, &zoneStatus)
+		if err != nil {
+			return err
+		}
+		if zoneStatus.IsDeployed {
+			return nil
+		}
+		if mode == zoneCheckWarn {
+			klog.Warningf("OVH zone not deployed for domain %s, proceeding anyway", domain)
+			return nil
+		}
+		if !time.Now().Add(taskPollInterval).Before(deadline) {
+			return fmt.Errorf("OVH zone not deployed for domain %s", domain)
+		}
+		klog.V(2).Infof("OVH zone %s is not deployed yet, waiting", domain)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("OVH zone not deployed for domain %s: %w", domain, ctx.Err())
+		case <-time.After(taskPollInterval):
+		}
+	}
 }
 
-func listRecords(ovhClient *ovh.Client, domain, fieldType, subDomain string) ([]int64, error) {
-	url := "/domain/zone/" + domain + "/record?fieldType=" + fieldType + "&subDomain=" + subDomain
-	ids := []int64{}
-	err := ovhClient.Get(url, &ids)
+// logDNSSECStatus logs whether DNSSEC is enabled for the zone. On such zones,
+// a refresh triggers the re-signing of the zone, which may delay the
+// propagation of the record and cause cert-manager's self check to fail a few
+// more times than usual.
+func logDNSSECStatus(ctx context.Context, api *ovhAPI, domain string) {
+	url := "/domain/zone/" + domain + "/dnssec"
+	dnssec := ovhZoneDNSSEC{}
+	err := api.get(ctx, operationList, url, &dnssec)
 	if err != nil {
-		return nil, fmt.Errorf("OVH API call failed: GET %s - %v", url, err)
+		klog.V(2).Infof("Unable to get DNSSEC status of OVH zone %s: %v", domain, err)
+		return
+	}
+	if dnssec.Status != "disabled" {
+		klog.Infof("DNSSEC status of OVH zone %s is %q: zone re-signing may delay the propagation of the challenge record", domain, dnssec.Status)
 	}
-	return ids, nil
 }
 
-func getRecord(ovhClient *ovh.Client, domain string, id int64) (*ovhZoneRecord, error) {
+func getZone(ctx context.Context, api *ovhAPI, domain string) (*ovhZone, error) {
+	url := "/domain/zone/" + domain
+	zone := ovhZone{}
+	err := api.get(ctx, operationList, url, &zone)
+	if err != nil {
+		return nil, err
+	}
+	return &zone, nil
+}
+
+func listRecords(ctx context.Context, api *ovhAPI, domain, fieldType, subDomain string) ([]int64, error) {
+	url := "/domain/zone/" + domain + "/record?fieldType=" + fieldType + "&subDomain=" + subDomain
+	return api.getIDs(ctx, operationList, url)
+}
+
+func getRecord(ctx context.Context, api *ovhAPI, domain string, id int64) (*ovhZoneRecord, error) {
 	url := "/domain/zone/" + domain + "/record/" + strconv.FormatInt(id, 10)
 	record := ovhZoneRecord{}
-	err := ovhClient.Get(url, &record)
+	err := api.get(ctx, operationList, url, &record)
 	if err != nil {
-		return nil, fmt.Errorf("OVH API call failed: GET %s - %v", url, err)
+		return nil, err
 	}
 	return &record, nil
 }
 
-func deleteRecord(ovhClient *ovh.Client, domain string, id int64) error {
+func deleteRecord(ctx context.Context, api *ovhAPI, domain string, id int64) error {
 	url := "/domain/zone/" + domain + "/record/" + strconv.FormatInt(id, 10)
-	err := ovhClient.Delete(url, nil)
+	err := api.delete(ctx, operationDelete, url)
 	if err != nil {
-		return fmt.Errorf("OVH API call failed: DELETE %s - %v", url, err)
+		return fmt.Errorf("unable to delete record %d in OVH zone %s: %w", id, domain, err)
 	}
 	return nil
 }
 
-func createRecord(ovhClient *ovh.Client, domain, fieldType, subDomain, target string) (*ovhZoneRecord, error) {
+func createRecord(ctx context.Context, api *ovhAPI, domain, fieldType, subDomain, target string, ttl int) (*ovhZoneRecord, error) {
 	url := "/domain/zone/" + domain + "/record"
 	params := ovhZoneRecord{
 		FieldType: fieldType,
 		SubDomain: subDomain,
 		Target:    target,
-		TTL:       60,
+		TTL:       ttl,
 	}
 	record := ovhZoneRecord{}
-	err := ovhClient.Post(url, &params, &record)
+	err := api.post(ctx, operationCreate, url, &params, &record)
 	if err != nil {
-		return nil, fmt.Errorf("OVH API call failed: POST %s - %v", url, err)
+		return nil, err
 	}
 
 	return &record, nil
 }
 
-func refreshRecords(ovhClient *ovh.Client, domain string) error {
+func updateRecord(ctx context.Context, api *ovhAPI, domain string, id int64, target string, ttl int) error {
+	url := "/domain/zone/" + domain + "/record/" + strconv.FormatInt(id, 10)
+	params := struct {
+		Target string `json:"target"`
+		TTL    int    `json:"ttl,omitempty"`
+	}{target, ttl}
+	return api.put(ctx, operationCreate, url, &params, nil)
+}
+
+// refreshRecords deploys the changes made to the zone and returns how. Every
+// outcome but a failure is logged here, so that the refreshes of Present and
+// CleanUp can be audited from the logs; a failure is returned to the caller,
+// which either fails or logs that it tolerates it.
+func refreshRecords(ctx context.Context, api *ovhAPI, domain string) (refreshOutcome, error) {
+	if auto, _ := api.autoRefresh.lookup(domain); auto {
+		klog.V(2).Infof("Refresh of OVH zone %s %s: the zone deploys changes by itself", domain, refreshNotNeeded)
+		return refreshNotNeeded, nil
+	}
+	coalesced, err := refreshZone(ctx, api, domain)
+	if err != nil && api.refreshFailure == refreshFailureTolerate && !isContextError(err) {
+		// The retry of each challenge of the burst joins the same refresh.
+		klog.Warningf("Refresh of OVH zone %s %s, retrying once: %v", domain, refreshFailed, err)
+		coalesced, err = refreshZone(ctx, api, domain)
+		if err != nil && !isContextError(err) {
+			klog.Warningf("Refresh of OVH zone %s %s again, ignoring as refreshFailure is %s: the record is only published once the zone is refreshed by a later change or by OVH: %v", domain, refreshFailed, refreshFailureTolerate, err)
+			return refreshFailed, nil
+		}
+	}
+	outcome := refreshPerformed
+	switch {
+	case err != nil:
+		return refreshFailed, err
+	case coalesced:
+		outcome = refreshCoalesced
+	}
+	klog.V(2).Infof("Refresh of OVH zone %s %s", domain, outcome)
+	return outcome, nil
+}
+
+// refreshZone requests a refresh of the zone, coalesced with the refreshes
+// requested within the refresh window, and returns whether it was coalesced.
+func refreshZone(ctx context.Context, api *ovhAPI, domain string) (bool, error) {
 	url := "/domain/zone/" + domain + "/refresh"
-	err := ovhClient.Post(url, nil, nil)
-	if err != nil {
-		return fmt.Errorf("OVH API call failed: POST %s - %v", url, err)
+	key := api.account() + "\n" + normalizeName(domain)
+	return api.refreshes.refresh(ctx, key, api.refreshWindow, func(ctx context.Context) error {
+		api.refreshes.noteRefresh(domain)
+		if !api.verifySerial {
+			return api.post(ctx, operationRefresh, url, nil, nil)
+		}
+		serial, serialErr := getZoneSerial(ctx, api, domain)
+		err := api.post(ctx, operationRefresh, url, nil, nil)
+		if err == nil && serialErr == nil {
+			waitForZoneSerial(ctx, api, domain, serial)
+		} else if serialErr != nil {
+			klog.Warningf("Unable to verify the refresh of OVH zone %s, the serial of the zone could not be fetched: %v", domain, serialErr)
+		}
+		return err
+	})
+}
+
+// waitForTasks polls the tasks of the zone until none of them is pending,
+// which means that the last changes have been deployed on the OVH name
+// servers.
+func waitForTasks(ctx context.Context, api *ovhAPI, domain string) error {
+	timeout := api.timeouts[operationTaskWait]
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	pending := 0
+	for {
+		count := 0
+		for _, status := range []string{"todo", "doing"} {
+			ids, err := listTasks(ctx, api, domain, status)
+			if err != nil && ctx.Err() == context.DeadlineExceeded && pending > 0 {
+				// The timeout expired during the check.
+				return fmt.Errorf("OVH zone %s still has %d pending tasks after %v", domain, pending, timeout)
+			}
+			if err != nil {
+				return err
+			}
+			count += len(ids)
+		}
+		pending = count
+		if pending == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("OVH zone %s still has %d pending tasks after %v", domain, pending, timeout)
+		case <-time.After(taskPollInterval):
+		}
 	}
+}
 
-	return nil
+func listTasks(ctx context.Context, api *ovhAPI, domain, status string) ([]int64, error) {
+	url := "/domain/zone/" + domain + "/task?status=" + status
+	return api.getIDs(ctx, operationList, url)
 }
@@ -1,10 +1,25 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	extapi "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+
+	"github.com/cert-manager/cert-manager/pkg/acme/webhook/apis/acme/v1alpha1"
 	dns "github.com/cert-manager/cert-manager/test/acme"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 var (
@@ -29,3 +44,1241 @@ func TestRunsSuite(t *testing.T) {
 	fixture.RunExtended(t)
 
 }
+
+func TestRemoveTXTRecordRetriesLockedZone(t *testing.T) {
+	shortenRetryDelay(t, time.Millisecond)
+	f := newFakeOVH(t, "example.com")
+	id := f.addRecord("example.com", ovhZoneRecord{FieldType: "TXT", SubDomain: "_acme-challenge", Target: "key"})
+	f.fail("DELETE /domain/zone/example.com/record/"+strconv.FormatInt(id, 10), http.StatusConflict)
+
+	err := removeTXTRecord(context.Background(), f.api(), &ovhDNSProviderConfig{}, "example.com", "_acme-challenge", "key", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if records := f.zoneRecords("example.com"); len(records) != 0 {
+		t.Errorf("records not deleted: %v", records)
+	}
+}
+
+func TestRetryBudgetIsShared(t *testing.T) {
+	shortenRetryDelay(t, time.Millisecond)
+	f := newFakeOVH(t, "example.com")
+	first := f.addRecord("example.com", ovhZoneRecord{FieldType: "TXT", SubDomain: "_acme-challenge", Target: "key"})
+	second := f.addRecord("example.com", ovhZoneRecord{FieldType: "TXT", SubDomain: "_acme-challenge", Target: "key"})
+	f.fail("DELETE /domain/zone/example.com/record/"+strconv.FormatInt(first, 10), http.StatusConflict)
+	f.fail("DELETE /domain/zone/example.com/record/"+strconv.FormatInt(second, 10), http.StatusConflict)
+
+	api := f.api()
+	api.retries = newRetryBudget(1)
+	err := removeTXTRecord(context.Background(), api, &ovhDNSProviderConfig{}, "example.com", "_acme-challenge", "key", nil)
+	if !isAPIError(err, http.StatusConflict) {
+		t.Fatalf("expected the conflict once the budget is spent, got %v", err)
+	}
+	if records := f.zoneRecords("example.com"); len(records) != 1 || records[0].Id != second {
+		t.Errorf("unexpected records: %v", records)
+	}
+}
+
+func TestRemoveTXTRecordReportsRecordID(t *testing.T) {
+	f := newFakeOVH(t, "example.com")
+	id := f.addRecord("example.com", ovhZoneRecord{FieldType: "TXT", SubDomain: "_acme-challenge", Target: "key"})
+	f.fail("DELETE /domain/zone/example.com/record/"+strconv.FormatInt(id, 10), http.StatusForbidden)
+
+	err := removeTXTRecord(context.Background(), f.api(), &ovhDNSProviderConfig{}, "example.com", "_acme-challenge", "key", nil)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if !strings.Contains(err.Error(), "record "+strconv.FormatInt(id, 10)+" in OVH zone example.com") {
+		t.Errorf("error does not identify the record: %v", err)
+	}
+}
+
+func TestAddTXTRecordIsIdempotent(t *testing.T) {
+	f := newFakeOVH(t, "example.com")
+	cfg := ovhDNSProviderConfig{ZoneCheck: zoneCheckEnforce}
+	for i := 0; i < 2; i++ {
+		_, err := addTXTRecord(context.Background(), f.api(), &cfg, "example.com", "_acme-challenge", "key", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if records := f.zoneRecords("example.com"); len(records) != 1 {
+		t.Errorf("expected a single record, got %v", records)
+	}
+	if n := f.countCalls("POST /domain/zone/example.com/refresh"); n != 2 {
+		t.Errorf("expected 2 refreshes, got %d", n)
+	}
+}
+
+func TestAddTXTRecordWaitsForZoneDeployment(t *testing.T) {
+	shortenTaskPollInterval(t)
+	f := newFakeOVH(t, "example.com")
+	f.undeployed["example.com"] = 1
+
+	cfg := ovhDNSProviderConfig{ZoneCheck: zoneCheckEnforce}
+	if _, err := addTXTRecord(context.Background(), f.api(), &cfg, "example.com", "_acme-challenge", "key", nil); err == nil {
+		t.Fatal("expected an error for a zone not deployed")
+	}
+
+	f.undeployed["example.com"] = 1
+	cfg.ZoneDeployTimeout = &metav1.Duration{Duration: time.Minute}
+	if _, err := addTXTRecord(context.Background(), f.api(), &cfg, "example.com", "_acme-challenge", "key", nil); err != nil {
+		t.Fatal(err)
+	}
+	if n := f.countCalls("GET /domain/zone/example.com/status"); n != 3 {
+		t.Errorf("expected 3 status calls, got %d", n)
+	}
+}
+
+func TestAddTXTRecordSettleDelay(t *testing.T) {
+	f := newFakeOVH(t, "example.com")
+	cfg := ovhDNSProviderConfig{ZoneCheck: zoneCheckEnforce, SettleDelay: &metav1.Duration{Duration: 20 * time.Millisecond}}
+	start := time.Now()
+	if _, err := addTXTRecord(context.Background(), f.api(), &cfg, "example.com", "_acme-challenge", "key", nil); err != nil {
+		t.Fatal(err)
+	}
+	// The delay applies after the creation and after the refresh.
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Errorf("expected two settle delays, returned after %v", elapsed)
+	}
+
+	// The delay is interrupted with the challenge, before the refresh.
+	cfg.SettleDelay.Duration = time.Minute
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := addTXTRecord(ctx, f.api(), &cfg, "example.com", "_acme-challenge", "other", nil)
+	if err == nil || !strings.Contains(err.Error(), "settle delay after the creation") {
+		t.Errorf("expected the settle delay to be interrupted, got %v", err)
+	}
+	if n := f.countCalls("POST /domain/zone/example.com/refresh"); n != 1 {
+		t.Errorf("expected a single refresh, got %d", n)
+	}
+
+	if _, err := loadConfig(&extapi.JSON{Raw: []byte(`{"settleDelay": "-1s"}`)}); err == nil {
+		t.Error("expected an error for a negative settle delay")
+	}
+}
+
+func TestAddTXTRecordUpsert(t *testing.T) {
+	f := newFakeOVH(t, "example.com")
+	manual := f.addRecord("example.com", ovhZoneRecord{FieldType: "TXT", SubDomain: "_acme-challenge", Target: "manual"})
+	leftover := f.addRecord("example.com", ovhZoneRecord{FieldType: "TXT", SubDomain: "_acme-challenge", Target: "old"})
+	cfg := ovhDNSProviderConfig{ZoneCheck: zoneCheckEnforce, Upsert: true}
+	ctx := context.Background()
+	records, err := newRecordStore(nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	records.put(ctx, "old", leftover)
+	records.release(ctx, "old", true)
+	claim := func(key string) func(ctx context.Context, ids []int64) (int64, error) {
+		return func(ctx context.Context, ids []int64) (int64, error) {
+			return records.claim(ctx, key, ids)
+		}
+	}
+
+	id, err := addTXTRecord(ctx, f.api(), &cfg, "example.com", "_acme-challenge", "key", claim("key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != leftover {
+		t.Errorf("got record %d, expected the leftover record %d to be replaced", id, leftover)
+	}
+
+	// The leftover record is taken and the other record was not created by
+	// the webhook: a new record is created for the next target.
+	id, err = addTXTRecord(ctx, f.api(), &cfg, "example.com", "_acme-challenge", "wildcard", claim("wildcard"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id == leftover || id == manual {
+		t.Errorf("record %d was replaced", id)
+	}
+
+	targets := map[string]bool{}
+	for _, record := range f.zoneRecords("example.com") {
+		targets[record.Target] = true
+	}
+	if len(targets) != 3 || !targets["key"] || !targets["manual"] || !targets["wildcard"] {
+		t.Errorf("unexpected targets %v", targets)
+	}
+}
+
+func TestAddTXTRecordConcurrentUpserts(t *testing.T) {
+	f := newFakeOVH(t, "example.com")
+	leftover := f.addRecord("example.com", ovhZoneRecord{FieldType: "TXT", SubDomain: "_acme-challenge", Target: "old"})
+	cfg := ovhDNSProviderConfig{ZoneCheck: zoneCheckEnforce, Upsert: true}
+	ctx := context.Background()
+	records, err := newRecordStore(nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	records.put(ctx, "old", leftover)
+	records.release(ctx, "old", true)
+
+	// A wildcard and its apex are presented at the same time.
+	var wg sync.WaitGroup
+	for _, target := range []string{"apex", "wildcard"} {
+		wg.Add(1)
+		go func(target string) {
+			defer wg.Done()
+			claim := func(ctx context.Context, ids []int64) (int64, error) {
+				return records.claim(ctx, target, ids)
+			}
+			if _, err := addTXTRecord(ctx, f.api(), &cfg, "example.com", "_acme-challenge", target, claim); err != nil {
+				t.Error(err)
+			}
+		}(target)
+	}
+	wg.Wait()
+
+	targets := map[string]bool{}
+	for _, record := range f.zoneRecords("example.com") {
+		targets[record.Target] = true
+	}
+	if len(targets) != 2 || !targets["apex"] || !targets["wildcard"] {
+		t.Errorf("unexpected targets %v", targets)
+	}
+}
+
+func TestAddTXTRecordUpsertRefusedWithoutStore(t *testing.T) {
+	f := newFakeOVH(t, "example.com")
+	f.addRecord("example.com", ovhZoneRecord{FieldType: "TXT", SubDomain: "_acme-challenge", Target: "old"})
+	cfg := ovhDNSProviderConfig{ZoneCheck: zoneCheckEnforce, Upsert: true}
+	claim := func(ctx context.Context, ids []int64) (int64, error) {
+		return 0, errors.New("store unavailable")
+	}
+
+	if _, err := addTXTRecord(context.Background(), f.api(), &cfg, "example.com", "_acme-challenge", "key", claim); err == nil {
+		t.Error("expected the upsert to fail when the record store is unavailable")
+	}
+	if records := f.zoneRecords("example.com"); len(records) != 1 || records[0].Target != "old" {
+		t.Errorf("unexpected records %v", records)
+	}
+}
+
+func TestAddTXTRecordWarnsUnmanagedRecords(t *testing.T) {
+	f := newFakeOVH(t, "example.com")
+	manual := f.addRecord("example.com", ovhZoneRecord{FieldType: "TXT", SubDomain: "_acme-challenge", Target: "manual"})
+	running := f.addRecord("example.com", ovhZoneRecord{FieldType: "TXT", SubDomain: "_acme-challenge", Target: "wildcard"})
+	cfg := ovhDNSProviderConfig{ZoneCheck: zoneCheckEnforce}
+	ctx := context.Background()
+	records, err := newRecordStore(nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	records.put(ctx, "wildcard", running)
+	api := f.api()
+	api.records = records
+
+	logs := captureLogs(t)
+	id, err := addTXTRecord(ctx, api, &cfg, "example.com", "_acme-challenge", "key", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(logs.String(), fmt.Sprintf("TXT record %d ", manual)) {
+		t.Errorf("expected a warning about the manual record, got %q", logs.String())
+	}
+	if strings.Contains(logs.String(), fmt.Sprintf("TXT record %d ", running)) {
+		t.Errorf("unexpected warning about the record of a running challenge: %q", logs.String())
+	}
+
+	if err := removeTXTRecord(ctx, api, &cfg, "example.com", "_acme-challenge", "key", []int64{id}); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(f.zoneRecords("example.com")); n != 2 {
+		t.Errorf("expected the manual and running records to be kept, got %d records", n)
+	}
+}
+
+func TestAddTXTRecordRecordLimit(t *testing.T) {
+	f := newFakeOVH(t, "example.com")
+	f.maxRecords["example.com"] = 2
+	f.addRecord("example.com", ovhZoneRecord{FieldType: "TXT", SubDomain: "", Target: "v=spf1 -all"})
+	leftover := f.addRecord("example.com", ovhZoneRecord{FieldType: "TXT", SubDomain: "_acme-challenge.www", Target: "old"})
+	ctx := context.Background()
+	records, err := newRecordStore(nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	records.put(ctx, "old", leftover)
+	records.release(ctx, "old", true)
+	api := f.api()
+	api.records = records
+
+	cfg := ovhDNSProviderConfig{ZoneCheck: zoneCheckEnforce}
+	_, err = addTXTRecord(ctx, api, &cfg, "example.com", "_acme-challenge", "key", nil)
+	if err == nil || !strings.Contains(err.Error(), "maximum number of records") || !isRecordLimitReached(err) {
+		t.Errorf("expected the record limit error, got %v", err)
+	}
+	if errorClass(err) != errorClassAPI {
+		t.Errorf("expected the record limit not to be an auth error, got class %q", errorClass(err))
+	}
+	if n := testutil.ToFloat64(recordLimitsReached.WithLabelValues("example.com")); n != 1 {
+		t.Errorf("expected 1 record limit reached, got %v", n)
+	}
+
+	// The leftover record is swept to make room for the challenge record.
+	cfg.SweepOnRecordLimit = true
+	if _, err := addTXTRecord(ctx, api, &cfg, "example.com", "_acme-challenge", "key", nil); err != nil {
+		t.Fatal(err)
+	}
+	targets := map[string]bool{}
+	for _, record := range f.zoneRecords("example.com") {
+		targets[record.Target] = true
+	}
+	if len(targets) != 2 || !targets["v=spf1 -all"] || !targets["key"] {
+		t.Errorf("expected only the leftover record to be swept, got %v", targets)
+	}
+}
+
+func TestSweepLeftoverRecordsFailure(t *testing.T) {
+	f := newFakeOVH(t, "sweep.example.com")
+	ctx := context.Background()
+	records, err := newRecordStore(nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := []int64{}
+	for _, target := range []string{"gone", "swept", "failed", "kept"} {
+		id := f.addRecord("sweep.example.com", ovhZoneRecord{FieldType: "TXT", SubDomain: "_acme-challenge", Target: target})
+		records.put(ctx, target, id)
+		records.release(ctx, target, true)
+		ids = append(ids, id)
+	}
+	f.fail(fmt.Sprintf("DELETE /domain/zone/sweep.example.com/record/%d", ids[0]), http.StatusNotFound)
+	f.fail(fmt.Sprintf("DELETE /domain/zone/sweep.example.com/record/%d", ids[2]), http.StatusInternalServerError)
+	api := f.api()
+	api.records = records
+
+	swept, err := sweepLeftoverRecords(ctx, api, "sweep.example.com")
+	if err == nil {
+		t.Error("expected the failed deletion to be reported")
+	}
+	if swept != 1 {
+		t.Errorf("expected only the deleted record to be counted, got %d", swept)
+	}
+	for i, leftover := range []bool{false, false, true, true} {
+		if _, ok := records.leftovers[ids[i]]; ok != leftover {
+			t.Errorf("expected record %d to be a leftover: %v, got %v", ids[i], leftover, ok)
+		}
+	}
+
+	// The next sweep deletes the records put back.
+	if swept, err := sweepLeftoverRecords(ctx, api, "sweep.example.com"); err != nil || swept != 2 {
+		t.Errorf("expected the 2 remaining leftover records to be swept, got %d, %v", swept, err)
+	}
+	if n := testutil.ToFloat64(leftoverRecordsDetected.WithLabelValues("sweep.example.com")); n != 6 {
+		t.Errorf("expected 6 leftover records detected across the sweeps, got %v", n)
+	}
+	if n := testutil.ToFloat64(leftoverRecordsSwept.WithLabelValues("sweep.example.com")); n != 3 {
+		t.Errorf("expected 3 leftover records swept, got %v", n)
+	}
+	if n := testutil.ToFloat64(leftoverSweepFailures.WithLabelValues("sweep.example.com")); n != 1 {
+		t.Errorf("expected 1 failed sweep, got %v", n)
+	}
+	if n := testutil.ToFloat64(leftoverRecords); n != 0 {
+		t.Errorf("expected no leftover record left, got %v", n)
+	}
+}
+
+func TestReconcileTXTRecords(t *testing.T) {
+	f := newFakeOVH(t, "example.com")
+	manual := f.addRecord("example.com", ovhZoneRecord{FieldType: "TXT", SubDomain: "_acme-challenge", Target: "manual"})
+	stale := f.addRecord("example.com", ovhZoneRecord{FieldType: "TXT", SubDomain: "_acme-challenge", Target: "old"})
+	current := f.addRecord("example.com", ovhZoneRecord{FieldType: "TXT", SubDomain: "_acme-challenge", Target: "key"})
+	running := f.addRecord("example.com", ovhZoneRecord{FieldType: "TXT", SubDomain: "_acme-challenge", Target: "wildcard"})
+	cfg := ovhDNSProviderConfig{ZoneCheck: zoneCheckEnforce, Reconcile: true}
+	ctx := context.Background()
+	records, err := newRecordStore(nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, id := range map[string]int64{"old": stale, "key": current, "wildcard": running} {
+		records.put(ctx, key, id)
+	}
+	records.release(ctx, "old", true)
+	records.release(ctx, "key", true)
+
+	if err := reconcileTXTRecords(ctx, f.api(), &cfg, "example.com", "_acme-challenge", "key", records.takeLeftovers); err != nil {
+		t.Fatal(err)
+	}
+	id, err := addTXTRecord(ctx, f.api(), &cfg, "example.com", "_acme-challenge", "key", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != current {
+		t.Errorf("got record %d, expected the leftover record %d with the current key", id, current)
+	}
+	ids := map[int64]bool{}
+	for _, record := range f.zoneRecords("example.com") {
+		ids[record.Id] = true
+	}
+	if len(ids) != 3 || !ids[manual] || !ids[current] || !ids[running] {
+		t.Errorf("expected only the stale record %d to be deleted, got %v", stale, ids)
+	}
+	if n := f.countCalls("POST /domain/zone/example.com/refresh"); n != 1 {
+		t.Errorf("expected 1 refresh, got %d", n)
+	}
+}
+
+func TestMixedCaseFQDN(t *testing.T) {
+	f := newFakeOVH(t, "example.com")
+	s := &ovhDNSProviderSolver{}
+	cfg := ovhDNSProviderConfig{ZoneCheck: zoneCheckEnforce}
+
+	present, err := s.newChallenge(&v1alpha1.ChallengeRequest{ResolvedZone: "example.com.", ResolvedFQDN: "_acme-challenge.WWW.Example.COM.", Key: "key"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if present.subDomain != "_acme-challenge.www" {
+		t.Errorf("unexpected subdomain %q", present.subDomain)
+	}
+	if _, err := addTXTRecord(context.Background(), f.api(), &cfg, present.domain, present.subDomain, present.target, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	cleanUp, err := s.newChallenge(&v1alpha1.ChallengeRequest{ResolvedZone: "example.com.", ResolvedFQDN: "_acme-challenge.www.example.com.", Key: "key"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := removeTXTRecord(context.Background(), f.api(), &cfg, cleanUp.domain, cleanUp.subDomain, cleanUp.target, nil); err != nil {
+		t.Fatal(err)
+	}
+	if records := f.zoneRecords("example.com"); len(records) != 0 {
+		t.Errorf("records left after cleanup: %v", records)
+	}
+}
+
+func TestGetSubDomain(t *testing.T) {
+	for _, tc := range []struct{ domain, fqdn, expected string }{
+		{"example.com", "example.com.", ""},
+		{"example.com", "_acme-challenge.example.com.", "_acme-challenge"},
+		{"example.com", "_acme-challenge.foo.example.com.", "_acme-challenge.foo"},
+		{"example.com", "_acme-challenge.foo.bar.example.com.", "_acme-challenge.foo.bar"},
+		{"example.com", "_acme-challenge.foo.bar.baz.example.com.", "_acme-challenge.foo.bar.baz"},
+		{"dev.example.com", "_acme-challenge.foo.bar.dev.example.com.", "_acme-challenge.foo.bar"},
+		{"example.com", "_acme-challenge.Foo.Bar.Example.COM.", "_acme-challenge.foo.bar"},
+		// The stray dots of a zone or name joined with an extra dot.
+		{".example.com.", "_acme-challenge.example.com.", "_acme-challenge"},
+		{"example.com", "_acme-challenge..example.com.", "_acme-challenge"},
+		{"example.com.", "_acme-challenge.www..example.com", "_acme-challenge.www"},
+		// A label ending like the zone is not the zone.
+		{"example.com", "_acme-challenge.myexample.com.", "_acme-challenge.myexample.com"},
+	} {
+		if subDomain := getSubDomain(tc.domain, tc.fqdn); subDomain != tc.expected {
+			t.Errorf("getSubDomain(%q, %q) = %q, expected %q", tc.domain, tc.fqdn, subDomain, tc.expected)
+		}
+	}
+}
+
+func TestCredentialValue(t *testing.T) {
+	tests := map[string]string{
+		"secret":         "secret",
+		"secret\n":       "secret",
+		"secret \r\n":    "secret",
+		" secret":        " secret",
+		"c2VjcmV0Cg==\n": "c2VjcmV0Cg==",
+		"c2VjcmV0\n":     "c2VjcmV0",
+	}
+	for value, expected := range tests {
+		if actual := credentialValue(value, "test"); actual != expected {
+			t.Errorf("credentialValue(%q) = %q, expected %q", value, actual, expected)
+		}
+	}
+
+	logs := captureLogs(t)
+	// "c2VjcmV0Cg==" decodes to "secret\n", which is not a valid credential.
+	for _, value := range []string{"secret", "c2VjcmV0Cg=="} {
+		credentialValue(value, "test")
+		if strings.Contains(logs.String(), "base64") {
+			t.Errorf("unexpected warning for %q: %s", value, logs)
+		}
+	}
+	// "c2VjcmV0" decodes to "secret".
+	credentialValue("c2VjcmV0", "test")
+	if !strings.Contains(logs.String(), "Value of test looks base64-encoded twice") {
+		t.Errorf("expected a warning for a value encoded twice: %s", logs)
+	}
+}
+
+func TestRemoveTXTRecordDeletesInOrder(t *testing.T) {
+	f := newFakeOVH(t, "example.com")
+	for i := 0; i < 3; i++ {
+		f.addRecord("example.com", ovhZoneRecord{FieldType: "TXT", SubDomain: "_acme-challenge", Target: "key"})
+	}
+	f.fail("DELETE /domain/zone/example.com/record/2", http.StatusForbidden)
+
+	err := removeTXTRecord(context.Background(), f.api(), &ovhDNSProviderConfig{}, "example.com", "_acme-challenge", "key", nil)
+	if err == nil || !strings.Contains(err.Error(), "after 1 of 3 records") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if n := f.countCalls("DELETE /domain/zone/example.com/record/3"); n != 0 {
+		t.Errorf("record 3 deleted after the failure")
+	}
+	if n := f.countCalls("POST /domain/zone/example.com/refresh"); n != 1 {
+		t.Errorf("partial cleanup not refreshed")
+	}
+
+	err = removeTXTRecord(context.Background(), f.api(), &ovhDNSProviderConfig{}, "example.com", "_acme-challenge", "key", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if records := f.zoneRecords("example.com"); len(records) != 0 {
+		t.Errorf("records not deleted: %v", records)
+	}
+}
+
+func TestRemoveTXTRecordDeletionLimit(t *testing.T) {
+	f := newFakeOVH(t, "example.com")
+	for i := 0; i < 5; i++ {
+		f.addRecord("example.com", ovhZoneRecord{FieldType: "TXT", SubDomain: "_acme-challenge", Target: "key"})
+	}
+	logs := captureLogs(t)
+	max := 2
+	cfg := ovhDNSProviderConfig{MaxCleanupDeletions: &max}
+
+	if err := removeTXTRecord(context.Background(), f.api(), &cfg, "example.com", "_acme-challenge", "key", nil); err != nil {
+		t.Fatal(err)
+	}
+	if n := f.countCalls("DELETE "); n != 2 {
+		t.Errorf("expected 2 deletions, got %d", n)
+	}
+	if records := f.zoneRecords("example.com"); len(records) != 3 {
+		t.Errorf("expected the 3 other records to be left, got %v", records)
+	}
+	if !strings.Contains(logs.String(), "CLEANUP LIMIT REACHED") || !strings.Contains(logs.String(), "[3 4 5]") {
+		t.Errorf("expected a warning listing the records left, got %q", logs.String())
+	}
+
+	max = 0
+	if err := removeTXTRecord(context.Background(), f.api(), &cfg, "example.com", "_acme-challenge", "key", nil); err != nil {
+		t.Fatal(err)
+	}
+	if records := f.zoneRecords("example.com"); len(records) != 0 {
+		t.Errorf("expected all the records to be deleted without a limit, got %v", records)
+	}
+}
+
+func TestRemoveTXTRecordWithKnownIDs(t *testing.T) {
+	f := newFakeOVH(t, "example.com")
+	created := f.addRecord("example.com", ovhZoneRecord{FieldType: "TXT", SubDomain: "_acme-challenge", Target: "key"})
+	other := f.addRecord("example.com", ovhZoneRecord{FieldType: "TXT", SubDomain: "_acme-challenge", Target: "key"})
+
+	err := removeTXTRecord(context.Background(), f.api(), &ovhDNSProviderConfig{}, "example.com", "_acme-challenge", "key", []int64{created})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := f.countCalls("GET /domain/zone/example.com/record/"); n != 1 {
+		t.Errorf("expected a single record lookup, got %d", n)
+	}
+	records := f.zoneRecords("example.com")
+	if len(records) != 1 || records[0].Id != other {
+		t.Errorf("unexpected remaining records: %v", records)
+	}
+
+	// An ID that does not identify the challenge record anymore falls back to
+	// matching the records of the subdomain.
+	f.addRecord("example.com", ovhZoneRecord{FieldType: "TXT", SubDomain: "_acme-challenge", Target: "other"})
+	err = removeTXTRecord(context.Background(), f.api(), &ovhDNSProviderConfig{}, "example.com", "_acme-challenge", "key", []int64{other + 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	records = f.zoneRecords("example.com")
+	if len(records) != 1 || records[0].Target != "other" {
+		t.Errorf("unexpected remaining records: %v", records)
+	}
+}
+
+func TestTargetMatches(t *testing.T) {
+	normalized := ovhDNSProviderConfig{}
+	verbatim := ovhDNSProviderConfig{VerbatimTarget: true}
+	tests := []struct {
+		stored            string
+		normalizedMatches bool
+		verbatimMatches   bool
+	}{
+		{"key", true, true},
+		{`"key"`, true, false},
+		{"key.", true, false},
+		{` "key." `, true, false},
+		{"other", false, false},
+		{`"`, false, false},
+	}
+	for _, tt := range tests {
+		if actual := normalized.targetMatches(tt.stored, "key"); actual != tt.normalizedMatches {
+			t.Errorf("normalized targetMatches(%q) = %v", tt.stored, actual)
+		}
+		if actual := verbatim.targetMatches(tt.stored, "key"); actual != tt.verbatimMatches {
+			t.Errorf("verbatim targetMatches(%q) = %v", tt.stored, actual)
+		}
+	}
+}
+
+func TestRemoveTXTRecordWithQuotedTarget(t *testing.T) {
+	f := newFakeOVH(t, "example.com")
+	f.addRecord("example.com", ovhZoneRecord{FieldType: "TXT", SubDomain: "_acme-challenge", Target: `"key"`})
+
+	err := removeTXTRecord(context.Background(), f.api(), &ovhDNSProviderConfig{VerbatimTarget: true}, "example.com", "_acme-challenge", "key", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if records := f.zoneRecords("example.com"); len(records) != 1 {
+		t.Errorf("verbatim cleanup should keep the quoted record: %v", records)
+	}
+
+	err = removeTXTRecord(context.Background(), f.api(), &ovhDNSProviderConfig{}, "example.com", "_acme-challenge", "key", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if records := f.zoneRecords("example.com"); len(records) != 0 {
+		t.Errorf("normalized cleanup should delete the quoted record: %v", records)
+	}
+}
+
+func TestRemoveTXTRecordRefresh(t *testing.T) {
+	const refresh = "POST /domain/zone/example.com/refresh"
+
+	t.Run("matches", func(t *testing.T) {
+		f := newFakeOVH(t, "example.com")
+		f.addRecord("example.com", ovhZoneRecord{FieldType: "TXT", SubDomain: "_acme-challenge", Target: "key"})
+		f.addRecord("example.com", ovhZoneRecord{FieldType: "TXT", SubDomain: "_acme-challenge", Target: "other"})
+		err := removeTXTRecord(context.Background(), f.api(), &ovhDNSProviderConfig{}, "example.com", "_acme-challenge", "key", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if records := f.zoneRecords("example.com"); len(records) != 1 || records[0].Target != "other" {
+			t.Errorf("unexpected records after cleanup: %v", records)
+		}
+		if n := f.countCalls(refresh); n != 1 {
+			t.Errorf("expected 1 refresh, got %d", n)
+		}
+	})
+
+	t.Run("no matches", func(t *testing.T) {
+		f := newFakeOVH(t, "example.com")
+		f.addRecord("example.com", ovhZoneRecord{FieldType: "TXT", SubDomain: "_acme-challenge", Target: "other"})
+		err := removeTXTRecord(context.Background(), f.api(), &ovhDNSProviderConfig{}, "example.com", "_acme-challenge", "key", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := f.countCalls("DELETE "); n != 0 {
+			t.Errorf("expected no deletion, got %d", n)
+		}
+		if n := f.countCalls(refresh); n != 0 {
+			t.Errorf("expected no refresh, got %d", n)
+		}
+	})
+
+	t.Run("listing error", func(t *testing.T) {
+		f := newFakeOVH(t, "example.com")
+		f.addRecord("example.com", ovhZoneRecord{FieldType: "TXT", SubDomain: "_acme-challenge", Target: "key"})
+		f.fail("GET /domain/zone/example.com/record", http.StatusInternalServerError)
+		err := removeTXTRecord(context.Background(), f.api(), &ovhDNSProviderConfig{}, "example.com", "_acme-challenge", "key", nil)
+		if err == nil {
+			t.Fatal("expected the listing error")
+		}
+		if n := f.countCalls(refresh); n != 0 {
+			t.Errorf("expected no refresh, got %d", n)
+		}
+		if records := f.zoneRecords("example.com"); len(records) != 1 {
+			t.Errorf("unexpected records after failed cleanup: %v", records)
+		}
+	})
+}
+
+func TestCleanUpIgnoreErrors(t *testing.T) {
+	f := newFakeOVH(t, "example.com")
+	f.fail("GET /domain/zone/example.com/record", http.StatusForbidden, http.StatusForbidden)
+
+	for _, ignore := range []bool{false, true} {
+		for name, sources := range map[string][]credentialSource{
+			// The credentials fail to load.
+			"credentials": {staticCredentials{err: errors.New("unavailable")}},
+			// The record lookup fails.
+			"record": {staticCredentials{creds: ovhCredentials{endpoint: f.server.URL, applicationKey: "key", applicationSecret: "secret", consumerKey: "consumer"}}},
+		} {
+			s := &ovhDNSProviderSolver{credentialSources: sources}
+			cfg := `{"ignoreCleanupErrors": ` + strconv.FormatBool(ignore) + `}`
+			ch := &v1alpha1.ChallengeRequest{
+				ResolvedZone:            "example.com.",
+				ResolvedFQDN:            "_acme-challenge.example.com.",
+				Key:                     "key",
+				AllowAmbientCredentials: true,
+				Config:                  &extapi.JSON{Raw: []byte(cfg)},
+			}
+			err := s.CleanUp(ch)
+			if ignore && err != nil {
+				t.Errorf("%s: expected the error to be ignored, got %v", name, err)
+			}
+			if !ignore && err == nil {
+				t.Errorf("%s: expected the cleanup error", name)
+			}
+		}
+	}
+}
+
+// shortenTaskPollInterval speeds up the polling of the zone tasks and status
+// for the duration of the test.
+func shortenTaskPollInterval(t *testing.T) {
+	interval := taskPollInterval
+	taskPollInterval = time.Millisecond
+	t.Cleanup(func() { taskPollInterval = interval })
+}
+
+// captureLogs redirects the logs to the returned buffer for the duration of
+// the test.
+func captureLogs(t *testing.T) *bytes.Buffer {
+	buf := &bytes.Buffer{}
+	klog.LogToStderr(false)
+	klog.SetOutput(buf)
+	t.Cleanup(func() {
+		klog.SetOutput(os.Stderr)
+		klog.LogToStderr(true)
+	})
+	return buf
+}
+
+func TestWaitForTasks(t *testing.T) {
+	shortenTaskPollInterval(t)
+	f := newFakeOVH(t, "example.com")
+
+	f.pendingTasks["example.com"] = 3
+	if err := waitForTasks(context.Background(), f.api(), "example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if n := f.pendingTasks["example.com"]; n != 0 {
+		t.Errorf("returned with %d pending task calls left", n)
+	}
+
+	f.pendingTasks["example.com"] = 1 << 30
+	api := f.api()
+	api.timeouts[operationTaskWait] = 20 * time.Millisecond
+	err := waitForTasks(context.Background(), api, "example.com")
+	if err == nil || !strings.Contains(err.Error(), "pending tasks") {
+		t.Errorf("expected the pending tasks error, got %v", err)
+	}
+}
+
+func TestLogDNSSECStatus(t *testing.T) {
+	f := newFakeOVH(t, "example.com", "signed.example.com")
+	f.dnssec["signed.example.com"] = "enabled"
+	logs := captureLogs(t)
+
+	logDNSSECStatus(context.Background(), f.api(), "example.com")
+	if logs.Len() != 0 {
+		t.Errorf("unexpected log for a zone without DNSSEC: %s", logs)
+	}
+	logDNSSECStatus(context.Background(), f.api(), "signed.example.com")
+	if !strings.Contains(logs.String(), `DNSSEC status of OVH zone signed.example.com is "enabled"`) {
+		t.Errorf("DNSSEC status not logged: %s", logs)
+	}
+}
+
+func TestVerifyRecordTTL(t *testing.T) {
+	f := newFakeOVH(t, "example.com", "clamped.example.com")
+	f.minTTL["clamped.example.com"] = 300
+	ttl := 60
+	cfg := ovhDNSProviderConfig{ZoneCheck: zoneCheckEnforce, TTL: &ttl, VerifyTTL: true}
+
+	for _, zone := range []string{"example.com", "clamped.example.com"} {
+		if _, err := addTXTRecord(context.Background(), f.api(), &cfg, zone, "_acme-challenge", "key", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := testutil.ToFloat64(ttlMismatches.WithLabelValues("example.com")); n != 0 {
+		t.Errorf("unexpected TTL mismatch for a TTL honored by OVH: %v", n)
+	}
+	if n := testutil.ToFloat64(ttlMismatches.WithLabelValues("clamped.example.com")); n != 1 {
+		t.Errorf("expected a TTL mismatch for a clamped TTL, got %v", n)
+	}
+}
+
+func TestAddTXTRecordVerifyListed(t *testing.T) {
+	shortenTaskPollInterval(t)
+	f := newFakeOVH(t, "example.com")
+	// The first record created by the fake has ID 1.
+	f.unlisted[1] = 2
+	cfg := ovhDNSProviderConfig{VerifyListed: true}
+
+	id, err := addTXTRecord(context.Background(), f.api(), &cfg, "example.com", "_acme-challenge", "key", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != 1 {
+		t.Errorf("got record %d, expected 1", id)
+	}
+	if n := f.countCalls("GET /domain/zone/example.com/record"); n != 4 {
+		t.Errorf("expected the lookup and 3 list calls, got %d calls", n)
+	}
+
+	// A record that is never listed fails the Present, for cert-manager to
+	// retry it.
+	f.unlisted[2] = 1 << 30
+	timeout := listWaitTimeout
+	listWaitTimeout = 50 * time.Millisecond
+	defer func() { listWaitTimeout = timeout }()
+	_, err = addTXTRecord(context.Background(), f.api(), &cfg, "example.com", "_acme-challenge.www", "key", nil)
+	if err == nil || !strings.Contains(err.Error(), "not listed") {
+		t.Errorf("expected the record not to be listed, got %v", err)
+	}
+}
+
+func TestAddTXTRecordCreateConflict(t *testing.T) {
+	shortenRetryDelay(t, time.Millisecond)
+	f := newFakeOVH(t, "example.com")
+	conflicts := []int{}
+	for i := 0; i <= defaultRetryBudget; i++ {
+		conflicts = append(conflicts, http.StatusConflict)
+	}
+	// The record created concurrently is missed by the lookup before the
+	// creation, which then conflicts with it.
+	concurrent := f.addRecord("example.com", ovhZoneRecord{FieldType: "TXT", SubDomain: "_acme-challenge", Target: "key"})
+	f.unlisted[concurrent] = 1
+	f.fail("POST /domain/zone/example.com/record", conflicts...)
+	cfg := ovhDNSProviderConfig{}
+
+	id, err := addTXTRecord(context.Background(), f.api(), &cfg, "example.com", "_acme-challenge", "key", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != concurrent {
+		t.Errorf("got record %d, expected the concurrent record %d", id, concurrent)
+	}
+	if n := len(f.zoneRecords("example.com")); n != 1 {
+		t.Errorf("expected a single record, got %d", n)
+	}
+
+	// Without a matching record, the conflict is reported.
+	f.fail("POST /domain/zone/example.com/record", conflicts...)
+	_, err = addTXTRecord(context.Background(), f.api(), &cfg, "example.com", "_acme-challenge", "other", nil)
+	if !isAPIError(err, http.StatusConflict) {
+		t.Errorf("expected the conflict error, got %v", err)
+	}
+}
+
+func TestAddTXTRecordRefusesEmptyTarget(t *testing.T) {
+	f := newFakeOVH(t, "example.com")
+	cfg := ovhDNSProviderConfig{}
+	_, err := addTXTRecord(context.Background(), f.api(), &cfg, "example.com", "_acme-challenge", "", nil)
+	if err == nil || !strings.Contains(err.Error(), "empty TXT record") {
+		t.Errorf("expected the empty record to be refused, got %v", err)
+	}
+	if n := f.countCalls(""); n != 0 {
+		t.Errorf("expected no call to OVH, got %d", n)
+	}
+	if n := testutil.ToFloat64(emptyTargetsRefused.WithLabelValues("example.com")); n != 1 {
+		t.Errorf("expected a refused empty target, got %v", n)
+	}
+}
+
+func TestCleanUpSkipped(t *testing.T) {
+	f := newFakeOVH(t, "example.com", "dev.example.com")
+	f.addRecord("dev.example.com", ovhZoneRecord{FieldType: "TXT", SubDomain: "_acme-challenge", Target: "key"})
+	records, err := newRecordStore(nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Present stored the record under the child zone it selected.
+	key := recordKey("dev.example.com", "_acme-challenge", "key")
+	records.put(context.Background(), key, 1)
+	s := &ovhDNSProviderSolver{
+		records:     records,
+		skipCleanup: true,
+		credentialSources: []credentialSource{staticCredentials{creds: ovhCredentials{
+			endpoint:          f.server.URL,
+			applicationKey:    "key",
+			applicationSecret: "secret",
+			consumerKey:       "consumer",
+		}}},
+	}
+	ch := &v1alpha1.ChallengeRequest{
+		ResolvedZone:            "example.com.",
+		ResolvedFQDN:            "_acme-challenge.dev.example.com.",
+		Key:                     "key",
+		AllowAmbientCredentials: true,
+	}
+	if err := s.CleanUp(ch); err != nil {
+		t.Fatal(err)
+	}
+	if records := f.zoneRecords("dev.example.com"); len(records) != 1 {
+		t.Errorf("expected the record to be kept, got %v", records)
+	}
+	if _, ok := records.get(context.Background(), key); ok {
+		t.Error("the record was not released")
+	}
+	if _, ok := records.leftovers[1]; !ok {
+		t.Error("the record was not marked as a leftover")
+	}
+	if n := f.countCalls(""); n != 0 {
+		t.Errorf("expected no OVH API call, got %d", n)
+	}
+}
+
+func TestAddTXTRecordZoneCheckModes(t *testing.T) {
+	for _, mode := range []string{zoneCheckWarn, zoneCheckSkip} {
+		f := newFakeOVH(t, "example.com")
+		f.undeployed["example.com"] = 1
+
+		cfg := ovhDNSProviderConfig{ZoneCheck: mode}
+		if _, err := addTXTRecord(context.Background(), f.api(), &cfg, "example.com", "_acme-challenge", "key", nil); err != nil {
+			t.Fatalf("%s: %v", mode, err)
+		}
+		if records := f.zoneRecords("example.com"); len(records) != 1 {
+			t.Errorf("%s: expected the record to be created, got %v", mode, records)
+		}
+		statusCalls := 0
+		if mode == zoneCheckWarn {
+			statusCalls = 1
+		}
+		if n := f.countCalls("GET /domain/zone/example.com/status"); n != statusCalls {
+			t.Errorf("%s: got %d status calls, expected %d", mode, n, statusCalls)
+		}
+	}
+}
+
+func TestAddTXTRecordZoneCheckSkipZones(t *testing.T) {
+	f := newFakeOVH(t, "example.com", "legacy.example.com")
+	f.undeployed["example.com"] = 100
+	f.undeployed["legacy.example.com"] = 100
+	cfg, err := loadConfig(&extapi.JSON{Raw: []byte(`{"zoneCheckSkipZones": ["Legacy.Example.com."]}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := addTXTRecord(context.Background(), f.api(), &cfg, "legacy.example.com", "_acme-challenge", "key", nil); err != nil {
+		t.Fatal(err)
+	}
+	if n := f.countCalls("GET /domain/zone/legacy.example.com/status"); n != 0 {
+		t.Errorf("got %d status calls for a skipped zone", n)
+	}
+	// The other zones are still checked.
+	if _, err := addTXTRecord(context.Background(), f.api(), &cfg, "example.com", "_acme-challenge", "key", nil); err == nil {
+		t.Error("expected an error for an undeployed zone")
+	}
+
+	if _, err := loadConfig(&extapi.JSON{Raw: []byte(`{"zoneCheckSkipZones": ["example.com/status"]}`)}); err == nil {
+		t.Error("expected an error for an invalid zone")
+	}
+}
+
+func TestPresentTimeout(t *testing.T) {
+	f := newFakeOVH(t, "example.com")
+	creds := staticCredentials{creds: ovhCredentials{
+		endpoint:          f.server.URL,
+		applicationKey:    "key",
+		applicationSecret: "secret",
+		consumerKey:       "consumer",
+	}}
+	tests := map[string]struct {
+		solverTimeout *metav1.Duration
+		config        string
+	}{
+		"presentTimeout":  {config: `{"presentTimeout": "50ms", "zoneDeployTimeout": "1m"}`},
+		"PRESENT_TIMEOUT": {solverTimeout: duration(50 * time.Millisecond), config: `{"zoneDeployTimeout": "1m"}`},
+	}
+	for name, test := range tests {
+		// The zone never gets deployed.
+		f.undeployed["example.com"] = 1 << 30
+		s := &ovhDNSProviderSolver{presentTimeout: test.solverTimeout, credentialSources: []credentialSource{creds}}
+		ch := &v1alpha1.ChallengeRequest{
+			ResolvedZone:            "example.com.",
+			ResolvedFQDN:            "_acme-challenge.example.com.",
+			Key:                     "key",
+			AllowAmbientCredentials: true,
+			Config:                  &extapi.JSON{Raw: []byte(test.config)},
+		}
+		start := time.Now()
+		err := s.Present(ch)
+		if err == nil || !strings.Contains(err.Error(), "did not complete within 50ms") || !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("%s: expected the present timeout error, got %v", name, err)
+		}
+		if elapsed := time.Since(start); elapsed > 10*time.Second {
+			t.Errorf("%s: Present aborted after %v", name, elapsed)
+		}
+	}
+}
+
+func TestPresentCanceledOnStop(t *testing.T) {
+	f := newFakeOVH(t, "example.com")
+	creds := staticCredentials{creds: ovhCredentials{
+		endpoint:          f.server.URL,
+		applicationKey:    "key",
+		applicationSecret: "secret",
+		consumerKey:       "consumer",
+	}}
+	// The zone never gets deployed.
+	f.undeployed["example.com"] = 1 << 30
+	stopCh := make(chan struct{})
+	s := &ovhDNSProviderSolver{stopCh: stopCh, credentialSources: []credentialSource{creds}}
+	ch := &v1alpha1.ChallengeRequest{
+		ResolvedZone:            "example.com.",
+		ResolvedFQDN:            "_acme-challenge.example.com.",
+		Key:                     "key",
+		AllowAmbientCredentials: true,
+		Config:                  &extapi.JSON{Raw: []byte(`{"zoneDeployTimeout": "1m"}`)},
+	}
+	time.AfterFunc(50*time.Millisecond, func() { close(stopCh) })
+	start := time.Now()
+	if err := s.Present(ch); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected Present to be canceled, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("Present aborted after %v", elapsed)
+	}
+}
+
+func TestPresentZonePropagationWaits(t *testing.T) {
+	f := newFakeOVH(t, "example.com", "slow.example.com")
+	creds := staticCredentials{creds: ovhCredentials{
+		endpoint:          f.server.URL,
+		applicationKey:    "key",
+		applicationSecret: "secret",
+		consumerKey:       "consumer",
+	}}
+	s := &ovhDNSProviderSolver{credentialSources: []credentialSource{creds}}
+	config := `{"refreshWindow": "10ms", "propagationWait": "10ms", "zonePropagationWaits": {"Slow.Example.com.": "200ms"}, "presentTimeout": "100ms"}`
+	present := func(zone string) error {
+		return s.Present(&v1alpha1.ChallengeRequest{
+			ResolvedZone:            zone + ".",
+			ResolvedFQDN:            "_acme-challenge." + zone + ".",
+			Key:                     "key",
+			AllowAmbientCredentials: true,
+			Config:                  &extapi.JSON{Raw: []byte(config)},
+		})
+	}
+
+	// The fast zone only waits for propagationWait.
+	if err := present("example.com"); err != nil {
+		t.Error(err)
+	}
+	// The slow zone waits longer than presentTimeout.
+	err := present("slow.example.com")
+	if err == nil || !strings.Contains(err.Error(), "propagation wait") {
+		t.Errorf("expected the propagation wait of the slow zone to time out, got %v", err)
+	}
+
+	for _, config := range []string{
+		`{"propagationWait": "-1s"}`,
+		`{"zonePropagationWaits": {"example.com": "-1s"}}`,
+		`{"zonePropagationWaits": {"example.com/record": "1s"}}`,
+	} {
+		if _, err := loadConfig(&extapi.JSON{Raw: []byte(config)}); err == nil {
+			t.Errorf("expected an error for %s", config)
+		}
+	}
+}
+
+func TestPresentCoalescesConcurrentCalls(t *testing.T) {
+	f := newFakeOVH(t, "example.com")
+	creds := staticCredentials{creds: ovhCredentials{
+		endpoint:          f.server.URL,
+		applicationKey:    "key",
+		applicationSecret: "secret",
+		consumerKey:       "consumer",
+	}}
+	s := &ovhDNSProviderSolver{presents: &presentFlights{}, credentialSources: []credentialSource{creds}}
+	ch := &v1alpha1.ChallengeRequest{
+		ResolvedZone:            "example.com.",
+		ResolvedFQDN:            "_acme-challenge.example.com.",
+		Key:                     "key",
+		AllowAmbientCredentials: true,
+		// The refresh window keeps the first call running while the
+		// retries of cert-manager arrive.
+		Config: &extapi.JSON{Raw: []byte(`{"refreshWindow": "200ms"}`)},
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := s.Present(ch); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := len(f.zoneRecords("example.com")); n != 1 {
+		t.Errorf("expected a single record, got %d", n)
+	}
+	if n := f.countCalls("POST /domain/zone/example.com/record"); n != 1 {
+		t.Errorf("expected a single creation, got %d", n)
+	}
+	if n := f.countCalls("POST /domain/zone/example.com/refresh"); n != 1 {
+		t.Errorf("expected a single refresh, got %d", n)
+	}
+}
+
+func TestPresentFlightsRetryAfterCanceledCall(t *testing.T) {
+	flights := &presentFlights{}
+	started := make(chan struct{})
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-started
+		cancel()
+	}()
+	var first int64
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		first, _ = flights.do(ctx, "key", func(ctx context.Context) (int64, error) {
+			close(started)
+			<-ctx.Done()
+			return 0, ctx.Err()
+		})
+	}()
+	<-started
+	// The joiner outlives the first caller and creates the record itself.
+	id, err := flights.do(context.Background(), "key", func(ctx context.Context) (int64, error) {
+		return 42, nil
+	})
+	<-done
+	if err != nil || id != 42 {
+		t.Errorf("do = %d, %v, expected 42", id, err)
+	}
+	if first != 0 {
+		t.Errorf("the canceled call got record %d", first)
+	}
+}
+
+func TestPresentCache(t *testing.T) {
+	f := newFakeOVH(t, "example.com")
+	creds := staticCredentials{creds: ovhCredentials{
+		endpoint:          f.server.URL,
+		applicationKey:    "key",
+		applicationSecret: "secret",
+		consumerKey:       "consumer",
+	}}
+	s := &ovhDNSProviderSolver{presented: presentCache{ttl: time.Minute}, credentialSources: []credentialSource{creds}}
+	ch := &v1alpha1.ChallengeRequest{
+		ResolvedZone:            "example.com.",
+		ResolvedFQDN:            "_acme-challenge.example.com.",
+		Key:                     "key",
+		AllowAmbientCredentials: true,
+		Config:                  &extapi.JSON{Raw: []byte(`{"refreshWindow": "10ms"}`)},
+	}
+	if err := s.Present(ch); err != nil {
+		t.Fatal(err)
+	}
+
+	// The repeated Present of the record is answered from the cache.
+	calls := f.countCalls("")
+	if err := s.Present(ch); err != nil {
+		t.Fatal(err)
+	}
+	if n := f.countCalls("") - calls; n != 0 {
+		t.Errorf("expected no call to OVH for the repeated Present, got %d", n)
+	}
+
+	// The CleanUp forgets the record, which the next Present creates again.
+	if err := s.CleanUp(ch); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Present(ch); err != nil {
+		t.Fatal(err)
+	}
+	if n := f.countCalls("POST /domain/zone/example.com/record"); n != 2 {
+		t.Errorf("expected the record to be created again after its CleanUp, got %d creations", n)
+	}
+	if n := len(f.zoneRecords("example.com")); n != 1 {
+		t.Errorf("expected a single record, got %d", n)
+	}
+
+	// An expired entry is forgotten.
+	s.presented.presented[ch.ResolvedFQDN] = time.Now().Add(-2 * time.Minute)
+	if _, ok := s.presented.recent(ch.ResolvedFQDN); ok {
+		t.Error("expected the expired entry to be forgotten")
+	}
+}
+
+func TestCleanUpGracePeriod(t *testing.T) {
+	f := newFakeOVH(t, "example.com")
+	creds := staticCredentials{creds: ovhCredentials{
+		endpoint:          f.server.URL,
+		applicationKey:    "key",
+		applicationSecret: "secret",
+		consumerKey:       "consumer",
+	}}
+	records, err := newRecordStore(nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &ovhDNSProviderSolver{presented: presentCache{ttl: time.Minute}, records: records, credentialSources: []credentialSource{creds}}
+	ch := &v1alpha1.ChallengeRequest{
+		ResolvedZone:            "example.com.",
+		ResolvedFQDN:            "_acme-challenge.example.com.",
+		Key:                     "key",
+		AllowAmbientCredentials: true,
+		Config:                  &extapi.JSON{Raw: []byte(`{"refreshWindow": "10ms", "cleanupGracePeriod": "200ms"}`)},
+	}
+	if err := s.Present(ch); err != nil {
+		t.Fatal(err)
+	}
+
+	// A new challenge presents the record during the grace period.
+	done := make(chan error)
+	go func() { done <- s.CleanUp(ch) }()
+	time.Sleep(50 * time.Millisecond)
+	if err := s.Present(ch); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if n := len(f.zoneRecords("example.com")); n != 1 {
+		t.Errorf("expected the record presented again to be kept, got %d records", n)
+	}
+	if _, ok := records.get(context.Background(), recordKey("example.com", "_acme-challenge", "key")); !ok {
+		t.Error("expected the record to stay in the record store")
+	}
+
+	// Without a new Present, the record is deleted after the grace period.
+	start := time.Now()
+	if err := s.CleanUp(ch); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("expected CleanUp to wait for the grace period, returned after %v", elapsed)
+	}
+	if n := len(f.zoneRecords("example.com")); n != 0 {
+		t.Errorf("expected the record to be deleted, got %d records", n)
+	}
+}
+
+// shortenRetryDelay speeds up the retries of the calls rejected because the
+// zone is locked or its task queue is full for the duration of the test.
+func shortenRetryDelay(t *testing.T, delay time.Duration) {
+	previous, previousTaskQueue := retryDelay, taskQueueRetryDelay
+	retryDelay, taskQueueRetryDelay = delay, delay
+	t.Cleanup(func() { retryDelay, taskQueueRetryDelay = previous, previousTaskQueue })
+}
+
+func TestRetryBudgetPerCallWithoutChallenge(t *testing.T) {
+	shortenRetryDelay(t, time.Millisecond)
+	f := newFakeOVH(t, "example.com")
+	api := f.api()
+
+	// Long-lived clients, like the one of the admin endpoint, never run out
+	// of retries.
+	for i := 0; i < 3; i++ {
+		f.fail("GET /domain/zone/example.com/record", http.StatusConflict, http.StatusConflict, http.StatusConflict)
+		if _, err := listRecords(context.Background(), api, "example.com", "TXT", "_acme-challenge"); err != nil {
+			t.Fatalf("call %d: %v", i, err)
+		}
+	}
+}
+
+func TestCallTimeoutPerAttempt(t *testing.T) {
+	shortenRetryDelay(t, 150*time.Millisecond)
+	f := newFakeOVH(t, "example.com")
+	api := f.api()
+	api.timeouts[operationList] = 200 * time.Millisecond
+
+	// The retries take longer than the timeout, but each attempt is fast.
+	f.fail("GET /domain/zone/example.com/record", http.StatusConflict, http.StatusConflict)
+	if _, err := listRecords(context.Background(), api, "example.com", "TXT", "_acme-challenge"); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"k8s.io/klog/v2"
+)
+
+const metricsNamespace = "cert_manager_webhook_ovh"
+
+// The values of METRICS_SENSITIVE_LABELS.
+const (
+	// metricsLabelsPlain exports the zones and endpoints as is.
+	metricsLabelsPlain = "plain"
+	// metricsLabelsHash exports the start of their HMAC-SHA256, keyed by
+	// METRICS_LABEL_SALT, instead.
+	metricsLabelsHash = "hash"
+	// metricsLabelsOmit exports them as empty values.
+	metricsLabelsOmit = "omit"
+)
+
+// metricsLabels is how the zone and endpoint labels of the metrics are
+// exported, so that shared monitoring systems do not learn the domains of the
+// webhook. It is set from the METRICS_SENSITIVE_LABELS environment variable,
+// and metricsLabelSalt from METRICS_LABEL_SALT.
+var (
+	metricsLabels    = metricsLabelsPlain
+	metricsLabelSalt []byte
+)
+
+// metricsLabelsFromEnv returns the mode set by METRICS_SENSITIVE_LABELS and
+// the salt set by METRICS_LABEL_SALT, which the hash mode requires: without a
+// secret key, anyone knowing a domain could hash it to find its series.
+func metricsLabelsFromEnv() (string, []byte, error) {
+	mode := os.Getenv("METRICS_SENSITIVE_LABELS")
+	switch mode {
+	case "":
+		mode = metricsLabelsPlain
+	case metricsLabelsPlain, metricsLabelsHash, metricsLabelsOmit:
+	default:
+		return "", nil, fmt.Errorf("invalid METRICS_SENSITIVE_LABELS %q: expected %s, %s or %s", mode, metricsLabelsPlain, metricsLabelsHash, metricsLabelsOmit)
+	}
+	salt := []byte(os.Getenv("METRICS_LABEL_SALT"))
+	if mode == metricsLabelsHash && len(salt) == 0 {
+		return "", nil, fmt.Errorf("METRICS_SENSITIVE_LABELS %s requires METRICS_LABEL_SALT, the secret key of the hash", metricsLabelsHash)
+	}
+	return mode, salt, nil
+}
+
+// sensitiveLabel returns the value of a zone or endpoint label, as set by
+// metricsLabels.
+func sensitiveLabel(value string) string {
+	switch metricsLabels {
+	case metricsLabelsHash:
+		mac := hmac.New(sha256.New, metricsLabelSalt)
+		mac.Write([]byte(value))
+		return hex.EncodeToString(mac.Sum(nil))[:12]
+	case metricsLabelsOmit:
+		return ""
+	}
+	return value
+}
+
+var (
+	rateLimitRemaining = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "api_rate_limit_remaining",
+		Help:      "Number of OVH API calls remaining in the current rate limit window, as reported by the last OVH response, whatever its account.",
+	})
+	authoritativeChecks = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "authoritative_checks_total",
+		Help:      "Checks of the challenge records on the OVH name servers of the zone, by result (visible, not_visible or error).",
+	}, []string{"zone", "result"})
+	ttlMismatches = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "record_ttl_mismatches_total",
+		Help:      "Challenge records stored by OVH with another TTL than the requested one, by zone (see the verifyTTL option).",
+	}, []string{"zone"})
+	ignoredCleanupErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "ignored_cleanup_errors_total",
+		Help:      "Failed cleanups reported as successful because of the ignoreCleanupErrors option, by zone. Each one may leave an orphan record.",
+	}, []string{"zone"})
+	emptyTargetsRefused = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "empty_targets_refused_total",
+		Help:      "Challenge records not created because their target, the challenge key, was empty, by zone. Each one is a bug upstream of the webhook.",
+	}, []string{"zone"})
+	recordLimitsReached = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "record_limits_reached_total",
+		Help:      "Challenge record creations refused by OVH because the zone holds its maximum number of records, by zone.",
+	}, []string{"zone"})
+	leftoverRecords = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "leftover_records",
+		Help:      "Leftover records known by this replica: records of finished challenges whose cleanup was skipped or failed.",
+	})
+	leftoverRecordsDetected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "leftover_records_detected_total",
+		Help:      "Leftover records found in the zone by the sweeps of the sweepOnRecordLimit option, by zone.",
+	}, []string{"zone"})
+	leftoverRecordsSwept = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "leftover_records_swept_total",
+		Help:      "Leftover records deleted by the sweeps of the sweepOnRecordLimit option, by zone.",
+	}, []string{"zone"})
+	leftoverSweepFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "leftover_sweep_failures_total",
+		Help:      "Sweeps of the sweepOnRecordLimit option that failed to delete the leftover records of the zone, by zone.",
+	}, []string{"zone"})
+	unchangedZoneSerials = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "unchanged_zone_serials_total",
+		Help:      "Zone refreshes after which the serial of the zone did not advance, with the verifySerial option, by zone.",
+	}, []string{"zone"})
+	cacheEntries = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "cache_entries",
+		Help:      "Entries of each in-memory cache after its last prune, by cache.",
+	}, []string{"cache"})
+	circuitBreakerState = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "api_circuit_breaker_state",
+		Help:      "State of the circuit breaker of each OVH API endpoint: 0 closed, 1 half-open, 2 open.",
+	}, []string{"endpoint"})
+	apiErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "api_errors_total",
+		Help:      "Failed OVH API call attempts, by class: transport (no response from OVH), auth (credentials rejected) or api (other errors returned by OVH).",
+	}, []string{"class"})
+	challengesInFlight = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "challenges_in_flight",
+		Help:      "Present and CleanUp calls holding a slot of MAX_CONCURRENT_CHALLENGES, by operation (present or cleanup).",
+	}, []string{"operation"})
+	challengeQueueWait = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "challenge_queue_wait_seconds",
+		Help:      "Time the Present and CleanUp calls waited for a slot of MAX_CONCURRENT_CHALLENGES, by operation (present or cleanup).",
+		Buckets:   []float64{0.01, 0.1, 0.5, 1, 5, 10, 30, 60, 120},
+	}, []string{"operation"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		rateLimitRemaining,
+		authoritativeChecks,
+		ttlMismatches,
+		ignoredCleanupErrors,
+		emptyTargetsRefused,
+		unchangedZoneSerials,
+		recordLimitsReached,
+		leftoverRecords,
+		leftoverRecordsDetected,
+		leftoverRecordsSwept,
+		leftoverSweepFailures,
+		circuitBreakerState,
+		apiErrors,
+		challengesInFlight,
+		challengeQueueWait,
+		cacheEntries,
+	)
+}
+
+// startMetricsServer serves the Prometheus metrics, the version of the webhook
+// and, if not nil, the admin endpoint on the given address until stopCh is
+// closed.
+func startMetricsServer(addr string, stopCh <-chan struct{}, admin http.Handler) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/version", serveVersion)
+	if admin != nil {
+		mux.Handle("/admin/records", admin)
+	}
+	server := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		<-stopCh
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(ctx)
+	}()
+	go func() {
+		klog.Infof("Serving metrics on %s", listener.Addr())
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			klog.Errorf("Metrics server failed: %v", err)
+		}
+	}()
+	return nil
+}
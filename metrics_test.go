@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestSensitiveLabels(t *testing.T) {
+	f := newFakeOVH(t, "hashed.example.com", "omitted.example.com")
+	cfg := ovhDNSProviderConfig{ZoneCheck: zoneCheckEnforce}
+	defer func() { metricsLabels, metricsLabelSalt = metricsLabelsPlain, nil }()
+
+	metricsLabels, metricsLabelSalt = metricsLabelsHash, []byte("salt")
+	addTXTRecord(context.Background(), f.api(), &cfg, "hashed.example.com", "_acme-challenge", "", nil)
+	hashed := sensitiveLabel("hashed.example.com")
+	if len(hashed) != 12 || hashed == sensitiveLabel("omitted.example.com") {
+		t.Errorf("expected distinct hashes of the zones, got %q", hashed)
+	}
+	metricsLabelSalt = []byte("other salt")
+	if sensitiveLabel("hashed.example.com") == hashed {
+		t.Error("expected the hash to depend on the salt")
+	}
+	metricsLabelSalt = []byte("salt")
+	if n := testutil.ToFloat64(emptyTargetsRefused.WithLabelValues(hashed)); n != 1 {
+		t.Errorf("expected the refusal under the hash of the zone, got %v", n)
+	}
+
+	metricsLabels = metricsLabelsOmit
+	addTXTRecord(context.Background(), f.api(), &cfg, "omitted.example.com", "_acme-challenge", "", nil)
+	if n := testutil.ToFloat64(emptyTargetsRefused.WithLabelValues("")); n != 1 {
+		t.Errorf("expected the refusal without its zone, got %v", n)
+	}
+	for _, zone := range []string{"hashed.example.com", "omitted.example.com"} {
+		if n := testutil.ToFloat64(emptyTargetsRefused.WithLabelValues(zone)); n != 0 {
+			t.Errorf("expected zone %s not to be exported, got %v", zone, n)
+		}
+	}
+
+	t.Setenv("METRICS_SENSITIVE_LABELS", "redact")
+	if _, _, err := metricsLabelsFromEnv(); err == nil {
+		t.Error("expected an error for an invalid METRICS_SENSITIVE_LABELS")
+	}
+	t.Setenv("METRICS_SENSITIVE_LABELS", metricsLabelsHash)
+	if _, _, err := metricsLabelsFromEnv(); err == nil {
+		t.Error("expected an error for the hash mode without METRICS_LABEL_SALT")
+	}
+	t.Setenv("METRICS_LABEL_SALT", "salt")
+	if mode, salt, err := metricsLabelsFromEnv(); err != nil || mode != metricsLabelsHash || string(salt) != "salt" {
+		t.Errorf("metricsLabelsFromEnv() = %q, %q, %v", mode, salt, err)
+	}
+}
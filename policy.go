@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/cert-manager/cert-manager/pkg/issuer/acme/dns/util"
+)
+
+// normalizeName returns the lower-case form of a domain name without the
+// trailing dot.
+func normalizeName(name string) string {
+	return strings.ToLower(util.UnFqdn(name))
+}
+
+// checkZoneAllowed returns an error if the zone is not in one of the given
+// allowlists. Empty allowlists allow every zone.
+func checkZoneAllowed(domain string, allowlists ...[]string) error {
+	for _, allowlist := range allowlists {
+		if len(allowlist) == 0 {
+			continue
+		}
+		allowed := false
+		for _, zone := range allowlist {
+			if normalizeName(zone) == normalizeName(domain) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return fmt.Errorf("OVH zone %s is not in the list of allowed zones", domain)
+		}
+	}
+	return nil
+}
+
+// checkSubDomainAllowed returns an error if the record name is in one of the
+// given denylists. A denylist entry is either a fully qualified name or a
+// wildcard like "*.example.com" that denies all the names below it.
+func checkSubDomainAllowed(domain, subDomain string, denylists ...[]string) error {
+	name := normalizeName(subDomain + "." + domain)
+	for _, denylist := range denylists {
+		for _, denied := range denylist {
+			denied = normalizeName(denied)
+			if name == denied || (strings.HasPrefix(denied, "*.") && strings.HasSuffix(name, denied[1:])) {
+				return fmt.Errorf("subdomain %s of OVH zone %s is denied by %q", subDomain, domain, denied)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import "testing"
+
+func TestCheckZoneAllowed(t *testing.T) {
+	tests := []struct {
+		domain     string
+		allowlists [][]string
+		allowed    bool
+	}{
+		{"example.com", nil, true},
+		{"example.com", [][]string{{}}, true},
+		{"example.com", [][]string{{"example.org", "Example.com."}}, true},
+		{"example.com", [][]string{{"example.org"}}, false},
+		{"example.com", [][]string{{"example.com"}, {"example.org"}}, false},
+		{"sub.example.com", [][]string{{"example.com"}}, false},
+	}
+	for _, tt := range tests {
+		err := checkZoneAllowed(tt.domain, tt.allowlists...)
+		if allowed := err == nil; allowed != tt.allowed {
+			t.Errorf("checkZoneAllowed(%q, %v) = %v, expected allowed = %v", tt.domain, tt.allowlists, err, tt.allowed)
+		}
+	}
+}
+
+func TestCheckSubDomainAllowed(t *testing.T) {
+	tests := []struct {
+		subDomain string
+		denylists [][]string
+		allowed   bool
+	}{
+		{"_acme-challenge", nil, true},
+		{"_acme-challenge", [][]string{{"_acme-challenge.www.example.com"}}, true},
+		{"_acme-challenge.www", [][]string{{"_acme-challenge.WWW.example.com."}}, false},
+		{"_acme-challenge.www", [][]string{{}, {"*.www.example.com"}}, false},
+		{"_acme-challenge.api", [][]string{{"*.www.example.com"}}, true},
+		{"_acme-challenge", [][]string{{"*.example.com"}}, false},
+	}
+	for _, tt := range tests {
+		err := checkSubDomainAllowed("example.com", tt.subDomain, tt.denylists...)
+		if allowed := err == nil; allowed != tt.allowed {
+			t.Errorf("checkSubDomainAllowed(%q, %v) = %v, expected allowed = %v", tt.subDomain, tt.denylists, err, tt.allowed)
+		}
+	}
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// dnsQueryTimeout bounds a single query to an authoritative name server,
+	// unless the queryTimeout of the propagation polling is set.
+	dnsQueryTimeout = 5 * time.Second
+	// propagationWorkers bounds the number of concurrent queries to the
+	// authoritative name servers, across all challenges.
+	propagationWorkers = 4
+	// nameServerCacheTTL is how long the name servers of a zone are reused
+	// before being fetched again from OVH.
+	nameServerCacheTTL = 10 * time.Minute
+	// defaultPollInitialInterval, defaultPollMaxInterval and
+	// defaultPollTimeout are the default schedule of waitForAuthoritative,
+	// well within the challenge timeout of cert-manager.
+	defaultPollInitialInterval = 2 * time.Second
+	defaultPollMaxInterval     = 30 * time.Second
+	defaultPollTimeout         = 2 * time.Minute
+)
+
+// ovhPollingConfig is the schedule of the polling of the OVH name servers:
+// the interval between two polls doubles from initialInterval up to
+// maxInterval, until timeout. Each query to a name server is bounded by
+// queryTimeout, so that an unreachable name server does not delay the polls
+// of the others.
+type ovhPollingConfig struct {
+	InitialInterval *metav1.Duration `json:"initialInterval,omitempty"`
+	MaxInterval     *metav1.Duration `json:"maxInterval,omitempty"`
+	Timeout         *metav1.Duration `json:"timeout,omitempty"`
+	QueryTimeout    *metav1.Duration `json:"queryTimeout,omitempty"`
+}
+
+func (cfg *ovhPollingConfig) validate() error {
+	for name, d := range map[string]*metav1.Duration{
+		"initial interval": cfg.InitialInterval,
+		"max interval":     cfg.MaxInterval,
+		"timeout":          cfg.Timeout,
+		"query timeout":    cfg.QueryTimeout,
+	} {
+		if d != nil && d.Duration <= 0 {
+			return fmt.Errorf("invalid propagation polling %s in OVH config: %v", name, d.Duration)
+		}
+	}
+	initial := firstDuration(defaultPollInitialInterval, cfg.InitialInterval)
+	max := firstDuration(defaultPollMaxInterval, cfg.MaxInterval)
+	if initial > max {
+		return fmt.Errorf("invalid propagation polling in OVH config: initial interval %v exceeds max interval %v", initial, max)
+	}
+	return nil
+}
+
+// propagationChecker checks that challenge records are served by the OVH name
+// servers. Its zero value is ready to use.
+type propagationChecker struct {
+	mu          sync.Mutex
+	nameServers map[string]cachedNameServers
+	used        accessTimes[string]
+	workers     chan struct{}
+}
+
+type cachedNameServers struct {
+	servers []string
+	expires time.Time
+}
+
+// check queries the OVH name servers of the zone for the challenge record
+// right after Present. A record missing there points at an OVH-side
+// propagation issue, while a record present there but not seen by
+// cert-manager points at resolver caching. The result is only reported in
+// logs and metrics. When resolver is not nil, it is queried instead of the
+// OVH name servers.
+func (pc *propagationChecker) check(ctx context.Context, api *ovhAPI, domain, fqdn, target string, resolver *dnsResolver) {
+	servers, err := pc.servers(ctx, api, domain, resolver)
+	if err != nil {
+		klog.Warningf("Unable to check propagation of %s: %v", fqdn, err)
+		authoritativeChecks.WithLabelValues(sensitiveLabel(domain), "error").Inc()
+		return
+	}
+
+	var wg sync.WaitGroup
+	for _, server := range servers {
+		wg.Add(1)
+		go func(server string) {
+			defer wg.Done()
+			authoritativeChecks.WithLabelValues(sensitiveLabel(domain), pc.checkServer(ctx, server, fqdn, target, dnsQueryTimeout, resolver)).Inc()
+		}(server)
+	}
+	wg.Wait()
+}
+
+// wait polls the OVH name servers of the zone until all of them serve the
+// challenge record, backing off between polls. The name servers are queried
+// in parallel, each within its own query timeout. Giving up only produces a
+// warning: cert-manager still runs its own self check. When resolver is not
+// nil, it is polled instead of the OVH name servers.
+func (pc *propagationChecker) wait(ctx context.Context, api *ovhAPI, domain, fqdn, target string, cfg ovhPollingConfig, resolver *dnsResolver) {
+	interval := firstDuration(defaultPollInitialInterval, cfg.InitialInterval)
+	maxInterval := firstDuration(defaultPollMaxInterval, cfg.MaxInterval)
+	timeout := firstDuration(defaultPollTimeout, cfg.Timeout)
+	queryTimeout := firstDuration(dnsQueryTimeout, cfg.QueryTimeout)
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	for {
+		pending, err := pc.pendingServers(ctx, api, domain, fqdn, target, queryTimeout, resolver)
+		if err == nil && len(pending) == 0 {
+			klog.V(2).Infof("TXT record %s is visible on all OVH name servers", fqdn)
+			return
+		}
+		select {
+		case <-ctx.Done():
+			klog.Warningf("TXT record %s is still not visible on OVH name servers %v after %v (last error: %v)", fqdn, pending, timeout, err)
+			return
+		case <-time.After(interval):
+		}
+		interval *= 2
+		if interval > maxInterval {
+			interval = maxInterval
+		}
+	}
+}
+
+// pendingServers returns the OVH name servers that do not serve the challenge
+// record yet, along with the error of their query if it failed.
+func (pc *propagationChecker) pendingServers(ctx context.Context, api *ovhAPI, domain, fqdn, target string, timeout time.Duration, resolver *dnsResolver) ([]string, error) {
+	servers, err := pc.servers(ctx, api, domain, resolver)
+	if err != nil {
+		return nil, err
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	pending := []string{}
+	for _, server := range servers {
+		wg.Add(1)
+		go func(server string) {
+			defer wg.Done()
+			visible, err := pc.queryServer(ctx, server, fqdn, target, timeout, resolver)
+			if !visible {
+				if err != nil {
+					server = fmt.Sprintf("%s (%v)", server, err)
+				}
+				mu.Lock()
+				pending = append(pending, server)
+				mu.Unlock()
+			}
+		}(server)
+	}
+	wg.Wait()
+	sort.Strings(pending)
+	return pending, nil
+}
+
+func (pc *propagationChecker) checkServer(ctx context.Context, server, fqdn, target string, timeout time.Duration, resolver *dnsResolver) string {
+	visible, err := pc.queryServer(ctx, server, fqdn, target, timeout, resolver)
+	switch {
+	case err != nil:
+		klog.Warningf("Unable to query %s for TXT record %s: %v", server, fqdn, err)
+		return "error"
+	case !visible:
+		klog.Infof("TXT record %s is not visible yet on OVH name server %s", fqdn, server)
+		return "not_visible"
+	default:
+		klog.V(2).Infof("TXT record %s is visible on OVH name server %s", fqdn, server)
+		return "visible"
+	}
+}
+
+// queryServer returns whether the name server, or the resolver if not nil,
+// serves the challenge record, once a worker slot is available.
+func (pc *propagationChecker) queryServer(ctx context.Context, server, fqdn, target string, timeout time.Duration, resolver *dnsResolver) (bool, error) {
+	release, err := pc.acquire(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer release()
+
+	var values []string
+	if resolver != nil {
+		values, err = resolver.queryTXT(ctx, fqdn, timeout)
+	} else {
+		values, err = queryTXT(ctx, nameServerAddr(server), fqdn, timeout)
+	}
+	if err != nil {
+		return false, err
+	}
+	return containsTarget(values, target), nil
+}
+
+// acquire waits for a free worker slot.
+func (pc *propagationChecker) acquire(ctx context.Context) (func(), error) {
+	pc.mu.Lock()
+	if pc.workers == nil {
+		pc.workers = make(chan struct{}, propagationWorkers)
+	}
+	workers := pc.workers
+	pc.mu.Unlock()
+
+	select {
+	case workers <- struct{}{}:
+		return func() { <-workers }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// servers returns the servers to query for the records of the zone: the
+// resolver when not nil, the OVH name servers of the zone otherwise.
+func (pc *propagationChecker) servers(ctx context.Context, api *ovhAPI, domain string, resolver *dnsResolver) ([]string, error) {
+	if resolver != nil {
+		return []string{resolver.String()}, nil
+	}
+	return pc.zoneNameServers(ctx, api, domain)
+}
+
+// zoneNameServers returns the name servers of the zone, fetched from OVH at
+// most once per nameServerCacheTTL.
+func (pc *propagationChecker) zoneNameServers(ctx context.Context, api *ovhAPI, domain string) ([]string, error) {
+	key := normalizeName(domain)
+	pc.mu.Lock()
+	cached, ok := pc.nameServers[key]
+	pc.used.touch(key)
+	pc.mu.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.servers, nil
+	}
+
+	zone, err := getZone(ctx, api, domain)
+	if err != nil {
+		return nil, err
+	}
+
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	if pc.nameServers == nil {
+		pc.nameServers = map[string]cachedNameServers{}
+	}
+	pc.nameServers[key] = cachedNameServers{servers: zone.NameServers, expires: time.Now().Add(nameServerCacheTTL)}
+	pc.used.touch(key)
+	return zone.NameServers, nil
+}
+
+func (pc *propagationChecker) prune(now time.Time, max int) int {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	return pruneEntries(pc.nameServers, pc.used, now, max, func(cached cachedNameServers) time.Time {
+		return cached.expires
+	})
+}
+
+// nameServerAddr returns the address of a name server given by its host name,
+// on the standard DNS port unless another one is specified.
+func nameServerAddr(server string) string {
+	if _, _, err := net.SplitHostPort(server); err == nil {
+		return server
+	}
+	return net.JoinHostPort(strings.TrimSuffix(server, "."), "53")
+}
+
+// queryTXT asks the name server at addr for the TXT values of fqdn, without
+// recursion, within timeout.
+func queryTXT(ctx context.Context, addr, fqdn string, timeout time.Duration) ([]string, error) {
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn(fqdn), dns.TypeTXT)
+	msg.RecursionDesired = false
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	return exchangeTXT(ctx, "udp", addr, msg)
+}
+
+// exchangeTXT sends msg to the name server at addr over network (udp or tcp)
+// and returns the TXT values of the response. Truncated udp responses are
+// queried again over tcp.
+func exchangeTXT(ctx context.Context, network, addr string, msg *dns.Msg) ([]string, error) {
+	client := &dns.Client{Net: network}
+	resp, _, err := client.ExchangeContext(ctx, msg, addr)
+	if err == nil && resp.Truncated && network == "udp" {
+		client.Net = "tcp"
+		resp, _, err = client.ExchangeContext(ctx, msg, addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return txtValues(resp), nil
+}
+
+// txtValues returns the TXT values of the answer of resp.
+func txtValues(resp *dns.Msg) []string {
+	values := []string{}
+	for _, rr := range resp.Answer {
+		if txt, ok := rr.(*dns.TXT); ok {
+			values = append(values, strings.Join(txt.Txt, ""))
+		}
+	}
+	return values
+}
+
+func containsTarget(values []string, target string) bool {
+	for _, value := range values {
+		if value == target {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// startDNSServer serves the given TXT records on a local UDP port and returns
+// its address.
+func startDNSServer(t *testing.T, records map[string][]string) string {
+	return startDNSHandler(t, func(name string) []string { return records[name] })
+}
+
+// startDNSHandler serves the TXT values returned by lookup on a local UDP port
+// and returns its address.
+func startDNSHandler(t *testing.T, lookup func(name string) []string) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		resp.Authoritative = true
+		for _, q := range req.Question {
+			for _, value := range lookup(q.Name) {
+				resp.Answer = append(resp.Answer, &dns.TXT{
+					Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60},
+					Txt: []string{value},
+				})
+			}
+		}
+		w.WriteMsg(resp)
+	})
+	server := &dns.Server{PacketConn: conn, Handler: handler}
+	go server.ActivateAndServe()
+	t.Cleanup(func() { server.Shutdown() })
+	return conn.LocalAddr().String()
+}
+
+func TestQueryTXT(t *testing.T) {
+	addr := startDNSServer(t, map[string][]string{
+		"_acme-challenge.example.com.": {"key", "other"},
+	})
+
+	values, err := queryTXT(context.Background(), addr, "_acme-challenge.example.com", dnsQueryTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !containsTarget(values, "key") {
+		t.Errorf("key not found in %v", values)
+	}
+
+	values, err = queryTXT(context.Background(), addr, "_acme-challenge.example.org.", dnsQueryTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 0 {
+		t.Errorf("unexpected values %v", values)
+	}
+}
+
+func TestNameServerAddr(t *testing.T) {
+	if addr := nameServerAddr("dns10.ovh.net."); addr != "dns10.ovh.net:53" {
+		t.Errorf("nameServerAddr = %q", addr)
+	}
+	if addr := nameServerAddr("127.0.0.1:5353"); addr != "127.0.0.1:5353" {
+		t.Errorf("nameServerAddr = %q", addr)
+	}
+}
+
+func TestZoneNameServersCached(t *testing.T) {
+	f := newFakeOVH(t, "example.com")
+	api := f.api()
+	pc := &propagationChecker{}
+
+	for _, domain := range []string{"example.com", "Example.com."} {
+		servers, err := pc.zoneNameServers(context.Background(), api, domain)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(servers) != 2 {
+			t.Errorf("unexpected name servers %v", servers)
+		}
+	}
+	if n := f.countCalls("GET /domain/zone/example.com"); n != 1 {
+		t.Errorf("zone fetched %d times, want 1", n)
+	}
+}
+
+func TestPollingConfigValidate(t *testing.T) {
+	valid := []ovhPollingConfig{
+		{},
+		{InitialInterval: duration(time.Second), MaxInterval: duration(time.Second), Timeout: duration(time.Minute)},
+	}
+	for _, cfg := range valid {
+		if err := cfg.validate(); err != nil {
+			t.Errorf("unexpected error for %+v: %v", cfg, err)
+		}
+	}
+	invalid := []ovhPollingConfig{
+		{Timeout: duration(0)},
+		{InitialInterval: duration(-time.Second)},
+		{InitialInterval: duration(time.Minute)},
+		{QueryTimeout: duration(0)},
+	}
+	for _, cfg := range invalid {
+		if err := cfg.validate(); err == nil {
+			t.Errorf("expected an error for %+v", cfg)
+		}
+	}
+}
+
+// queryLog records the times of the queries to a name server that serves the
+// record from the given query on, or never when visibleFrom is 0.
+type queryLog struct {
+	mu          sync.Mutex
+	times       []time.Time
+	visibleFrom int
+}
+
+func (l *queryLog) lookup(name string) []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.times = append(l.times, time.Now())
+	if l.visibleFrom > 0 && len(l.times) >= l.visibleFrom {
+		return []string{"key"}
+	}
+	return nil
+}
+
+func (l *queryLog) queries() []time.Time {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]time.Time{}, l.times...)
+}
+
+func TestPropagationWaitReturnsOnceVisible(t *testing.T) {
+	log := &queryLog{visibleFrom: 3}
+	f := newFakeOVH(t, "example.com")
+	f.nameServers["example.com"] = []string{startDNSHandler(t, log.lookup)}
+	pc := &propagationChecker{}
+
+	cfg := ovhPollingConfig{InitialInterval: duration(10 * time.Millisecond), Timeout: duration(time.Minute)}
+	start := time.Now()
+	pc.wait(context.Background(), f.api(), "example.com", "_acme-challenge.example.com", "key", cfg, nil)
+	if n := len(log.queries()); n != 3 {
+		t.Errorf("got %d queries, expected the wait to end with the third one", n)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("wait returned after %v", elapsed)
+	}
+}
+
+func TestPropagationWaitBacksOff(t *testing.T) {
+	log := &queryLog{}
+	f := newFakeOVH(t, "example.com")
+	f.nameServers["example.com"] = []string{startDNSHandler(t, log.lookup)}
+	pc := &propagationChecker{}
+	logs := captureLogs(t)
+
+	cfg := ovhPollingConfig{
+		InitialInterval: duration(20 * time.Millisecond),
+		MaxInterval:     duration(80 * time.Millisecond),
+		Timeout:         duration(500 * time.Millisecond),
+	}
+	start := time.Now()
+	pc.wait(context.Background(), f.api(), "example.com", "_acme-challenge.example.com", "key", cfg, nil)
+	elapsed := time.Since(start)
+
+	if elapsed < 500*time.Millisecond || elapsed > 5*time.Second {
+		t.Errorf("wait gave up after %v, expected the 500ms timeout", elapsed)
+	}
+	if !strings.Contains(logs.String(), "is still not visible on OVH name servers") {
+		t.Errorf("missing timeout warning: %s", logs)
+	}
+	times := log.queries()
+	if len(times) < 4 {
+		t.Fatalf("got %d queries", len(times))
+	}
+	// The intervals double from 20ms, then stay at 80ms.
+	for i, want := range []time.Duration{20 * time.Millisecond, 40 * time.Millisecond, 80 * time.Millisecond} {
+		if gap := times[i+1].Sub(times[i]); gap < want {
+			t.Errorf("interval %d is %v, expected at least %v", i, gap, want)
+		}
+	}
+	for i := 3; i+1 < len(times); i++ {
+		if gap := times[i+1].Sub(times[i]); gap > 80*time.Millisecond+time.Second {
+			t.Errorf("interval %d is %v, expected at most the 80ms max interval", i, gap)
+		}
+	}
+	if len(times) > 12 {
+		t.Errorf("got %d queries, expected the polling to back off", len(times))
+	}
+}
+
+func TestPropagationWaitQueryTimeout(t *testing.T) {
+	// An unreachable name server never answers.
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	log := &queryLog{visibleFrom: 1}
+	f := newFakeOVH(t, "example.com")
+	f.nameServers["example.com"] = []string{startDNSHandler(t, log.lookup), conn.LocalAddr().String()}
+	pc := &propagationChecker{}
+	logs := captureLogs(t)
+
+	cfg := ovhPollingConfig{
+		InitialInterval: duration(20 * time.Millisecond),
+		Timeout:         duration(300 * time.Millisecond),
+		QueryTimeout:    duration(50 * time.Millisecond),
+	}
+	pc.wait(context.Background(), f.api(), "example.com", "_acme-challenge.example.com", "key", cfg, nil)
+
+	// The queries to the reachable name server are not held up by the
+	// unreachable one.
+	if n := len(log.queries()); n < 3 {
+		t.Errorf("got %d queries, expected several polls within the timeout", n)
+	}
+	if !strings.Contains(logs.String(), conn.LocalAddr().String()+" (") {
+		t.Errorf("missing the unreachable name server and its error in the warning: %s", logs)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// parseProxyURL validates an HTTP proxy, set in source.
+func parseProxyURL(proxy, source string) (*url.URL, error) {
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return nil, fmt.Errorf("invalid HTTP proxy %q in %s: %v", proxy, source, err)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, fmt.Errorf("invalid HTTP proxy %q in %s: the URL scheme must be http, https or socks5", proxy, source)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("invalid HTTP proxy %q in %s: the URL has no host", proxy, source)
+	}
+	return u, nil
+}
+
+// proxyTransports holds one transport per proxy, so that the connections
+// through a proxy are reused by the OVH clients of successive challenges.
+// Its zero value is ready to use.
+type proxyTransports struct {
+	// maxIdleConnsPerHost and idleConnTimeout, when not 0, replace the
+	// settings of the default transport in all the transports.
+	maxIdleConnsPerHost int
+	idleConnTimeout     time.Duration
+
+	mu         sync.Mutex
+	transports map[string]*http.Transport
+}
+
+// get returns the transport for the given proxy URL, set in source. Without a
+// proxy, the
+// default transport is used, which honors the HTTPS_PROXY and NO_PROXY
+// environment variables, or a copy of it when its connection settings are
+// tuned.
+func (p *proxyTransports) get(proxy, source string) (http.RoundTripper, error) {
+	tuned := p.maxIdleConnsPerHost != 0 || p.idleConnTimeout != 0
+	if proxy == "" && !tuned {
+		return http.DefaultTransport, nil
+	}
+	var u *url.URL
+	if proxy != "" {
+		var err error
+		u, err = parseProxyURL(proxy, source)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if t, ok := p.transports[proxy]; ok {
+		return t, nil
+	}
+	if p.transports == nil {
+		p.transports = map[string]*http.Transport{}
+	}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	if u != nil {
+		t.Proxy = http.ProxyURL(u)
+	}
+	if p.maxIdleConnsPerHost != 0 {
+		t.MaxIdleConnsPerHost = p.maxIdleConnsPerHost
+		if t.MaxIdleConns != 0 && t.MaxIdleConns < p.maxIdleConnsPerHost {
+			t.MaxIdleConns = p.maxIdleConnsPerHost
+		}
+	}
+	if p.idleConnTimeout != 0 {
+		t.IdleConnTimeout = p.idleConnTimeout
+	}
+	p.transports[proxy] = t
+	return t, nil
+}
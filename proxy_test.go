@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestProxyTransports(t *testing.T) {
+	p := &proxyTransports{}
+	if transport, err := p.get("", "OVH config"); err != nil || transport != http.DefaultTransport {
+		t.Errorf("expected the default transport without proxy, got %v, %v", transport, err)
+	}
+
+	first, err := p.get("http://proxy.example.com:3128", "OVH config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := p.get("http://proxy.example.com:3128", "OVH config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != second {
+		t.Error("expected the transport of the proxy to be reused")
+	}
+	req, _ := http.NewRequest("GET", "https://eu.api.ovh.com/1.0/auth/time", nil)
+	proxy, err := first.(*http.Transport).Proxy(req)
+	if err != nil || proxy.String() != "http://proxy.example.com:3128" {
+		t.Errorf("unexpected proxy %v, %v", proxy, err)
+	}
+
+	for _, invalid := range []string{"proxy.example.com:3128", "ftp://proxy.example.com", "http://"} {
+		if _, err := p.get(invalid, "OVH config"); err == nil {
+			t.Errorf("expected an error for %q", invalid)
+		}
+	}
+}
+
+func TestProxyTransportsTuned(t *testing.T) {
+	p := &proxyTransports{maxIdleConnsPerHost: 16, idleConnTimeout: time.Minute}
+	direct, err := p.get("", "OVH config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if direct == http.DefaultTransport {
+		t.Fatal("expected a tuned copy of the default transport")
+	}
+	if again, _ := p.get("", "OVH config"); again != direct {
+		t.Error("expected the tuned transport to be reused")
+	}
+	proxied, err := p.get("http://proxy.example.com:3128", "OVH config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, transport := range []http.RoundTripper{direct, proxied} {
+		tr := transport.(*http.Transport)
+		if tr.MaxIdleConnsPerHost != 16 || tr.IdleConnTimeout != time.Minute {
+			t.Errorf("unexpected settings %d, %v", tr.MaxIdleConnsPerHost, tr.IdleConnTimeout)
+		}
+	}
+	// The direct transport still honors the proxy environment variables.
+	if direct.(*http.Transport).Proxy == nil {
+		t.Error("expected the direct transport to keep the proxy from the environment")
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ovh/go-ovh/ovh"
+	"k8s.io/klog/v2"
+)
+
+// proxyCheckTimeout bounds the proxy check, so that a proxy dropping the
+// connections does not block the startup of the webhook.
+const proxyCheckTimeout = 30 * time.Second
+
+// proxyCheckFromEnv returns the proxy checked at startup as set by
+// PROXY_CHECK: true for the proxy of the environment (HTTPS_PROXY and
+// NO_PROXY), returned as an empty proxy, or the URL of a proxy, like the
+// httpProxy option of an issuer.
+func proxyCheckFromEnv() (proxy string, enabled bool, err error) {
+	value := os.Getenv("PROXY_CHECK")
+	if value == "" {
+		return "", false, nil
+	}
+	if enabled, err := strconv.ParseBool(value); err == nil {
+		return "", enabled, nil
+	}
+	if _, err := parseProxyURL(value, "PROXY_CHECK"); err != nil {
+		return "", false, fmt.Errorf("%v, or true for the proxy of the environment", err)
+	}
+	return value, true, nil
+}
+
+// checkProxy makes one call to the OVH API through proxy, the proxy of the
+// environment when empty, and tells apart in its error a proxy that cannot be
+// connected to, an OVH API that cannot be reached through the proxy and
+// credentials rejected by OVH. With the credentials of the webhook
+// environment, the call checks them with GET /auth/currentCredential; without
+// them, it only gets the time of the OVH API of OVH_ENDPOINT.
+func (s *ovhDNSProviderSolver) checkProxy(ctx context.Context, proxy string) error {
+	transport, err := s.proxies.get(proxy, "PROXY_CHECK")
+	if err != nil {
+		return err
+	}
+	via := "the proxy of the environment"
+	if proxy != "" {
+		// The proxy was validated by proxyCheckFromEnv.
+		u, _ := parseProxyURL(proxy, "PROXY_CHECK")
+		via = "proxy " + u.Redacted()
+	}
+	if len(s.httpHeaders) > 0 {
+		transport = &headerTransport{base: transport, headers: s.httpHeaders}
+	}
+
+	var endpoint string
+	client, err := ovh.NewDefaultClient()
+	if err == nil {
+		client.UserAgent = s.userAgent
+		client.Client.Transport = transport
+		var timeouts operationTimeouts
+		timeouts, err = resolveTimeouts(ovhTimeoutsConfig{}, s.timeouts)
+		if err != nil {
+			return err
+		}
+		api := newOVHAPI(client, timeouts, s.limiters.get(client))
+		endpoint = api.endpoint
+		err = api.checkCredential(ctx)
+	} else {
+		klog.Infof("No OVH credentials in the webhook environment, checking %s without them: %v", via, err)
+		endpoint, err = environmentEndpoint()
+		if err != nil {
+			return err
+		}
+		err = getAPITime(ctx, transport, endpoint)
+	}
+
+	switch {
+	case err == nil:
+		klog.Infof("Proxy check succeeded: reached the OVH API %s through %s", endpoint, via)
+		return nil
+	case isProxyConnectError(err):
+		return fmt.Errorf("proxy check failed: unable to connect to %s: %w", via, err)
+	case errorClass(err) == errorClassTransport:
+		return fmt.Errorf("proxy check failed: unable to reach the OVH API %s through %s: %w", endpoint, via, err)
+	case errorClass(err) == errorClassAuth || errors.Is(err, errCredentialNotValidated):
+		return fmt.Errorf("proxy check failed: reached the OVH API %s through %s, but OVH rejected the credentials of the webhook environment: %w", endpoint, via, err)
+	}
+	return fmt.Errorf("proxy check failed: the OVH API %s reached through %s returned an error: %w", endpoint, via, err)
+}
+
+// environmentEndpoint returns the base URL of the OVH API set by OVH_ENDPOINT,
+// ovh-eu by default.
+func environmentEndpoint() (string, error) {
+	endpoint := os.Getenv("OVH_ENDPOINT")
+	if endpoint == "" {
+		endpoint = ovh.OvhEU
+	}
+	endpoint, err := normalizeEndpoint(endpoint)
+	if err != nil {
+		return "", fmt.Errorf("invalid OVH_ENDPOINT: %v", err)
+	}
+	if url, ok := ovh.Endpoints[endpoint]; ok {
+		return url, nil
+	}
+	return endpoint, nil
+}
+
+// getAPITime gets the time of the OVH API, which needs no credentials.
+func getAPITime(ctx context.Context, transport http.RoundTripper, endpoint string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint+"/auth/time", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := (&http.Client{Transport: transport}).Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// isProxyConnectError returns whether err is a failure to connect to the
+// proxy itself, rather than to the OVH API through it.
+func isProxyConnectError(err error) bool {
+	var opErr *net.OpError
+	if !errors.As(err, &opErr) {
+		return false
+	}
+	if opErr.Op == "proxyconnect" {
+		return true
+	}
+	// A SOCKS proxy that cannot be dialed is reported within the error of the
+	// SOCKS connect command.
+	var dialErr *net.OpError
+	return strings.HasPrefix(opErr.Op, "socks") && errors.As(opErr.Err, &dialErr) && dialErr.Op == "dial"
+}
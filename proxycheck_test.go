@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"strings"
+	"testing"
+)
+
+func TestCheckProxy(t *testing.T) {
+	f := newFakeOVH(t, "example.com")
+	proxy := httptest.NewServer(&httputil.ReverseProxy{Director: func(*http.Request) {}})
+	t.Cleanup(proxy.Close)
+	t.Setenv("OVH_ENDPOINT", f.server.URL)
+	t.Setenv("OVH_APPLICATION_KEY", "key")
+	t.Setenv("OVH_APPLICATION_SECRET", "secret")
+	t.Setenv("OVH_CONSUMER_KEY", "consumer")
+	s := &ovhDNSProviderSolver{}
+	ctx := context.Background()
+
+	if err := s.checkProxy(ctx, proxy.URL); err != nil {
+		t.Fatal(err)
+	}
+	if n := f.countCalls("GET /auth/currentCredential"); n != 1 {
+		t.Errorf("expected the credentials to be checked through the proxy, got %d calls", n)
+	}
+
+	f.rejectedKeys["consumer"] = true
+	err := s.checkProxy(ctx, proxy.URL)
+	if err == nil || !strings.Contains(err.Error(), "OVH rejected the credentials") {
+		t.Errorf("expected the credentials to be rejected, got %v", err)
+	}
+
+	// Without credentials, only the connectivity is checked.
+	t.Setenv("OVH_APPLICATION_KEY", "")
+	if err := s.checkProxy(ctx, proxy.URL); err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := "http://" + listener.Addr().String()
+	listener.Close()
+	err = s.checkProxy(ctx, closed)
+	if err == nil || !strings.Contains(err.Error(), "unable to connect to proxy "+closed) {
+		t.Errorf("expected the proxy connection to fail, got %v", err)
+	}
+
+	// The proxy accepts the connection, but not the call.
+	dropping := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err == nil {
+			conn.Close()
+		}
+	}))
+	t.Cleanup(dropping.Close)
+	err = s.checkProxy(ctx, dropping.URL)
+	if err == nil || !strings.Contains(err.Error(), "unable to reach the OVH API") {
+		t.Errorf("expected the OVH API to be unreachable through the proxy, got %v", err)
+	}
+}
+
+func TestProxyCheckFromEnv(t *testing.T) {
+	for value, expected := range map[string]struct {
+		proxy   string
+		enabled bool
+	}{
+		"":                           {"", false},
+		"false":                      {"", false},
+		"true":                       {"", true},
+		"http://proxy.internal:3128": {"http://proxy.internal:3128", true},
+	} {
+		t.Setenv("PROXY_CHECK", value)
+		proxy, enabled, err := proxyCheckFromEnv()
+		if err != nil || proxy != expected.proxy || enabled != expected.enabled {
+			t.Errorf("proxyCheckFromEnv() with %q = %q, %v, %v", value, proxy, enabled, err)
+		}
+	}
+	t.Setenv("PROXY_CHECK", "ftp://proxy.internal")
+	if _, _, err := proxyCheckFromEnv(); err == nil || !strings.Contains(err.Error(), "in PROXY_CHECK") || strings.Contains(err.Error(), "OVH config") {
+		t.Errorf("expected an error for an invalid proxy in PROXY_CHECK, got %v", err)
+	}
+}
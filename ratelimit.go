@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ovh/go-ovh/ovh"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// rateLimitRemainingHeader and rateLimitResetHeader are the response
+	// headers describing the rate limit of the OVH API. The reset value is
+	// either a number of seconds or a Unix timestamp.
+	rateLimitRemainingHeader = "X-Ratelimit-Remaining"
+	rateLimitResetHeader     = "X-Ratelimit-Reset"
+	// rateLimitLowWatermark is the remaining budget below which the calls are
+	// delayed until the end of the rate limit window.
+	rateLimitLowWatermark = 5
+	// rateLimitMaxDelay bounds the delay applied to a single call.
+	rateLimitMaxDelay = time.Minute
+	// minUnixReset is the smallest reset value interpreted as a timestamp.
+	minUnixReset = 1000000000
+)
+
+// rateLimiters holds the rate limiter of each OVH account, as OVH reports the
+// rate limit of the credentials of each call. Its zero value is ready to use.
+type rateLimiters struct {
+	mu       sync.Mutex
+	limiters map[string]*rateLimiter
+	used     accessTimes[string]
+}
+
+// get returns the rate limiter of the credentials of client, shared by the
+// challenges using them.
+func (ls *rateLimiters) get(client *ovh.Client) *rateLimiter {
+	key := clientEndpoint(client) + "\n" + client.AppKey + "\n" + client.ConsumerKey
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	l, ok := ls.limiters[key]
+	ls.used.touch(key)
+	if !ok {
+		l = &rateLimiter{}
+		if ls.limiters == nil {
+			ls.limiters = map[string]*rateLimiter{}
+		}
+		ls.limiters[key] = l
+	}
+	return l
+}
+
+// takePauses returns the number of calls paused since its last call, across
+// the accounts.
+func (ls *rateLimiters) takePauses() int {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	pauses := 0
+	for _, l := range ls.limiters {
+		pauses += l.takePauses()
+	}
+	return pauses
+}
+
+// prune removes the rate limiters whose window has ended, which pause no
+// call: the next call of their account starts a new one.
+func (ls *rateLimiters) prune(now time.Time, max int) int {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	return pruneEntries(ls.limiters, ls.used, now, max, func(l *rateLimiter) time.Time {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		return l.reset
+	})
+}
+
+// rateLimiter tracks the rate limit reported by the OVH API for an account
+// and proactively pauses its calls when the budget is almost exhausted.
+type rateLimiter struct {
+	mu        sync.Mutex
+	known     bool
+	remaining int
+	reset     time.Time
+	// pauses counts the calls paused since the last status event.
+	pauses int
+}
+
+// update records the rate limit headers of a response.
+func (l *rateLimiter) update(header http.Header) {
+	remaining, err := strconv.Atoi(header.Get(rateLimitRemainingHeader))
+	if err != nil {
+		return
+	}
+	reset, err := strconv.ParseInt(header.Get(rateLimitResetHeader), 10, 64)
+	if err != nil {
+		return
+	}
+
+	now := time.Now()
+	resetTime := now.Add(time.Duration(reset) * time.Second)
+	if reset >= minUnixReset {
+		resetTime = time.Unix(reset, 0)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.known = true
+	l.remaining = remaining
+	l.reset = resetTime
+	rateLimitRemaining.Set(float64(remaining))
+}
+
+// takePauses returns the number of calls paused since its last call.
+func (l *rateLimiter) takePauses() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	pauses := l.pauses
+	l.pauses = 0
+	return pauses
+}
+
+// available returns whether a call can be made without waiting.
+func (l *rateLimiter) available() bool {
+	if l == nil {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return !l.known || l.remaining > rateLimitLowWatermark || !time.Now().Before(l.reset)
+}
+
+// wait blocks until the next call can be made.
+func (l *rateLimiter) wait(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+
+	l.mu.Lock()
+	delay := time.Duration(0)
+	if l.known && l.remaining <= rateLimitLowWatermark {
+		delay = time.Until(l.reset)
+	}
+	if delay > 0 {
+		l.pauses++
+	}
+	l.mu.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+	if delay > rateLimitMaxDelay {
+		delay = rateLimitMaxDelay
+	}
+	klog.V(2).Infof("OVH API rate limit almost reached, pausing for %v", delay)
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(delay):
+		return nil
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/ovh/go-ovh/ovh"
+)
+
+func TestRateLimiterPausesWhenBudgetIsLow(t *testing.T) {
+	l := &rateLimiter{}
+	header := http.Header{}
+	header.Set(rateLimitRemainingHeader, "100")
+	header.Set(rateLimitResetHeader, "60")
+	l.update(header)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := l.wait(ctx); err != nil {
+		t.Fatalf("unexpected pause with a high budget: %v", err)
+	}
+
+	header.Set(rateLimitRemainingHeader, "1")
+	header.Set(rateLimitResetHeader, strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10))
+	l.update(header)
+	if err := l.wait(ctx); err == nil {
+		t.Fatal("expected a pause with a low budget")
+	}
+}
+
+func TestRateLimitersPerAccount(t *testing.T) {
+	ls := &rateLimiters{}
+	clients := []*ovh.Client{}
+	for _, consumerKey := range []string{"exhausted", "fresh"} {
+		client, err := ovh.NewClient("https://eu.api.ovh.com/1.0", "key", "secret", consumerKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		clients = append(clients, client)
+	}
+	if ls.get(clients[0]) != ls.get(clients[0]) {
+		t.Fatal("expected a single rate limiter per account")
+	}
+	header := http.Header{}
+	header.Set(rateLimitRemainingHeader, "0")
+	header.Set(rateLimitResetHeader, "3600")
+	ls.get(clients[0]).update(header)
+
+	// The exhausted budget of an account does not pause the others.
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := ls.get(clients[1]).wait(ctx); err != nil {
+		t.Errorf("unexpected pause of another account: %v", err)
+	}
+	if err := ls.get(clients[0]).wait(ctx); err == nil {
+		t.Error("expected a pause of the exhausted account")
+	}
+	if n := ls.takePauses(); n != 1 {
+		t.Errorf("expected 1 pause, got %d", n)
+	}
+}
+
+func TestRateLimiterIgnoresMissingHeaders(t *testing.T) {
+	l := &rateLimiter{}
+	l.update(http.Header{})
+	if l.known {
+		t.Error("rate limit should be unknown")
+	}
+	if err := l.wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRateLimitPauseIsNotBoundByCallTimeout(t *testing.T) {
+	f := newFakeOVH(t, "example.com")
+	api := f.api()
+	api.limiter = &rateLimiter{known: true, remaining: 0, reset: time.Now().Add(200 * time.Millisecond)}
+	api.timeouts[operationList] = 100 * time.Millisecond
+
+	if _, err := listRecords(context.Background(), api, "example.com", "TXT", "_acme-challenge"); err != nil {
+		t.Fatalf("the rate limit pause should not count against the call timeout: %v", err)
+	}
+}
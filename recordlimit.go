@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"k8s.io/klog/v2"
+)
+
+// createAfterRecordLimit handles the refused creation of the challenge record
+// of a zone holding its maximum number of records. With the sweepOnRecordLimit
+// option, it deletes the leftover records of the zone and creates the record
+// again. Otherwise, or if the zone is still full, it returns an error telling
+// to clean up the zone, as the limit is usually reached by piled up records.
+func createAfterRecordLimit(ctx context.Context, api *ovhAPI, cfg *ovhDNSProviderConfig, domain, subDomain, target string, ttl int, limitErr error) (*ovhZoneRecord, error) {
+	recordLimitsReached.WithLabelValues(sensitiveLabel(domain)).Inc()
+	if cfg.SweepOnRecordLimit && api.records != nil {
+		swept, err := sweepLeftoverRecords(ctx, api, domain)
+		if err != nil {
+			klog.Warningf("Unable to delete the leftover records of OVH zone %s, which holds its maximum number of records: %v", domain, err)
+		}
+		if swept > 0 {
+			klog.Infof("Deleted %d leftover records of OVH zone %s, which holds its maximum number of records", swept, domain)
+			record, err := createRecord(ctx, api, domain, "TXT", subDomain, txtRecordTarget(target), ttl)
+			if !isRecordLimitReached(err) {
+				return record, err
+			}
+			limitErr = err
+		}
+	}
+	return nil, fmt.Errorf("OVH zone %s holds its maximum number of records, the TXT record for %s cannot be created: delete the records the zone no longer needs, such as leftover _acme-challenge TXT records, or enable sweepOnRecordLimit to delete the leftover records of the webhook: %w", domain, subDomain, limitErr)
+}
+
+// sweepLeftoverRecords deletes the leftover TXT records of the zone, i.e. the
+// records of finished challenges whose cleanup was skipped or failed, and
+// returns how many it deleted. The records the webhook did not create are
+// never deleted. The deletions are deployed by the next refresh of the zone.
+// When a deletion fails, the leftover records not deleted yet are put back in
+// the record store, so that the next sweep deletes them.
+func sweepLeftoverRecords(ctx context.Context, api *ovhAPI, domain string) (swept int, err error) {
+	defer func() {
+		if err != nil {
+			leftoverSweepFailures.WithLabelValues(sensitiveLabel(domain)).Inc()
+		}
+	}()
+	ids, err := api.getIDs(ctx, operationList, "/domain/zone/"+domain+"/record?fieldType=TXT")
+	if err != nil || len(ids) == 0 {
+		return 0, err
+	}
+	// The records are deleted in the order they were created, like claim
+	// reuses them.
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	leftovers, err := api.records.takeLeftovers(ctx, ids)
+	if err != nil {
+		return 0, err
+	}
+	leftoverRecordsDetected.WithLabelValues(sensitiveLabel(domain)).Add(float64(len(leftovers)))
+	for i, id := range leftovers {
+		err := deleteRecord(ctx, api, domain, id)
+		switch {
+		case isAPIError(err, http.StatusNotFound):
+			klog.V(2).Infof("Leftover TXT record %d of zone %s was already deleted", id, domain)
+		case err != nil:
+			api.records.restoreLeftovers(ctx, leftovers[i:])
+			return swept, err
+		default:
+			swept++
+			leftoverRecordsSwept.WithLabelValues(sensitiveLabel(domain)).Inc()
+			klog.V(2).Infof("Deleted leftover TXT record %d of zone %s", id, domain)
+		}
+	}
+	return swept, nil
+}
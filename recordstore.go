@@ -0,0 +1,440 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog/v2"
+)
+
+// recordMaxAge is how long the ID of a record is kept, in memory and in the
+// ConfigMap, and how long a leftover record may be reused. Entries are
+// normally removed by CleanUp, which cert-manager may never call, e.g. when a
+// challenge is deleted while the webhook is down: old entries are removed so
+// that the memory used and the ConfigMap, bounded to 1 MiB, stay small.
+const recordMaxAge = 7 * 24 * time.Hour
+
+// recordStore remembers the IDs of the records created by Present, so that
+// CleanUp deletes exactly these records instead of listing and matching the
+// records of the subdomain. The IDs are kept in memory and, optionally,
+// persisted in a ConfigMap to survive restarts of the webhook.
+type recordStore struct {
+	mu      sync.Mutex
+	entries map[string]recordEntry
+	// leftovers holds, with the time they were left, the IDs of the records
+	// of finished challenges that may still exist in their zone because their
+	// cleanup was skipped or failed. They are the only records that the upsert
+	// option replaces.
+	leftovers map[int64]time.Time
+	// used holds the last use of the entries, for the cache janitor.
+	used accessTimes[string]
+
+	// client, namespace and name identify the ConfigMap used for persistence.
+	// Persistence is disabled when client is nil.
+	client    kubernetes.Interface
+	namespace string
+	name      string
+}
+
+type recordEntry struct {
+	id      int64
+	created time.Time
+}
+
+// newRecordStore returns a record store persisted in the ConfigMap identified
+// by ref ("<namespace>/<name>"), or an in-memory store if ref is empty.
+func newRecordStore(client kubernetes.Interface, ref string) (*recordStore, error) {
+	store := &recordStore{entries: map[string]recordEntry{}, leftovers: map[int64]time.Time{}}
+	if ref == "" {
+		return store, nil
+	}
+	namespace, name, ok := strings.Cut(ref, "/")
+	if !ok || namespace == "" || name == "" {
+		return nil, fmt.Errorf("invalid RECORD_STORE_CONFIGMAP %q: expected <namespace>/<name>", ref)
+	}
+	store.client = client
+	store.namespace = namespace
+	store.name = name
+	return store, nil
+}
+
+// recordKey identifies a challenge record. The target is hashed so that the key
+// is a valid ConfigMap key and does not expose the challenge token.
+func recordKey(domain, subDomain, target string) string {
+	sum := sha256.Sum256([]byte(normalizeName(domain) + "\n" + subDomain + "\n" + target))
+	return hex.EncodeToString(sum[:])
+}
+
+// leftoverKey is the ConfigMap key of a leftover record. It cannot collide
+// with the record keys, which are hexadecimal.
+func leftoverKey(id int64) string {
+	return "leftover." + strconv.FormatInt(id, 10)
+}
+
+// recordValue is the ConfigMap value of a record key: the ID of the record and
+// the time it was stored, so that the keys whose CleanUp never ran expire.
+func recordValue(id int64, created time.Time) string {
+	return strconv.FormatInt(id, 10) + "@" + created.Format(time.RFC3339)
+}
+
+// parseRecordValue parses a recordValue. The values stored by earlier versions
+// hold only the ID, and have a zero time.
+func parseRecordValue(value string) (int64, time.Time, error) {
+	idValue, createdValue, stamped := strings.Cut(value, "@")
+	id, err := strconv.ParseInt(idValue, 10, 64)
+	if err != nil || !stamped {
+		return id, time.Time{}, err
+	}
+	created, err := time.Parse(time.RFC3339, createdValue)
+	return id, created, err
+}
+
+// pruneRecordData removes from the data of the ConfigMap the record keys and
+// the leftover records stored more than recordMaxAge before now, and returns
+// whether it changed the data. The record keys of earlier versions, which
+// have no time, are stamped with now to expire in turn.
+func pruneRecordData(data map[string]string, now time.Time) bool {
+	changed := false
+	for k, value := range data {
+		var stored time.Time
+		var err error
+		if strings.HasPrefix(k, "leftover.") {
+			stored, err = time.Parse(time.RFC3339, value)
+		} else {
+			var id int64
+			id, stored, err = parseRecordValue(value)
+			if err == nil && stored.IsZero() {
+				data[k] = recordValue(id, now)
+				changed = true
+				continue
+			}
+		}
+		if err == nil && now.Sub(stored) > recordMaxAge {
+			delete(data, k)
+			changed = true
+		}
+	}
+	return changed
+}
+
+func (rs *recordStore) get(ctx context.Context, key string) (int64, bool) {
+	if rs == nil {
+		return 0, false
+	}
+	rs.mu.Lock()
+	entry, ok := rs.entries[key]
+	rs.used.touch(key)
+	rs.mu.Unlock()
+	if ok || rs.client == nil {
+		return entry.id, ok
+	}
+
+	cm, err := rs.client.CoreV1().ConfigMaps(rs.namespace).Get(ctx, rs.name, metav1.GetOptions{})
+	if err != nil {
+		if !apierrors.IsNotFound(err) {
+			klog.Warningf("Unable to read record IDs from ConfigMap %s/%s: %v", rs.namespace, rs.name, err)
+		}
+		return 0, false
+	}
+	id, _, err := parseRecordValue(cm.Data[key])
+	if err != nil {
+		return 0, false
+	}
+	return id, true
+}
+
+func (rs *recordStore) put(ctx context.Context, key string, id int64) {
+	if rs == nil {
+		return
+	}
+	now := time.Now()
+	rs.mu.Lock()
+	for k, entry := range rs.entries {
+		if now.Sub(entry.created) > recordMaxAge {
+			delete(rs.entries, k)
+		}
+	}
+	rs.entries[key] = recordEntry{id: id, created: now}
+	rs.used.touch(key)
+	rs.mu.Unlock()
+	rs.persist(ctx, func(data map[string]string) bool {
+		pruneRecordData(data, now)
+		data[key] = recordValue(id, now)
+		return true
+	})
+}
+
+// prune removes the entries and the leftover records older than recordMaxAge
+// and, beyond max of each, the entries used the longest ago and the oldest
+// leftover records. The ConfigMap is pruned by its own updates: CleanUp reads
+// the IDs evicted from the memory back from it, or matches the records of the
+// subdomain without it.
+func (rs *recordStore) prune(now time.Time, max int) int {
+	if rs == nil {
+		return 0
+	}
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	n := pruneEntries(rs.entries, rs.used, now, max, func(entry recordEntry) time.Time {
+		return entry.created.Add(recordMaxAge)
+	})
+	n += pruneEntries(rs.leftovers, nil, now, max, func(left time.Time) time.Time {
+		return left.Add(recordMaxAge)
+	})
+	rs.noteLeftovers()
+	return n
+}
+
+// managed returns whether the record of id was created by the webhook, as
+// known by this replica: a record of a running challenge or a leftover record.
+func (rs *recordStore) managed(id int64) bool {
+	if rs == nil {
+		return false
+	}
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if _, ok := rs.leftovers[id]; ok {
+		return true
+	}
+	for _, entry := range rs.entries {
+		if entry.id == id {
+			return true
+		}
+	}
+	return false
+}
+
+// noteLeftovers reports the number of leftover records in the leftover_records
+// metric. The caller holds rs.mu.
+func (rs *recordStore) noteLeftovers() {
+	leftoverRecords.Set(float64(len(rs.leftovers)))
+}
+
+// leftoverCount returns the number of leftover records known by this replica.
+func (rs *recordStore) leftoverCount() int {
+	if rs == nil {
+		return 0
+	}
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	return len(rs.leftovers)
+}
+
+// putSince returns whether Present recorded the record of key after t. Only
+// the records put by this replica are known.
+func (rs *recordStore) putSince(key string, t time.Time) bool {
+	if rs == nil {
+		return false
+	}
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	entry, ok := rs.entries[key]
+	return ok && entry.created.After(t)
+}
+
+// release forgets the record of a finished challenge. If leftover is true,
+// the record may still exist in the zone and becomes a leftover that the
+// upsert option can reuse.
+func (rs *recordStore) release(ctx context.Context, key string, leftover bool) {
+	if rs == nil {
+		return
+	}
+	id, ok := rs.get(ctx, key)
+	leftover = leftover && ok
+	now := time.Now()
+	rs.mu.Lock()
+	delete(rs.entries, key)
+	for leftID, left := range rs.leftovers {
+		if now.Sub(left) > recordMaxAge {
+			delete(rs.leftovers, leftID)
+		}
+	}
+	if leftover {
+		rs.leftovers[id] = now
+	}
+	rs.noteLeftovers()
+	rs.mu.Unlock()
+	rs.persist(ctx, func(data map[string]string) bool {
+		delete(data, key)
+		pruneRecordData(data, now)
+		if leftover {
+			data[leftoverKey(id)] = now.Format(time.RFC3339)
+		}
+		return true
+	})
+}
+
+// claim assigns to the challenge identified by key the first leftover record
+// among ids, the records of its subdomain, and returns its ID, or 0 if none of
+// them is a leftover. The claim is atomic, across the replicas sharing the
+// ConfigMap as well, so that two challenges never get the same record. It
+// fails if the ConfigMap cannot be updated: the records then cannot be told
+// apart from the ones in use.
+func (rs *recordStore) claim(ctx context.Context, key string, ids []int64) (int64, error) {
+	if rs == nil {
+		return 0, nil
+	}
+	ids = append([]int64{}, ids...)
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	if rs.client == nil {
+		rs.mu.Lock()
+		defer rs.mu.Unlock()
+		for _, id := range ids {
+			if _, ok := rs.leftovers[id]; ok {
+				delete(rs.leftovers, id)
+				rs.noteLeftovers()
+				rs.entries[key] = recordEntry{id: id, created: time.Now()}
+				rs.used.touch(key)
+				return id, nil
+			}
+		}
+		return 0, nil
+	}
+
+	var claimed int64
+	err := rs.update(ctx, func(data map[string]string) bool {
+		claimed = 0
+		for _, id := range ids {
+			if _, ok := data[leftoverKey(id)]; ok {
+				claimed = id
+				delete(data, leftoverKey(id))
+				data[key] = recordValue(id, time.Now())
+				return true
+			}
+		}
+		return false
+	})
+	if err != nil {
+		return 0, fmt.Errorf("unable to claim a leftover record in ConfigMap %s/%s: %w", rs.namespace, rs.name, err)
+	}
+	if claimed != 0 {
+		rs.mu.Lock()
+		delete(rs.leftovers, claimed)
+		rs.noteLeftovers()
+		rs.entries[key] = recordEntry{id: claimed, created: time.Now()}
+		rs.used.touch(key)
+		rs.mu.Unlock()
+	}
+	return claimed, nil
+}
+
+// takeLeftovers removes the leftover records among ids from the store and
+// returns their IDs, so that the reconcile option deletes them. Like claim, it
+// is atomic across the replicas and fails if the ConfigMap cannot be updated.
+func (rs *recordStore) takeLeftovers(ctx context.Context, ids []int64) ([]int64, error) {
+	if rs == nil {
+		return nil, nil
+	}
+	taken := []int64{}
+	if rs.client == nil {
+		rs.mu.Lock()
+		defer rs.mu.Unlock()
+		for _, id := range ids {
+			if _, ok := rs.leftovers[id]; ok {
+				delete(rs.leftovers, id)
+				taken = append(taken, id)
+			}
+		}
+		rs.noteLeftovers()
+		return taken, nil
+	}
+
+	err := rs.update(ctx, func(data map[string]string) bool {
+		taken = []int64{}
+		for _, id := range ids {
+			if _, ok := data[leftoverKey(id)]; ok {
+				delete(data, leftoverKey(id))
+				taken = append(taken, id)
+			}
+		}
+		return len(taken) > 0
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to take the leftover records in ConfigMap %s/%s: %w", rs.namespace, rs.name, err)
+	}
+	rs.mu.Lock()
+	for _, id := range taken {
+		delete(rs.leftovers, id)
+	}
+	rs.noteLeftovers()
+	rs.mu.Unlock()
+	return taken, nil
+}
+
+// restoreLeftovers puts back the leftover records among the ones taken by
+// takeLeftovers that were not deleted.
+func (rs *recordStore) restoreLeftovers(ctx context.Context, ids []int64) {
+	if rs == nil || len(ids) == 0 {
+		return
+	}
+	now := time.Now()
+	rs.mu.Lock()
+	for _, id := range ids {
+		rs.leftovers[id] = now
+	}
+	rs.noteLeftovers()
+	rs.mu.Unlock()
+	rs.persist(ctx, func(data map[string]string) bool {
+		for _, id := range ids {
+			data[leftoverKey(id)] = now.Format(time.RFC3339)
+		}
+		return true
+	})
+}
+
+// persist applies update to the data of the ConfigMap. Failures are only
+// logged: CleanUp falls back to matching the records when an ID is missing.
+func (rs *recordStore) persist(ctx context.Context, update func(data map[string]string) bool) {
+	if rs.client == nil {
+		return
+	}
+	err := rs.update(ctx, update)
+	if err != nil {
+		klog.Warningf("Unable to persist record IDs in ConfigMap %s/%s: %v", rs.namespace, rs.name, err)
+	}
+}
+
+// update applies fn to the data of the ConfigMap, creating it if needed, and
+// retries on conflicts. fn returns whether it changed the data.
+func (rs *recordStore) update(ctx context.Context, fn func(data map[string]string) bool) error {
+	configMaps := rs.client.CoreV1().ConfigMaps(rs.namespace)
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		cm, err := configMaps.Get(ctx, rs.name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			cm = &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: rs.namespace, Name: rs.name}}
+			cm.Data = map[string]string{}
+			if !fn(cm.Data) {
+				return nil
+			}
+			_, err = configMaps.Create(ctx, cm, metav1.CreateOptions{})
+			if apierrors.IsAlreadyExists(err) {
+				return apierrors.NewConflict(corev1.Resource("configmaps"), rs.name, err)
+			}
+			return err
+		}
+		if err != nil {
+			return err
+		}
+		if cm.Data == nil {
+			cm.Data = map[string]string{}
+		}
+		if !fn(cm.Data) {
+			return nil
+		}
+		_, err = configMaps.Update(ctx, cm, metav1.UpdateOptions{})
+		return err
+	})
+}
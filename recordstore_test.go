@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func newTestRecordStore(t *testing.T, client *fake.Clientset) *recordStore {
+	rs, err := newRecordStore(client, "cert-manager/records")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rs
+}
+
+// storedIDs returns the data of the ConfigMap, with the IDs of the record
+// keys without the time they were stored.
+func storedIDs(t *testing.T, client *fake.Clientset) map[string]string {
+	cm, err := client.CoreV1().ConfigMaps("cert-manager").Get(context.Background(), "records", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, value := range cm.Data {
+		cm.Data[key], _, _ = strings.Cut(value, "@")
+	}
+	return cm.Data
+}
+
+func TestRecordStorePersists(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	ctx := context.Background()
+	key := recordKey("example.com", "_acme-challenge", "key")
+	newTestRecordStore(t, client).put(ctx, key, 42)
+
+	if data := storedIDs(t, client); data[key] != "42" {
+		t.Errorf("ID not persisted: %v", data)
+	}
+
+	// A restarted webhook reads the IDs back from the ConfigMap.
+	restarted := newTestRecordStore(t, client)
+	if id, ok := restarted.get(ctx, key); !ok || id != 42 {
+		t.Errorf("get = %d, %v, expected 42 from the ConfigMap", id, ok)
+	}
+	restarted.release(ctx, key, false)
+	if data := storedIDs(t, client); len(data) != 0 {
+		t.Errorf("ID not deleted from the ConfigMap: %v", data)
+	}
+	if _, ok := newTestRecordStore(t, client).get(ctx, key); ok {
+		t.Error("deleted ID still found")
+	}
+}
+
+func TestRecordStorePersistRetriesConflicts(t *testing.T) {
+	client := fake.NewSimpleClientset(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "cert-manager", Name: "records"},
+		Data:       map[string]string{"other": "1"},
+	})
+	conflicts := 1
+	client.PrependReactor("update", "configmaps", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if conflicts == 0 {
+			return false, nil, nil
+		}
+		conflicts--
+		return true, nil, apierrors.NewConflict(corev1.Resource("configmaps"), "records", nil)
+	})
+
+	newTestRecordStore(t, client).put(context.Background(), "key", 2)
+	if data := storedIDs(t, client); data["key"] != "2" || data["other"] != "1" {
+		t.Errorf("unexpected IDs after a conflict: %v", data)
+	}
+}
+
+func TestRecordStorePersistRetriesCreateRace(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	// Another replica creates the ConfigMap between the read and the create.
+	raced := false
+	client.PrependReactor("create", "configmaps", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if raced {
+			return false, nil, nil
+		}
+		raced = true
+		cm := &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "cert-manager", Name: "records"},
+			Data:       map[string]string{"other": "1"},
+		}
+		if err := client.Tracker().Add(cm); err != nil {
+			t.Fatal(err)
+		}
+		return true, nil, apierrors.NewAlreadyExists(corev1.Resource("configmaps"), "records")
+	})
+
+	newTestRecordStore(t, client).put(context.Background(), "key", 2)
+	if data := storedIDs(t, client); data["key"] != "2" || data["other"] != "1" {
+		t.Errorf("unexpected IDs after a create race: %v", data)
+	}
+}
+
+func TestRecordStoreForgetsOldEntries(t *testing.T) {
+	rs, err := newRecordStore(nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	rs.put(ctx, "old", 1)
+	rs.entries["old"] = recordEntry{id: 1, created: time.Now().Add(-recordMaxAge - time.Minute)}
+	rs.put(ctx, "new", 2)
+
+	if _, ok := rs.get(ctx, "old"); ok {
+		t.Error("old entry was kept")
+	}
+	if id, ok := rs.get(ctx, "new"); !ok || id != 2 {
+		t.Errorf("get = %d, %v, expected 2", id, ok)
+	}
+}
+
+func TestRecordStorePrunesStaleKeys(t *testing.T) {
+	stale := time.Now().Add(-recordMaxAge - time.Minute)
+	client := fake.NewSimpleClientset(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "cert-manager", Name: "records"},
+		Data: map[string]string{
+			// The CleanUp of this record never ran.
+			"stale":  recordValue(1, stale),
+			"legacy": "2",
+		},
+	})
+	ctx := context.Background()
+	newTestRecordStore(t, client).put(ctx, "new", 3)
+
+	cm, err := client.CoreV1().ConfigMaps("cert-manager").Get(ctx, "records", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cm.Data["stale"]; ok {
+		t.Error("expected the stale record key to be pruned")
+	}
+	// A key of an earlier version gets the time of the prune, to expire
+	// recordMaxAge later.
+	if id, created, err := parseRecordValue(cm.Data["legacy"]); err != nil || id != 2 || created.IsZero() {
+		t.Errorf("expected the legacy key to be stamped, got %q", cm.Data["legacy"])
+	}
+	if id, ok := newTestRecordStore(t, client).get(ctx, "new"); !ok || id != 3 {
+		t.Errorf("get = %d, %v, expected 3 from the ConfigMap", id, ok)
+	}
+}
+
+func TestRecordStoreClaimsLeftovers(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	ctx := context.Background()
+	rs := newTestRecordStore(t, client)
+	rs.put(ctx, "done", 1)
+	rs.put(ctx, "failed", 2)
+	rs.put(ctx, "running", 3)
+	rs.release(ctx, "done", false)
+	rs.release(ctx, "failed", true)
+
+	// Another replica only knows the leftovers from the ConfigMap.
+	replica := newTestRecordStore(t, client)
+	id, err := replica.claim(ctx, "new", []int64{1, 2, 3, 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != 2 {
+		t.Errorf("claimed record %d, expected the leftover record 2", id)
+	}
+	if id, _ := rs.claim(ctx, "other", []int64{1, 2, 3, 4}); id != 0 {
+		t.Errorf("record %d claimed twice", id)
+	}
+	if data := storedIDs(t, client); data["new"] != "2" || data[leftoverKey(2)] != "" {
+		t.Errorf("claim not persisted: %v", data)
+	}
+}
+
+func TestRecordStoreClaimFailsWithoutConfigMap(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	client.PrependReactor("get", "configmaps", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, apierrors.NewForbidden(corev1.Resource("configmaps"), "records", nil)
+	})
+	if _, err := newTestRecordStore(t, client).claim(context.Background(), "key", []int64{1}); err == nil {
+		t.Error("expected an error when the ConfigMap cannot be read")
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// defaultRefreshWindow is the default coalescing window of the zone
+// refreshes.
+const defaultRefreshWindow = 2 * time.Second
+
+const (
+	// refreshFailureFail and refreshFailureTolerate are the values of the
+	// refreshFailure option, which controls what happens to the challenges
+	// whose zone refresh failed: they fail, or the refresh is retried once
+	// and they succeed even if the retry fails.
+	refreshFailureFail     = "fail"
+	refreshFailureTolerate = "tolerate"
+)
+
+// refreshOutcome is what refreshRecords did to deploy the changes of a zone.
+type refreshOutcome string
+
+const (
+	// refreshPerformed is a refresh requested from OVH.
+	refreshPerformed refreshOutcome = "performed"
+	// refreshCoalesced is a refresh that joined another one requested within
+	// the refresh window.
+	refreshCoalesced refreshOutcome = "coalesced"
+	// refreshNotNeeded is a refresh skipped because the zone deploys its
+	// changes by itself.
+	refreshNotNeeded refreshOutcome = "not needed"
+	// refreshFailed is a refresh that returned an error.
+	refreshFailed refreshOutcome = "failed"
+)
+
+// refreshCoalescer merges the refreshes of a zone requested within a short
+// window into a single OVH API call. Each refresh of a zone triggers a new
+// deployment task on OVH side, so issuing one refresh for many concurrent
+// challenges reduces both the API calls and the load on the zone.
+type refreshCoalescer struct {
+	mu      sync.Mutex
+	pending map[string]*refreshBatch
+	// refreshed holds the time of the last refresh of each zone, for the
+	// detection of the zones that deploy changes by themselves.
+	refreshed map[string]time.Time
+	used      accessTimes[string]
+}
+
+type refreshBatch struct {
+	done chan struct{}
+	err  error
+}
+
+// refresh calls fn once the window has elapsed, unless a refresh with the
+// same key is already waiting, in which case the caller joins it and refresh
+// returns true. The changes made by all the callers of a batch are done before
+// the batch is started, so a single call of fn deploys all of them. Since the
+// joiners rely on the fn of the first caller, the key must identify the zone
+// and the account used to refresh it.
+func (c *refreshCoalescer) refresh(ctx context.Context, key string, window time.Duration, fn func(ctx context.Context) error) (bool, error) {
+	if c == nil || window == 0 {
+		return false, fn(ctx)
+	}
+
+	c.mu.Lock()
+	if c.pending == nil {
+		c.pending = map[string]*refreshBatch{}
+	}
+	batch, ok := c.pending[key]
+	if !ok {
+		batch = &refreshBatch{done: make(chan struct{})}
+		c.pending[key] = batch
+		// The batch must not be canceled along with the caller that started it.
+		batchCtx := context.WithoutCancel(ctx)
+		go func() {
+			time.Sleep(window)
+			c.mu.Lock()
+			delete(c.pending, key)
+			c.mu.Unlock()
+			batch.err = fn(batchCtx)
+			close(batch.done)
+		}()
+	}
+	c.mu.Unlock()
+
+	select {
+	case <-ctx.Done():
+		return ok, ctx.Err()
+	case <-batch.done:
+		return ok, batch.err
+	}
+}
+
+// noteRefresh records that the zone is being refreshed.
+func (c *refreshCoalescer) noteRefresh(domain string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.refreshed == nil {
+		c.refreshed = map[string]time.Time{}
+	}
+	c.refreshed[normalizeName(domain)] = time.Now()
+	c.used.touch(normalizeName(domain))
+}
+
+// prune removes the refresh times older than autoRefreshCacheTTL, which the
+// detections of the refresh mode, lasting a few seconds, no longer ask about.
+// The pending refreshes are kept.
+func (c *refreshCoalescer) prune(now time.Time, max int) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return pruneEntries(c.refreshed, c.used, now, max, func(last time.Time) time.Time {
+		return last.Add(autoRefreshCacheTTL)
+	})
+}
+
+// zoneSOA is the SOA record of a zone, as returned by OVH.
+type zoneSOA struct {
+	Serial int64 `json:"serial"`
+	// NXDomainTTL is the MINIMUM field of the SOA record.
+	NXDomainTTL int `json:"nxDomainTtl"`
+}
+
+func getZoneSOA(ctx context.Context, api *ovhAPI, domain string) (zoneSOA, error) {
+	soa := zoneSOA{}
+	err := api.get(ctx, operationList, "/domain/zone/"+domain+"/soa", &soa)
+	return soa, err
+}
+
+func getZoneSerial(ctx context.Context, api *ovhAPI, domain string) (int64, error) {
+	soa, err := getZoneSOA(ctx, api, domain)
+	return soa.Serial, err
+}
+
+// waitForZoneSerial polls the serial of the zone until it advances past the
+// serial it had before a refresh, for up to serialWaitTimeout. A serial that
+// does not advance, reported in the logs and the unchanged_zone_serials_total
+// metric, indicates that OVH did not deploy the changes of the zone. It is not
+// an error: the propagation checks tell whether the record was published.
+func waitForZoneSerial(ctx context.Context, api *ovhAPI, domain string, before int64) {
+	deadline := time.Now().Add(serialWaitTimeout)
+	for {
+		serial, err := getZoneSerial(ctx, api, domain)
+		if err != nil {
+			klog.Warningf("Unable to verify the refresh of OVH zone %s: %v", domain, err)
+			return
+		}
+		if serial != before {
+			klog.V(2).Infof("Serial of OVH zone %s advanced from %d to %d after its refresh", domain, before, serial)
+			return
+		}
+		if !time.Now().Add(taskPollInterval).Before(deadline) {
+			klog.Warningf("Serial of OVH zone %s is still %d %v after its refresh: the changes of the zone may not be deployed", domain, serial, serialWaitTimeout)
+			unchangedZoneSerials.WithLabelValues(sensitiveLabel(domain)).Inc()
+			return
+		}
+		select {
+		case <-ctx.Done():
+			klog.Warningf("Verification of the refresh of OVH zone %s interrupted: %v", domain, ctx.Err())
+			return
+		case <-time.After(taskPollInterval):
+		}
+	}
+}
+
+// refreshedSince returns whether the zone was refreshed since the given time.
+func (c *refreshCoalescer) refreshedSince(domain string, since time.Time) bool {
+	if c == nil {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	last, ok := c.refreshed[normalizeName(domain)]
+	c.used.touch(normalizeName(domain))
+	return ok && !last.Before(since)
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRefreshCoalescerMergesConcurrentRefreshes(t *testing.T) {
+	c := &refreshCoalescer{}
+	var calls int32
+	fn := func(ctx context.Context) error {
+		atomic.AddInt32(&calls, 1)
+		return nil
+	}
+
+	var wg sync.WaitGroup
+	var joined int32
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			coalesced, err := c.refresh(context.Background(), "example.com", 50*time.Millisecond, fn)
+			if err != nil {
+				t.Error(err)
+			}
+			if coalesced {
+				atomic.AddInt32(&joined, 1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if calls != 1 {
+		t.Errorf("expected a single refresh, got %d", calls)
+	}
+	if joined != 4 {
+		t.Errorf("expected 4 coalesced refreshes, got %d", joined)
+	}
+}
+
+func TestRefreshCoalescerWithoutWindow(t *testing.T) {
+	c := &refreshCoalescer{}
+	var calls int32
+	fn := func(ctx context.Context) error {
+		atomic.AddInt32(&calls, 1)
+		return nil
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := c.refresh(context.Background(), "example.com", 0, fn); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if calls != 3 {
+		t.Errorf("expected 3 refreshes, got %d", calls)
+	}
+}
+
+func TestRefreshSkippedForAutoRefreshZones(t *testing.T) {
+	f := newFakeOVH(t, "example.com", "example.org")
+	api := f.api()
+	api.autoRefresh = &autoRefreshDetector{}
+	api.autoRefresh.set("Example.com.", true)
+	api.autoRefresh.set("example.org", false)
+
+	for domain, expected := range map[string]refreshOutcome{"example.com": refreshNotNeeded, "example.org": refreshPerformed} {
+		outcome, err := refreshRecords(context.Background(), api, domain)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if outcome != expected {
+			t.Errorf("refresh of %s %s, expected %s", domain, outcome, expected)
+		}
+	}
+	if n := f.countCalls("POST /domain/zone/example.com/refresh"); n != 0 {
+		t.Errorf("auto-refresh zone refreshed %d times", n)
+	}
+	if n := f.countCalls("POST /domain/zone/example.org/refresh"); n != 1 {
+		t.Errorf("zone refreshed %d times, want 1", n)
+	}
+}
+
+func TestRefreshVerifySerial(t *testing.T) {
+	shortenTaskPollInterval(t)
+	timeout := serialWaitTimeout
+	serialWaitTimeout = 20 * time.Millisecond
+	defer func() { serialWaitTimeout = timeout }()
+	f := newFakeOVH(t, "example.com", "example.org")
+	f.ignoredRefreshes["example.org"] = true
+	api := f.api()
+	api.verifySerial = true
+
+	for _, domain := range []string{"example.com", "example.org"} {
+		if _, err := refreshRecords(context.Background(), api, domain); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := f.countCalls("GET /domain/zone/example.com/soa"); n != 2 {
+		t.Errorf("expected the serial to be fetched before and after the refresh, got %d calls", n)
+	}
+	if n := f.countCalls("GET /domain/zone/example.org/soa"); n < 3 {
+		t.Errorf("expected the unchanged serial to be polled, got %d calls", n)
+	}
+	if n := testutil.ToFloat64(unchangedZoneSerials.WithLabelValues("example.com")); n != 0 {
+		t.Errorf("expected no unchanged serial for the refreshed zone, got %v", n)
+	}
+	if n := testutil.ToFloat64(unchangedZoneSerials.WithLabelValues("example.org")); n != 1 {
+		t.Errorf("expected 1 unchanged serial, got %v", n)
+	}
+}
+
+func TestRefreshFailure(t *testing.T) {
+	f := newFakeOVH(t, "example.com")
+	call := "POST /domain/zone/example.com/refresh"
+	api := f.api()
+	f.fail(call, http.StatusBadRequest)
+	if outcome, err := refreshRecords(context.Background(), api, "example.com"); err == nil || outcome != refreshFailed {
+		t.Errorf("expected the refresh to fail, got %s, %v", outcome, err)
+	}
+
+	// A failed refresh is retried once.
+	api.refreshFailure = refreshFailureTolerate
+	f.fail(call, http.StatusBadRequest)
+	if outcome, err := refreshRecords(context.Background(), api, "example.com"); err != nil || outcome != refreshPerformed {
+		t.Errorf("expected the retried refresh to succeed, got %s, %v", outcome, err)
+	}
+
+	// The challenges of a burst share the refresh and its retry, and succeed
+	// when both fail.
+	calls := f.countCalls(call)
+	f.fail(call, http.StatusBadRequest, http.StatusBadRequest)
+	api.refreshes = &refreshCoalescer{}
+	api.refreshWindow = 50 * time.Millisecond
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if outcome, err := refreshRecords(context.Background(), api, "example.com"); err != nil || outcome != refreshFailed {
+				t.Errorf("expected the failed refresh to be tolerated, got %s, %v", outcome, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := f.countCalls(call) - calls; n != 2 {
+		t.Errorf("expected a refresh and its retry, got %d refreshes", n)
+	}
+}
+
+func TestRefreshCoalescerSeparatesAccounts(t *testing.T) {
+	f := newFakeOVH(t, "example.com")
+	c := &refreshCoalescer{}
+	apis := []*ovhAPI{f.api(), f.api(), f.api()}
+	apis[1].client.ConsumerKey = "other"
+	for _, api := range apis {
+		api.refreshes = c
+		api.refreshWindow = 50 * time.Millisecond
+	}
+
+	var wg sync.WaitGroup
+	for _, api := range apis {
+		wg.Add(1)
+		go func(api *ovhAPI) {
+			defer wg.Done()
+			if _, err := refreshRecords(context.Background(), api, "example.com"); err != nil {
+				t.Error(err)
+			}
+		}(api)
+	}
+	wg.Wait()
+
+	if n := f.countCalls("POST /domain/zone/example.com/refresh"); n != 2 {
+		t.Errorf("expected one refresh per account, got %d", n)
+	}
+}
+
+// shortenAutoRefreshProbeDelay speeds up the detection of the zones that
+// deploy changes by themselves for the duration of the test.
+func shortenAutoRefreshProbeDelay(t *testing.T) {
+	delay := autoRefreshProbeDelay
+	autoRefreshProbeDelay = time.Millisecond
+	t.Cleanup(func() { autoRefreshProbeDelay = delay })
+}
+
+func TestDetectAutoRefresh(t *testing.T) {
+	shortenAutoRefreshProbeDelay(t)
+	served := startDNSServer(t, map[string][]string{"_acme-challenge.auto.example.": {"key"}})
+	missing := startDNSServer(t, map[string][]string{})
+	f := newFakeOVH(t, "auto.example", "manual.example", "lagging.example")
+	f.nameServers["auto.example"] = []string{served, served}
+	f.nameServers["manual.example"] = []string{missing}
+	f.nameServers["lagging.example"] = []string{served, missing}
+
+	for domain, want := range map[string]bool{"auto.example": true, "manual.example": false, "lagging.example": false} {
+		api := f.api()
+		api.autoRefresh = &autoRefreshDetector{}
+		detectAutoRefresh(context.Background(), api, domain, "_acme-challenge."+domain, "key", time.Now())
+		if auto, ok := api.autoRefresh.lookup(domain); !ok || auto != want {
+			t.Errorf("%s: lookup = %t, %t, want %t, true", domain, auto, ok, want)
+		}
+	}
+}
+
+func TestDetectAutoRefreshIgnoresConcurrentRefreshes(t *testing.T) {
+	shortenAutoRefreshProbeDelay(t)
+	served := startDNSServer(t, map[string][]string{"_acme-challenge.auto.example.": {"key"}})
+	f := newFakeOVH(t, "auto.example")
+	f.nameServers["auto.example"] = []string{served}
+	api := f.api()
+	api.autoRefresh = &autoRefreshDetector{}
+	api.refreshes = &refreshCoalescer{}
+
+	// Another challenge refreshed the zone after the record was created: the
+	// record may be visible because of that refresh.
+	created := time.Now()
+	api.refreshes.noteRefresh("auto.example")
+	detectAutoRefresh(context.Background(), api, "auto.example", "_acme-challenge.auto.example", "key", created)
+	if auto, ok := api.autoRefresh.lookup("auto.example"); ok {
+		t.Errorf("inconclusive detection cached as %t", auto)
+	}
+
+	// A single challenge probes the zone at a time.
+	done, ok := api.autoRefresh.startProbe("auto.example")
+	if !ok {
+		t.Fatal("unable to start the probe")
+	}
+	detectAutoRefresh(context.Background(), api, "auto.example", "_acme-challenge.auto.example", "key", time.Now())
+	done()
+	if _, ok := api.autoRefresh.lookup("auto.example"); ok {
+		t.Error("zone probed twice at the same time")
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// maxDoHResponseSize bounds the DNS messages read from a DNS over HTTPS
+// resolver, the maximum size of a DNS message.
+const maxDoHResponseSize = 65535
+
+// dnsResolver is a resolver queried instead of the OVH name servers of the
+// zone for the propagation checks, for clusters that cannot reach them
+// directly.
+type dnsResolver struct {
+	// network is udp (with a fallback to tcp for truncated responses), tcp
+	// or https.
+	network string
+	// addr is the host and port of the resolver or, for https, the URL of
+	// its DNS over HTTPS endpoint.
+	addr string
+}
+
+// parseResolver validates the resolver of the propagation checks: an IP
+// address or a host name, with an optional port, prefixed with udp:// (the
+// default) or tcp://, or the https:// URL of a DNS over HTTPS (RFC 8484)
+// endpoint. source names where it comes from, for the error messages.
+func parseResolver(resolver, source string) (*dnsResolver, error) {
+	if strings.HasPrefix(resolver, "https://") {
+		u, err := url.Parse(resolver)
+		if err != nil {
+			return nil, fmt.Errorf("invalid propagation resolver %q in %s: %v", resolver, source, err)
+		}
+		if u.Host == "" || u.User != nil {
+			return nil, fmt.Errorf("invalid propagation resolver %q in %s: expected a DNS over HTTPS URL like https://dns.example/dns-query", resolver, source)
+		}
+		return &dnsResolver{network: "https", addr: u.String()}, nil
+	}
+	network := "udp"
+	hostPort := resolver
+	for _, scheme := range []string{"udp", "tcp"} {
+		if rest, ok := strings.CutPrefix(resolver, scheme+"://"); ok {
+			network, hostPort = scheme, rest
+		}
+	}
+	host, port := hostPort, "53"
+	if h, p, err := net.SplitHostPort(hostPort); err == nil {
+		host, port = h, p
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return nil, fmt.Errorf("invalid propagation resolver %q in %s: invalid port %q", resolver, source, port)
+	}
+	host = strings.TrimSuffix(strings.TrimSuffix(strings.TrimPrefix(host, "["), "]"), ".")
+	if net.ParseIP(host) == nil && !zoneNamePattern.MatchString(strings.ToLower(host)) {
+		return nil, fmt.Errorf("invalid propagation resolver %q in %s: expected an IP address or a host name, with an optional port", resolver, source)
+	}
+	return &dnsResolver{network: network, addr: net.JoinHostPort(host, port)}, nil
+}
+
+// String returns the resolver as it appears in the logs.
+func (r *dnsResolver) String() string {
+	if r.network == "https" {
+		return r.addr
+	}
+	return r.network + "://" + r.addr
+}
+
+// queryTXT asks the resolver for the TXT values of fqdn, with recursion,
+// within timeout.
+func (r *dnsResolver) queryTXT(ctx context.Context, fqdn string, timeout time.Duration) ([]string, error) {
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn(fqdn), dns.TypeTXT)
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	if r.network != "https" {
+		return exchangeTXT(ctx, r.network, r.addr, msg)
+	}
+	resp, err := r.exchangeHTTPS(ctx, msg)
+	if err != nil {
+		return nil, err
+	}
+	return txtValues(resp), nil
+}
+
+// exchangeHTTPS sends msg to the DNS over HTTPS endpoint of the resolver.
+func (r *dnsResolver) exchangeHTTPS(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	// The ID of DNS over HTTPS queries should be 0, for caching.
+	msg.Id = 0
+	body, err := msg.Pack()
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.addr, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DNS over HTTPS query failed with status %s", resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxDoHResponseSize))
+	if err != nil {
+		return nil, err
+	}
+	reply := new(dns.Msg)
+	if err := reply.Unpack(data); err != nil {
+		return nil, fmt.Errorf("invalid DNS over HTTPS response: %v", err)
+	}
+	return reply, nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// defaultRetryBudget is the number of retries allowed to a single Present or
+// CleanUp when none is configured, and to a single call made outside of a
+// challenge.
+const defaultRetryBudget = 5
+
+// retryDelay is the delay before retrying a call rejected because the zone is
+// locked by another operation. Tests shorten it.
+var retryDelay = 2 * time.Second
+
+// taskQueueRetryDelay is the delay before retrying a call rejected because the
+// task queue of the zone is full. The queue takes much longer than a lock to
+// drain, since OVH deploys the pending tasks one at a time. Tests shorten it.
+var taskQueueRetryDelay = 30 * time.Second
+
+// retryBudget is the number of retries left to the OVH API calls made on
+// behalf of a challenge. Sharing it between the create, refresh and polling
+// steps keeps a problematic zone from using up the API quota during mass
+// issuance.
+type retryBudget struct {
+	mu        sync.Mutex
+	size      int
+	remaining int
+}
+
+func newRetryBudget(retries int) *retryBudget {
+	return &retryBudget{size: retries, remaining: retries}
+}
+
+// refill gives back the whole budget, e.g. to the calls switching to the
+// fallback endpoint once the retries on the failing endpoint used it up.
+func (b *retryBudget) refill() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.remaining = b.size
+}
+
+// take consumes a retry and returns whether one was left.
+func (b *retryBudget) take() bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.remaining <= 0 {
+		return false
+	}
+	b.remaining--
+	return true
+}
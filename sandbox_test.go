@@ -0,0 +1,78 @@
+//go:build ovhsandbox
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/ovh/go-ovh/ovh"
+)
+
+// TestSandbox creates and deletes a challenge record in a real OVH zone
+// dedicated to tests. It only runs with the ovhsandbox build tag and when the
+// OVH_SANDBOX_* environment variables are set.
+func TestSandbox(t *testing.T) {
+	zone := os.Getenv("OVH_SANDBOX_ZONE")
+	endpoint := os.Getenv("OVH_SANDBOX_ENDPOINT")
+	applicationKey := os.Getenv("OVH_SANDBOX_APPLICATION_KEY")
+	applicationSecret := os.Getenv("OVH_SANDBOX_APPLICATION_SECRET")
+	consumerKey := os.Getenv("OVH_SANDBOX_CONSUMER_KEY")
+	if zone == "" || endpoint == "" || applicationKey == "" || applicationSecret == "" || consumerKey == "" {
+		t.Skip("OVH_SANDBOX_ZONE, OVH_SANDBOX_ENDPOINT, OVH_SANDBOX_APPLICATION_KEY, OVH_SANDBOX_APPLICATION_SECRET and OVH_SANDBOX_CONSUMER_KEY must be set")
+	}
+
+	cfg := ovhDNSProviderConfig{Endpoint: endpoint, ZoneCheck: zoneCheckEnforce}
+	if err := (&ovhDNSProviderSolver{}).validate(&cfg, true); err != nil {
+		t.Fatal(err)
+	}
+	client, err := ovh.NewClient(cfg.Endpoint, applicationKey, applicationSecret, consumerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	timeouts, err := resolveTimeouts(ovhTimeoutsConfig{}, ovhTimeoutsConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := newOVHAPI(client, timeouts, &rateLimiter{})
+
+	ctx := context.Background()
+	subDomain := "_acme-challenge.sandbox"
+	target := "sandbox-" + time.Now().UTC().Format("20060102T150405")
+	id, err := addTXTRecord(ctx, api, &cfg, zone, subDomain, target, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Do not leave the record in the zone if a later step fails.
+	t.Cleanup(func() {
+		err := deleteRecord(ctx, api, zone, id)
+		if err == nil {
+			t.Logf("deleted record %d left by the test", id)
+			_, err = refreshRecords(ctx, api, zone)
+		}
+		if err != nil && !isAPIError(err, http.StatusNotFound) {
+			t.Errorf("unable to delete record %d left by the test: %v", id, err)
+		}
+	})
+	ids, err := findTXTRecords(ctx, api, &cfg, zone, subDomain, target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 1 {
+		t.Errorf("expected a single record, got %v", ids)
+	}
+
+	if err := removeTXTRecord(ctx, api, &cfg, zone, subDomain, target, ids); err != nil {
+		t.Fatal(err)
+	}
+	ids, err = findTXTRecords(ctx, api, &cfg, zone, subDomain, target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 0 {
+		t.Errorf("records %v still exist after cleanup", ids)
+	}
+}
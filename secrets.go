@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// defaultSecretFetchRetries is the default number of retries of a Secret
+	// fetch that failed because of the Kubernetes API server.
+	defaultSecretFetchRetries = 3
+	// secretCacheTTL is how long a fetched Secret may stand in for a fetch
+	// that keeps failing.
+	secretCacheTTL = 5 * time.Minute
+	// defaultSecretStartupWindow is the default period after the start of
+	// the webhook during which the Secret fetches keep being retried.
+	defaultSecretStartupWindow = time.Minute
+)
+
+var (
+	// secretFetchDelay is the delay before the first retry of a Secret
+	// fetch, doubled at each retry. Tests shorten it.
+	secretFetchDelay = 200 * time.Millisecond
+	// secretStartupRetryDelay is the delay between two fetches of a Secret
+	// during the startup window. Tests shorten it.
+	secretStartupRetryDelay = 2 * time.Second
+)
+
+// secretCache keeps the last version fetched of each Secret, so that a
+// Kubernetes API server hiccup does not fail the challenges. Its zero value is
+// ready to use.
+type secretCache struct {
+	mu      sync.Mutex
+	secrets map[string]cachedSecret
+	used    accessTimes[string]
+}
+
+type cachedSecret struct {
+	secret  *corev1.Secret
+	fetched time.Time
+}
+
+// getSecret fetches a Secret, retrying the failures caused by the Kubernetes
+// API server. The Secret is fetched for every challenge, so that a rotated
+// secret is used right away; the cached copy is only used when the fetch
+// still fails after the retries, for at most secretCacheTTL.
+func (s *ovhDNSProviderSolver) getSecret(ctx context.Context, namespace, name string) (*corev1.Secret, error) {
+	key := namespace + "/" + name
+	backoff := wait.Backoff{Duration: secretFetchDelay, Factor: 2, Jitter: 0.1, Steps: s.secretRetries + 1}
+	var secret *corev1.Secret
+	err := retry.OnError(backoff, isTransientKubeError, func() error {
+		var err error
+		secret, err = s.client.CoreV1().Secrets(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil && isTransientKubeError(err) && ctx.Err() == nil {
+			klog.V(2).Infof("Unable to fetch secret %s, retrying: %v", key, err)
+		}
+		return err
+	})
+	if err != nil && isStartupSecretError(err) && time.Since(s.started) < s.secretStartupWindow {
+		secret, err = s.waitForStartupSecret(ctx, namespace, name, err)
+	}
+	if err == nil {
+		s.secrets.put(key, secret)
+		return secret, nil
+	}
+	if isTransientKubeError(err) {
+		if cached, ok := s.secrets.get(key); ok {
+			klog.Warningf("Unable to fetch secret %s, using the version fetched %v ago: %v", key, time.Since(cached.fetched).Round(time.Second), err)
+			return cached.secret, nil
+		}
+	}
+	return nil, err
+}
+
+// waitForStartupSecret fetches a Secret again until the end of the startup
+// window, while the fetch fails with err. Right after the start of the
+// webhook, the Kubernetes API server may not be reachable yet and the Secret
+// may not be created yet, e.g. by an operator syncing it from an external
+// secret manager, which would fail the first challenges.
+func (s *ovhDNSProviderSolver) waitForStartupSecret(ctx context.Context, namespace, name string, err error) (*corev1.Secret, error) {
+	deadline := s.started.Add(s.secretStartupWindow)
+	klog.Infof("Unable to fetch secret %s/%s after the start of the webhook, retrying until %s: %v", namespace, name, deadline.Format(time.RFC3339), err)
+	for {
+		delay := time.Until(deadline)
+		if delay <= 0 {
+			return nil, err
+		}
+		if delay > secretStartupRetryDelay {
+			delay = secretStartupRetryDelay
+		}
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(delay):
+		}
+		var secret *corev1.Secret
+		secret, err = s.client.CoreV1().Secrets(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err == nil || !isStartupSecretError(err) {
+			return secret, err
+		}
+	}
+}
+
+// isStartupSecretError returns whether a Secret fetch made right after the
+// start of the webhook may succeed later.
+func isStartupSecretError(err error) bool {
+	return isTransientKubeError(err) || apierrors.IsNotFound(err)
+}
+
+func (sc *secretCache) get(key string) (cachedSecret, bool) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	cached, ok := sc.secrets[key]
+	sc.used.touch(key)
+	if !ok || time.Since(cached.fetched) > secretCacheTTL {
+		return cachedSecret{}, false
+	}
+	return cached, true
+}
+
+func (sc *secretCache) prune(now time.Time, max int) int {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return pruneEntries(sc.secrets, sc.used, now, max, func(cached cachedSecret) time.Time {
+		return cached.fetched.Add(secretCacheTTL)
+	})
+}
+
+func (sc *secretCache) put(key string, secret *corev1.Secret) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if sc.secrets == nil {
+		sc.secrets = map[string]cachedSecret{}
+	}
+	if previous, ok := sc.secrets[key]; ok && previous.secret.ResourceVersion != secret.ResourceVersion {
+		klog.V(2).Infof("Secret %s changed, now at resource version %s", key, secret.ResourceVersion)
+	}
+	sc.secrets[key] = cachedSecret{secret: secret, fetched: time.Now()}
+	sc.used.touch(key)
+}
+
+// isTransientKubeError returns whether a Kubernetes API call failed because
+// of the API server or of the network, rather than because of the request.
+func isTransientKubeError(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var status apierrors.APIStatus
+	if !errors.As(err, &status) {
+		return true
+	}
+	return apierrors.IsServerTimeout(err) || apierrors.IsTimeout(err) || apierrors.IsTooManyRequests(err) ||
+		apierrors.IsInternalError(err) || apierrors.IsServiceUnavailable(err) || apierrors.IsUnexpectedServerError(err)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// failSecretGets makes the next Secret fetches of client fail with the given
+// errors.
+func failSecretGets(client *fake.Clientset, errs ...error) {
+	client.PrependReactor("get", "secrets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if len(errs) == 0 {
+			return false, nil, nil
+		}
+		err := errs[0]
+		errs = errs[1:]
+		return true, nil, err
+	})
+}
+
+func TestSecretFetchRetries(t *testing.T) {
+	previous := secretFetchDelay
+	secretFetchDelay = time.Millisecond
+	t.Cleanup(func() { secretFetchDelay = previous })
+
+	client := fake.NewSimpleClientset(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "ovh", ResourceVersion: "1"},
+		Data:       map[string][]byte{"applicationSecret": []byte("secret")},
+	})
+	s := &ovhDNSProviderSolver{client: client, secretRetries: 2}
+	ref := corev1.SecretKeySelector{LocalObjectReference: corev1.LocalObjectReference{Name: "ovh"}, Key: "applicationSecret"}
+	unavailable := apierrors.NewServiceUnavailable("overloaded")
+	ctx := context.Background()
+
+	failSecretGets(client, unavailable, apierrors.NewTimeoutError("slow", 1))
+	if value, _, err := s.secret(ctx, ref, "default", defaultApplicationSecretKey); err != nil || value != "secret" {
+		t.Fatalf("secret = %q, %v, expected the value after the retries", value, err)
+	}
+
+	// Once the retries are exhausted, the last version fetched is used.
+	failSecretGets(client, unavailable, unavailable, unavailable)
+	if value, _, err := s.secret(ctx, ref, "default", defaultApplicationSecretKey); err != nil || value != "secret" {
+		t.Errorf("secret = %q, %v, expected the cached value", value, err)
+	}
+
+	// A denied fetch is neither retried nor served from the cache.
+	failSecretGets(client, apierrors.NewForbidden(corev1.Resource("secrets"), "ovh", nil))
+	if _, _, err := s.secret(ctx, ref, "default", defaultApplicationSecretKey); !apierrors.IsForbidden(err) {
+		t.Errorf("expected the denied fetch to fail, got %v", err)
+	}
+
+	// The cached version expires.
+	s.secrets.secrets["default/ovh"] = cachedSecret{secret: s.secrets.secrets["default/ovh"].secret, fetched: time.Now().Add(-secretCacheTTL - time.Minute)}
+	failSecretGets(client, unavailable, unavailable, unavailable)
+	if _, _, err := s.secret(ctx, ref, "default", defaultApplicationSecretKey); err == nil {
+		t.Error("expected an error once the cached version expired")
+	}
+}
+
+func TestSecretFetchStartupWindow(t *testing.T) {
+	previous := secretStartupRetryDelay
+	secretStartupRetryDelay = time.Millisecond
+	t.Cleanup(func() { secretStartupRetryDelay = previous })
+
+	client := fake.NewSimpleClientset(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "ovh"},
+		Data:       map[string][]byte{"applicationSecret": []byte("secret")},
+	})
+	s := &ovhDNSProviderSolver{client: client, started: time.Now(), secretStartupWindow: time.Minute}
+	ref := corev1.SecretKeySelector{LocalObjectReference: corev1.LocalObjectReference{Name: "ovh"}, Key: "applicationSecret"}
+	notFound := apierrors.NewNotFound(corev1.Resource("secrets"), "ovh")
+	ctx := context.Background()
+
+	// Right after the start, a Secret not created yet is waited for.
+	failSecretGets(client, notFound, notFound, apierrors.NewServiceUnavailable("starting"))
+	if value, _, err := s.secret(ctx, ref, "default", defaultApplicationSecretKey); err != nil || value != "secret" {
+		t.Fatalf("secret = %q, %v, expected the value once the Secret exists", value, err)
+	}
+
+	// A denied fetch is not retried.
+	failSecretGets(client, notFound, apierrors.NewForbidden(corev1.Resource("secrets"), "ovh", nil))
+	if _, _, err := s.secret(ctx, ref, "default", defaultApplicationSecretKey); !apierrors.IsForbidden(err) {
+		t.Errorf("expected the denied fetch to fail, got %v", err)
+	}
+
+	// After the startup window, a missing Secret fails right away.
+	s.started = time.Now().Add(-time.Hour)
+	failSecretGets(client, notFound)
+	if _, _, err := s.secret(ctx, ref, "default", defaultApplicationSecretKey); !apierrors.IsNotFound(err) {
+		t.Errorf("expected the missing Secret to fail, got %v", err)
+	}
+
+	// The startup window is bounded.
+	s.started = time.Now().Add(-time.Minute + 50*time.Millisecond)
+	client.PrependReactor("get", "secrets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, notFound
+	})
+	start := time.Now()
+	if _, _, err := s.secret(ctx, ref, "default", defaultApplicationSecretKey); !apierrors.IsNotFound(err) {
+		t.Errorf("expected the missing Secret to fail at the end of the window, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("the fetch returned after %v", elapsed)
+	}
+}
+
+func TestSecretDefaultKey(t *testing.T) {
+	client := fake.NewSimpleClientset(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "ovh"},
+		Data:       map[string][]byte{"applicationSecret": []byte("secret")},
+	})
+	s := &ovhDNSProviderSolver{client: client}
+	ref := corev1.SecretKeySelector{LocalObjectReference: corev1.LocalObjectReference{Name: "ovh"}}
+	if value, _, err := s.secret(context.Background(), ref, "default", defaultApplicationSecretKey); err != nil || value != "secret" {
+		t.Errorf("secret = %q, %v, expected the value of the default key", value, err)
+	}
+
+	_, _, err := s.secret(context.Background(), ref, "default", "other")
+	if err == nil || !strings.Contains(err.Error(), "the secret reference has no key") {
+		t.Errorf("expected an error asking for the key, got %v", err)
+	}
+}
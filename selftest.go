@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/ovh/go-ovh/ovh"
+	"k8s.io/klog/v2"
+)
+
+// environmentAPI returns an OVH API client using the credentials of the
+// webhook environment (the OVH_* variables or an ovh.conf file), for the
+// operations that are not made on behalf of an issuer.
+func (s *ovhDNSProviderSolver) environmentAPI() (*ovhAPI, error) {
+	client, err := ovh.NewDefaultClient()
+	if err != nil {
+		return nil, err
+	}
+	client.UserAgent = s.userAgent
+	if len(s.httpHeaders) > 0 {
+		client.Client.Transport = &headerTransport{base: client.Client.Transport, headers: s.httpHeaders}
+	}
+	timeouts, err := resolveTimeouts(ovhTimeoutsConfig{}, s.timeouts)
+	if err != nil {
+		return nil, err
+	}
+	api := newOVHAPI(client, timeouts, s.limiters.get(client))
+	api.breaker = s.breakers.get(api.endpoint)
+	return api, nil
+}
+
+// selfTestTimeout bounds the self-test, so that a slow OVH API does not block
+// the startup of the webhook.
+const selfTestTimeout = 2 * time.Minute
+
+// selfTest creates, reads back and deletes a uniquely-named TXT record in the
+// zone, to detect permission and connectivity problems at startup rather than
+// at the first issuance.
+func selfTest(ctx context.Context, api *ovhAPI, zone string) error {
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		return err
+	}
+	subDomain := "_cert-manager-webhook-ovh-self-test-" + hex.EncodeToString(suffix)
+	target := "self-test"
+
+	record, err := createRecord(ctx, api, zone, "TXT", subDomain, target, defaultTTL)
+	if err != nil {
+		return fmt.Errorf("self-test in OVH zone %s failed to create a record: %w", zone, err)
+	}
+	readBack, err := getRecord(ctx, api, zone, record.Id)
+	if err == nil && readBack.Target != target {
+		err = fmt.Errorf("unexpected target %q", readBack.Target)
+	}
+	if err != nil {
+		// The record is deleted even if the self-test timed out, as long as
+		// the delete timeout allows.
+		if deleteErr := deleteRecord(context.WithoutCancel(ctx), api, zone, record.Id); deleteErr != nil {
+			klog.Errorf("Self-test left TXT record %d for %s in OVH zone %s, delete it manually: %v", record.Id, subDomain, zone, deleteErr)
+		}
+		return fmt.Errorf("self-test in OVH zone %s failed to read record %d back: %w", zone, record.Id, err)
+	}
+	if err := deleteRecord(ctx, api, zone, record.Id); err != nil {
+		return fmt.Errorf("self-test in OVH zone %s failed: %w", zone, err)
+	}
+	klog.Infof("Self-test in OVH zone %s succeeded", zone)
+	return nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestSelfTest(t *testing.T) {
+	f := newFakeOVH(t, "example.com")
+	if err := selfTest(context.Background(), f.api(), "example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if records := f.zoneRecords("example.com"); len(records) != 0 {
+		t.Errorf("self-test left records: %v", records)
+	}
+
+	f.fail("POST /domain/zone/example.com/record", http.StatusForbidden)
+	if err := selfTest(context.Background(), f.api(), "example.com"); err == nil {
+		t.Error("expected the self-test to fail")
+	}
+}
+
+func TestSelfTestReportsLeftRecord(t *testing.T) {
+	f := newFakeOVH(t, "example.com")
+	f.fail("GET /domain/zone/example.com/record/1", http.StatusInternalServerError)
+	f.fail("DELETE /domain/zone/example.com/record/1", http.StatusForbidden)
+	logs := captureLogs(t)
+
+	if err := selfTest(context.Background(), f.api(), "example.com"); err == nil {
+		t.Fatal("expected the self-test to fail")
+	}
+	if !strings.Contains(logs.String(), "Self-test left TXT record 1") {
+		t.Errorf("left record not reported: %s", logs)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// defaultPresentCacheTTL is the default time during which a repeated Present
+// of a presented record is answered without calling OVH.
+const defaultPresentCacheTTL = 5 * time.Minute
+
+// presentFlights collapses the concurrent Present calls of a same challenge,
+// which cert-manager makes when it retries a challenge whose Present is still
+// running, into a single creation and refresh of the record. Its zero value is
+// ready to use. A nil presentFlights does not collapse the calls.
+type presentFlights struct {
+	mu      sync.Mutex
+	flights map[string]*presentFlight
+}
+
+type presentFlight struct {
+	done chan struct{}
+	id   int64
+	err  error
+}
+
+// do calls fn, unless a call with the same key is running, in which case the
+// caller waits for it and gets its result. Since the joiners rely on the fn
+// of the first caller, the key must identify the account, the zone, the
+// subdomain and the target of the record. When the first caller gives up, a
+// joiner still waiting calls fn itself.
+func (g *presentFlights) do(ctx context.Context, key string, fn func(ctx context.Context) (int64, error)) (int64, error) {
+	if g == nil {
+		return fn(ctx)
+	}
+
+	g.mu.Lock()
+	if flight, ok := g.flights[key]; ok {
+		g.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-flight.done:
+		}
+		if isContextError(flight.err) && ctx.Err() == nil {
+			return g.do(ctx, key, fn)
+		}
+		return flight.id, flight.err
+	}
+	flight := &presentFlight{done: make(chan struct{})}
+	if g.flights == nil {
+		g.flights = map[string]*presentFlight{}
+	}
+	g.flights[key] = flight
+	g.mu.Unlock()
+
+	flight.id, flight.err = fn(ctx)
+	g.mu.Lock()
+	delete(g.flights, key)
+	g.mu.Unlock()
+	close(flight.done)
+	return flight.id, flight.err
+}
+
+// presentCache remembers the records whose Present succeeded, so that the
+// Present calls cert-manager repeats for a challenge return right away instead
+// of calling OVH again. The entries expire after ttl and are forgotten by the
+// CleanUp of the record. Its zero value, with a ttl of 0, remembers nothing.
+type presentCache struct {
+	ttl time.Duration
+
+	mu        sync.Mutex
+	presented map[string]time.Time
+	used      accessTimes[string]
+}
+
+// recent returns how long ago the record of key was presented, if it was
+// within ttl.
+func (pc *presentCache) recent(key string) (time.Duration, bool) {
+	if pc.ttl == 0 {
+		return 0, false
+	}
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	presented, ok := pc.presented[key]
+	pc.used.touch(key)
+	if !ok {
+		return 0, false
+	}
+	age := time.Since(presented)
+	if age > pc.ttl {
+		delete(pc.presented, key)
+		return 0, false
+	}
+	return age, true
+}
+
+// put records that the record of key was presented.
+func (pc *presentCache) put(key string) {
+	if pc.ttl == 0 {
+		return
+	}
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	if pc.presented == nil {
+		pc.presented = map[string]time.Time{}
+	}
+	now := time.Now()
+	for k, presented := range pc.presented {
+		if now.Sub(presented) > pc.ttl {
+			delete(pc.presented, k)
+		}
+	}
+	pc.presented[key] = now
+	pc.used.touch(key)
+}
+
+func (pc *presentCache) prune(now time.Time, max int) int {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	return pruneEntries(pc.presented, pc.used, now, max, func(presented time.Time) time.Time {
+		return presented.Add(pc.ttl)
+	})
+}
+
+// forget removes the record of key, once cleaned up.
+func (pc *presentCache) forget(key string) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	delete(pc.presented, key)
+}
+
+func isContextError(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
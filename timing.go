@@ -0,0 +1,55 @@
+package main
+
+import (
+	"strings"
+	"time"
+)
+
+// stepTimer measures the time spent in each step of a Present, so that the
+// debug logs show which OVH call is the bottleneck of a slow challenge. A nil
+// stepTimer records nothing.
+type stepTimer struct {
+	start time.Time
+	last  time.Time
+	steps []timedStep
+}
+
+type timedStep struct {
+	name     string
+	duration time.Duration
+}
+
+func newStepTimer(start time.Time) *stepTimer {
+	return &stepTimer{start: start, last: start}
+}
+
+// done records the time spent since the previous step as the duration of the
+// step name. The durations of a step done several times are added up.
+func (t *stepTimer) done(name string) {
+	if t == nil {
+		return
+	}
+	now := time.Now()
+	d := now.Sub(t.last)
+	t.last = now
+	for i := range t.steps {
+		if t.steps[i].name == name {
+			t.steps[i].duration += d
+			return
+		}
+	}
+	t.steps = append(t.steps, timedStep{name: name, duration: d})
+}
+
+// total returns the time elapsed since the start of the first step.
+func (t *stepTimer) total() time.Duration {
+	return t.last.Sub(t.start)
+}
+
+func (t *stepTimer) String() string {
+	steps := make([]string, len(t.steps))
+	for i, step := range t.steps {
+		steps[i] = step.name + " " + step.duration.Round(time.Millisecond).String()
+	}
+	return strings.Join(steps, ", ")
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStepTimer(t *testing.T) {
+	start := time.Now().Add(-3 * time.Second)
+	steps := newStepTimer(start)
+	steps.last = start.Add(time.Second)
+	steps.done("zone validation")
+	steps.done("refresh")
+	steps.done("zone validation")
+
+	if len(steps.steps) != 2 {
+		t.Fatalf("expected the durations of a repeated step to be added up, got %v", steps.steps)
+	}
+	if d := steps.steps[0].duration; d < 2*time.Second {
+		t.Errorf("zone validation took %v, expected at least 2s", d)
+	}
+	if total := steps.total(); total < 3*time.Second {
+		t.Errorf("total of %v, expected at least 3s", total)
+	}
+	if s := steps.String(); !strings.HasPrefix(s, "zone validation 2") || !strings.Contains(s, ", refresh ") {
+		t.Errorf("unexpected breakdown %q", s)
+	}
+
+	var disabled *stepTimer
+	disabled.done("refresh")
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ovh/go-ovh/ovh"
+	"k8s.io/klog/v2"
+)
+
+// ttlRangeCacheTTL is how long the TTL range learned for a zone is applied,
+// so that a change of the zone settings is eventually picked up.
+const ttlRangeCacheTTL = time.Hour
+
+// zoneTTLRanges holds the range of TTLs OVH applies to the records of each
+// zone. OVH does not expose it: it is learned from the records stored with
+// another TTL than the requested one. Its zero value is ready to use.
+type zoneTTLRanges struct {
+	mu     sync.Mutex
+	ranges map[string]ttlRange
+	used   accessTimes[string]
+}
+
+// ttlRange is the range of TTLs of a zone. A bound is 0 when unknown.
+type ttlRange struct {
+	min, max int
+	expires  time.Time
+}
+
+// learn records that OVH stored a record of the zone with the stored TTL
+// instead of the requested one.
+func (r *zoneTTLRanges) learn(domain string, requested, stored int) {
+	if r == nil || requested == 0 || stored == 0 || requested == stored {
+		return
+	}
+	key := normalizeName(domain)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.ranges == nil {
+		r.ranges = map[string]ttlRange{}
+	}
+	current := r.ranges[key]
+	if time.Now().After(current.expires) {
+		current = ttlRange{}
+	}
+	if stored > requested && stored > current.min {
+		current.min = stored
+	}
+	if stored < requested && (current.max == 0 || stored < current.max) {
+		current.max = stored
+	}
+	current.expires = time.Now().Add(ttlRangeCacheTTL)
+	r.ranges[key] = current
+	r.used.touch(key)
+	klog.V(2).Infof("OVH stored a record of zone %s with TTL %d instead of %d, now applying TTLs between %d and %d (0 meaning no bound)", domain, stored, requested, current.min, current.max)
+}
+
+// clamp returns ttl within the range learned for the zone. A TTL of 0, the
+// default TTL of the zone, is never changed.
+func (r *zoneTTLRanges) clamp(domain string, ttl int) int {
+	if r == nil || ttl == 0 {
+		return ttl
+	}
+	r.mu.Lock()
+	current, ok := r.ranges[normalizeName(domain)]
+	r.used.touch(normalizeName(domain))
+	r.mu.Unlock()
+	if !ok || time.Now().After(current.expires) {
+		return ttl
+	}
+	clamped := ttl
+	if current.min != 0 && clamped < current.min {
+		clamped = current.min
+	}
+	if current.max != 0 && clamped > current.max {
+		clamped = current.max
+	}
+	if clamped != ttl {
+		klog.Infof("Clamping the TTL %d of the challenge records of zone %s to %d, the TTL OVH applies to the zone", ttl, domain, clamped)
+	}
+	return clamped
+}
+
+func (r *zoneTTLRanges) prune(now time.Time, max int) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return pruneEntries(r.ranges, r.used, now, max, func(current ttlRange) time.Time {
+		return current.expires
+	})
+}
+
+// zoneMinimumTTL returns the minimum TTL of the records of the zone, for the
+// ttlZeroMeansMinimum option: the MINIMUM field of the SOA record of the zone,
+// which RFC 1035 defines as the lower bound of the TTLs of the zone. It
+// returns 0, the default TTL of the zone, when the SOA record cannot be read.
+func zoneMinimumTTL(ctx context.Context, api *ovhAPI, domain string) int {
+	soa, err := getZoneSOA(ctx, api, domain)
+	if err != nil {
+		klog.Warningf("Unable to read the minimum TTL of zone %s, using the default TTL of the zone: %v", domain, err)
+		return 0
+	}
+	klog.V(2).Infof("Using the minimum TTL %d of zone %s for a TTL of 0", soa.NXDomainTTL, domain)
+	return soa.NXDomainTTL
+}
+
+// isTTLRejected returns whether OVH rejected a record because of its TTL.
+func isTTLRejected(err error) bool {
+	var apiErr *ovh.APIError
+	return errors.As(err, &apiErr) && apiErr.Code == http.StatusBadRequest && strings.Contains(strings.ToLower(apiErr.Message), "ttl")
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestZoneTTLRanges(t *testing.T) {
+	r := &zoneTTLRanges{}
+	if ttl := r.clamp("example.com", 60); ttl != 60 {
+		t.Errorf("clamped to %d without a known range", ttl)
+	}
+	r.learn("Example.com.", 60, 300)
+	r.learn("example.com", 172800, 86400)
+	tests := map[int]int{0: 0, 60: 300, 600: 600, 604800: 86400}
+	for ttl, expected := range tests {
+		if clamped := r.clamp("example.com", ttl); clamped != expected {
+			t.Errorf("clamp(%d) = %d, expected %d", ttl, clamped, expected)
+		}
+	}
+	if ttl := r.clamp("example.org", 60); ttl != 60 {
+		t.Errorf("clamped to %d with the range of another zone", ttl)
+	}
+
+	// The learned range expires.
+	current := r.ranges["example.com"]
+	current.expires = time.Now().Add(-time.Minute)
+	r.ranges["example.com"] = current
+	if ttl := r.clamp("example.com", 60); ttl != 60 {
+		t.Errorf("clamped to %d with an expired range", ttl)
+	}
+}
+
+func TestAddTXTRecordClampsTTL(t *testing.T) {
+	f := newFakeOVH(t, "example.com")
+	f.minTTL["example.com"] = 300
+	ttl := 60
+	cfg := ovhDNSProviderConfig{ZoneCheck: zoneCheckEnforce, TTL: &ttl}
+	ranges := &zoneTTLRanges{}
+	logs := captureLogs(t)
+
+	for _, target := range []string{"key", "other"} {
+		api := f.api()
+		api.ttlRanges = ranges
+		if _, err := addTXTRecord(context.Background(), api, &cfg, "example.com", "_acme-challenge", target, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The first record taught the minimum TTL of the zone, applied to the
+	// second one.
+	if !strings.Contains(logs.String(), "Clamping the TTL 60 of the challenge records of zone example.com to 300") {
+		t.Errorf("expected the second TTL to be clamped: %s", logs)
+	}
+}
+
+func TestAddTXTRecordTTLZeroMeansMinimum(t *testing.T) {
+	f := newFakeOVH(t, "example.com")
+	f.minTTL["example.com"] = 300
+	ttl := 0
+	for _, test := range []struct {
+		zeroMeansMinimum bool
+		expected         int
+	}{
+		// By default, the record gets the default TTL of the zone.
+		{false, 0},
+		{true, 300},
+	} {
+		cfg := ovhDNSProviderConfig{ZoneCheck: zoneCheckEnforce, TTL: &ttl, TTLZeroMeansMinimum: test.zeroMeansMinimum}
+		id, err := addTXTRecord(context.Background(), f.api(), &cfg, "example.com", "_acme-challenge", fmt.Sprint("key", test.zeroMeansMinimum), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, record := range f.zoneRecords("example.com") {
+			if record.Id == id && record.TTL != test.expected {
+				t.Errorf("expected TTL %d with ttlZeroMeansMinimum %v, got %d", test.expected, test.zeroMeansMinimum, record.TTL)
+			}
+		}
+	}
+
+	// When the SOA record cannot be read, the default TTL of the zone is used.
+	f.fail("GET /domain/zone/example.com/soa", http.StatusForbidden)
+	cfg := ovhDNSProviderConfig{ZoneCheck: zoneCheckEnforce, TTL: &ttl, TTLZeroMeansMinimum: true}
+	id, err := addTXTRecord(context.Background(), f.api(), &cfg, "example.com", "_acme-challenge", "other", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, record := range f.zoneRecords("example.com") {
+		if record.Id == id && record.TTL != 0 {
+			t.Errorf("expected the default TTL of the zone without its SOA record, got %d", record.TTL)
+		}
+	}
+}
+
+func TestAddTXTRecordRetriesRejectedTTL(t *testing.T) {
+	f := newFakeOVH(t, "example.com")
+	f.failWith("POST /domain/zone/example.com/record", "Invalid TTL value", http.StatusBadRequest)
+	ttl := 30
+	cfg := ovhDNSProviderConfig{ZoneCheck: zoneCheckEnforce, TTL: &ttl}
+	if _, err := addTXTRecord(context.Background(), f.api(), &cfg, "example.com", "_acme-challenge", "key", nil); err != nil {
+		t.Fatal(err)
+	}
+	records := f.zoneRecords("example.com")
+	if len(records) != 1 || records[0].TTL != 0 {
+		t.Errorf("expected a record with the default TTL of the zone, got %v", records)
+	}
+}
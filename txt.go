@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	// maxTXTStringLength is the maximum length of a character-string of a
+	// TXT record.
+	maxTXTStringLength = 255
+	// maxTXTDataLength is the maximum length of the data of a record,
+	// including the length octet of each character-string.
+	maxTXTDataLength = 65535
+)
+
+// validateTXTTarget checks that the target fits in a TXT record.
+func validateTXTTarget(target string) error {
+	count := (len(target) + maxTXTStringLength - 1) / maxTXTStringLength
+	if len(target)+count > maxTXTDataLength {
+		return fmt.Errorf("TXT target of %d bytes is too long", len(target))
+	}
+	return nil
+}
+
+// txtRecordTarget returns the target sent to OVH for a TXT record. Values
+// longer than a character-string are split into several quoted strings,
+// which resolvers concatenate.
+func txtRecordTarget(target string) string {
+	if len(target) <= maxTXTStringLength {
+		return target
+	}
+	parts := []string{}
+	for len(target) > 0 {
+		n := maxTXTStringLength
+		if len(target) < n {
+			n = len(target)
+		}
+		parts = append(parts, quoteTXTString(target[:n]))
+		target = target[n:]
+	}
+	return strings.Join(parts, " ")
+}
+
+func quoteTXTString(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	return `"` + strings.ReplaceAll(s, `"`, `\"`) + `"`
+}
+
+// joinTXTStrings parses a sequence of quoted character-strings, as stored by
+// OVH for split values, and returns their concatenation.
+func joinTXTStrings(value string) (string, bool) {
+	var joined strings.Builder
+	count := 0
+	for {
+		value = strings.TrimLeft(value, " \t")
+		if value == "" {
+			return joined.String(), count > 0
+		}
+		if value[0] != '"' {
+			return "", false
+		}
+		i := 1
+		for ; i < len(value) && value[i] != '"'; i++ {
+			if value[i] == '\\' && i+1 < len(value) {
+				i++
+			}
+			joined.WriteByte(value[i])
+		}
+		if i == len(value) {
+			return "", false
+		}
+		value = value[i+1:]
+		count++
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestTXTRecordTarget(t *testing.T) {
+	if actual := txtRecordTarget("key"); actual != "key" {
+		t.Errorf("short target changed to %q", actual)
+	}
+
+	long := strings.Repeat("a", 300) + `"\`
+	split := txtRecordTarget(long)
+	expected := `"` + strings.Repeat("a", 255) + `" "` + strings.Repeat("a", 45) + `\"\\"`
+	if split != expected {
+		t.Errorf("txtRecordTarget = %q, expected %q", split, expected)
+	}
+	if joined, ok := joinTXTStrings(split); !ok || joined != long {
+		t.Errorf("joinTXTStrings = %q, %v", joined, ok)
+	}
+
+	if err := validateTXTTarget(strings.Repeat("a", 70000)); err == nil {
+		t.Error("expected an error for a target too long for a record")
+	}
+}
+
+func TestAddTXTRecordWithLongTarget(t *testing.T) {
+	f := newFakeOVH(t, "example.com")
+	target := strings.Repeat("b", 400)
+	for _, cfg := range []ovhDNSProviderConfig{{}, {VerbatimTarget: true}} {
+		cfg.ZoneCheck = zoneCheckEnforce
+		if _, err := addTXTRecord(context.Background(), f.api(), &cfg, "example.com", "_acme-challenge", target, nil); err != nil {
+			t.Fatal(err)
+		}
+		records := f.zoneRecords("example.com")
+		if len(records) != 1 || records[0].Target != txtRecordTarget(target) {
+			t.Fatalf("unexpected records %v", records)
+		}
+		if err := removeTXTRecord(context.Background(), f.api(), &cfg, "example.com", "_acme-challenge", target, nil); err != nil {
+			t.Fatal(err)
+		}
+		if records := f.zoneRecords("example.com"); len(records) != 0 {
+			t.Errorf("records left after cleanup: %v", records)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"runtime"
+	"runtime/debug"
+)
+
+// version and commit identify the build of the webhook, set at build time
+// with -ldflags "-X main.version=... -X main.commit=...".
+var (
+	version = "dev"
+	commit  = ""
+)
+
+const goOVHModule = "github.com/ovh/go-ovh"
+
+// userAgent returns the product identifying the webhook in the User-Agent
+// of the OVH API requests. The USER_AGENT_SUFFIX environment variable can be
+// used to add a cluster identifier.
+func userAgent() string {
+	ua := "cert-manager-webhook-ovh/" + version
+	if suffix := os.Getenv("USER_AGENT_SUFFIX"); suffix != "" {
+		ua += " " + suffix
+	}
+	return ua
+}
+
+// versionInfo is the body of the /version endpoint.
+type versionInfo struct {
+	Version      string `json:"version"`
+	Commit       string `json:"commit,omitempty"`
+	GoVersion    string `json:"goVersion"`
+	GoOVHVersion string `json:"goOVHVersion,omitempty"`
+}
+
+// buildVersionInfo describes the running binary. The commit and the go-ovh
+// version fall back to the build information embedded by the Go toolchain.
+func buildVersionInfo() versionInfo {
+	info := versionInfo{
+		Version:   version,
+		Commit:    commit,
+		GoVersion: runtime.Version(),
+	}
+	build, ok := debug.ReadBuildInfo()
+	if !ok {
+		return info
+	}
+	for _, dep := range build.Deps {
+		if dep.Path == goOVHModule {
+			info.GoOVHVersion = dep.Version
+		}
+	}
+	if info.Commit == "" {
+		for _, setting := range build.Settings {
+			if setting.Key == "vcs.revision" {
+				info.Commit = setting.Value
+			}
+		}
+	}
+	return info
+}
+
+func serveVersion(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(buildVersionInfo())
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/cert-manager/cert-manager/pkg/acme/webhook/apis/acme/v1alpha1"
+)
+
+func TestServeVersion(t *testing.T) {
+	rec := httptest.NewRecorder()
+	serveVersion(rec, httptest.NewRequest("GET", "/version", nil))
+
+	info := versionInfo{}
+	if err := json.NewDecoder(rec.Body).Decode(&info); err != nil {
+		t.Fatal(err)
+	}
+	if info.Version != version || info.GoVersion != runtime.Version() {
+		t.Errorf("unexpected version info %+v", info)
+	}
+	if info.GoOVHVersion == "" {
+		t.Error("missing go-ovh version")
+	}
+}
+
+func TestUserAgent(t *testing.T) {
+	t.Setenv("USER_AGENT_SUFFIX", "cluster/prod-1")
+	f := newFakeOVH(t, "example.com")
+	s := &ovhDNSProviderSolver{
+		userAgent: userAgent(),
+		credentialSources: []credentialSource{staticCredentials{creds: ovhCredentials{
+			endpoint:          f.server.URL,
+			applicationKey:    "key",
+			applicationSecret: "secret",
+			consumerKey:       "consumer",
+		}}},
+	}
+	api, err := s.ovhClient(context.Background(), &v1alpha1.ChallengeRequest{AllowAmbientCredentials: true}, &ovhDNSProviderConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := listRecords(context.Background(), api, "example.com", "TXT", "_acme-challenge"); err != nil {
+		t.Fatal(err)
+	}
+	// go-ovh adds its own product around the one of the webhook.
+	if want := "cert-manager-webhook-ovh/" + version + " cluster/prod-1"; !strings.Contains(f.userAgent, want) {
+		t.Errorf("User-Agent %q does not contain %q", f.userAgent, want)
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	"github.com/cert-manager/cert-manager/pkg/acme/webhook/apis/acme/v1alpha1"
+)
+
+const (
+	// zoneSelectionResolved, zoneSelectionLongest and zoneSelectionShortest
+	// are the values of the zoneSelection option. The resolved mode uses the
+	// zone resolved by cert-manager; the other modes pick, among the zones of
+	// the OVH account matching the FQDN, the most specific one (a delegated
+	// child zone, the default) or the least specific one (its parent).
+	zoneSelectionResolved = "resolved"
+	zoneSelectionLongest  = "longest"
+	zoneSelectionShortest = "shortest"
+)
+
+// zoneNamePattern matches the names of the zones set in the config, which
+// are used in the paths of the OVH API calls.
+var zoneNamePattern = regexp.MustCompile(`^([a-z0-9_]([a-z0-9_-]*[a-z0-9_])?\.)*[a-z0-9]([a-z0-9-]*[a-z0-9])?$`)
+
+// zoneListCacheTTL is how long the list of the zones of an OVH account is
+// reused before it is fetched again.
+const zoneListCacheTTL = 5 * time.Minute
+
+// zoneListCache caches the zones of each OVH account, so that Present and
+// CleanUp do not list them on every call. Its zero value is ready to use.
+type zoneListCache struct {
+	mu    sync.Mutex
+	zones map[string]cachedZoneList
+	used  accessTimes[string]
+}
+
+type cachedZoneList struct {
+	zones []string
+	// denied is set when OVH denied the list to the credentials.
+	denied  bool
+	expires time.Time
+}
+
+// errZoneListDenied reports credentials lacking the GET /domain/zone right,
+// which the API keys created before the zoneSelection option did not need.
+var errZoneListDenied = errors.New("listing the zones of the OVH account is denied")
+
+// list returns the zones of the account of api, fetched from OVH at most once
+// per zoneListCacheTTL unless refresh is set. A denied list is not asked again
+// within zoneListCacheTTL, even with refresh, and returns errZoneListDenied.
+func (zc *zoneListCache) list(ctx context.Context, api *ovhAPI, refresh bool) ([]string, error) {
+	key := api.account()
+	zc.mu.Lock()
+	cached, ok := zc.zones[key]
+	zc.used.touch(key)
+	zc.mu.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		if cached.denied {
+			return nil, errZoneListDenied
+		}
+		if !refresh {
+			return cached.zones, nil
+		}
+	}
+
+	zones := []string{}
+	err := api.get(ctx, operationList, "/domain/zone", &zones)
+	denied := isAPIError(err, http.StatusForbidden)
+	if err != nil && !denied {
+		return nil, err
+	}
+
+	zc.mu.Lock()
+	defer zc.mu.Unlock()
+	if zc.zones == nil {
+		zc.zones = map[string]cachedZoneList{}
+	}
+	zc.zones[key] = cachedZoneList{zones: zones, denied: denied, expires: time.Now().Add(zoneListCacheTTL)}
+	zc.used.touch(key)
+	if denied {
+		klog.Warningf("OVH denied the list of the zones of the account, grant the GET /domain/zone right to the API key; until then, zoneSelection uses the zones resolved by cert-manager: %v", err)
+		return nil, fmt.Errorf("%w: %w", errZoneListDenied, err)
+	}
+	return zones, nil
+}
+
+func (zc *zoneListCache) prune(now time.Time, max int) int {
+	zc.mu.Lock()
+	defer zc.mu.Unlock()
+	return pruneEntries(zc.zones, zc.used, now, max, func(cached cachedZoneList) time.Time {
+		return cached.expires
+	})
+}
+
+// selectZone returns the OVH zone of the account that holds the record of
+// fqdn according to mode. A zone created since the list was cached is found
+// by listing the zones again when none matches.
+func selectZone(ctx context.Context, api *ovhAPI, cache *zoneListCache, fqdn, mode string) (string, error) {
+	zones, err := cache.list(ctx, api, false)
+	if err != nil {
+		return "", err
+	}
+	candidates := matchingZones(zones, fqdn)
+	if len(candidates) == 0 {
+		zones, err = cache.list(ctx, api, true)
+		if err != nil {
+			return "", err
+		}
+		candidates = matchingZones(zones, fqdn)
+	}
+	if len(candidates) == 0 {
+		return "", fmt.Errorf("no zone of the OVH account matches %s", fqdn)
+	}
+	sort.Slice(candidates, func(i, j int) bool { return len(candidates[i]) < len(candidates[j]) })
+
+	zone := candidates[len(candidates)-1]
+	if mode == zoneSelectionShortest {
+		zone = candidates[0]
+	}
+	klog.V(2).Infof("Selected OVH zone %s for %s among %v (zoneSelection: %s)", zone, fqdn, candidates, mode)
+	return zone, nil
+}
+
+// matchingZones returns the zones that fqdn belongs to.
+func matchingZones(zones []string, fqdn string) []string {
+	name := normalizeName(fqdn)
+	candidates := []string{}
+	for _, zone := range zones {
+		zone = normalizeName(zone)
+		if name == zone || hasDomainSuffix(name, zone) {
+			candidates = append(candidates, zone)
+		}
+	}
+	return candidates
+}
+
+func hasDomainSuffix(name, zone string) bool {
+	return len(name) > len(zone) && name[len(name)-len(zone)-1:] == "."+zone
+}
+
+// selectZone replaces the zone resolved by cert-manager with the zone chosen
+// by the zoneSelection option, and checks the policies again for this zone.
+// A zone set by the zone option is used as is, after checking that it is a
+// zone of the account with the checkAccountZone option.
+func (s *ovhDNSProviderSolver) selectZone(ctx context.Context, api *ovhAPI, fqdn string, c *challenge) error {
+	if c.cfg.Zone != "" {
+		klog.V(2).Infof("Selected OVH zone %s for %s as set in OVH config", c.domain, fqdn)
+		return s.checkAccountZone(ctx, api, c)
+	}
+	if c.cfg.ZoneSelection == zoneSelectionResolved {
+		klog.V(2).Infof("Selected OVH zone %s for %s as resolved by cert-manager (zoneSelection: %s)", c.domain, fqdn, zoneSelectionResolved)
+		return s.checkAccountZone(ctx, api, c)
+	}
+	zone, err := selectZone(ctx, api, &s.zones, fqdn, c.cfg.ZoneSelection)
+	if errors.Is(err, errZoneListDenied) {
+		// The zone resolved by cert-manager is used, as with zoneSelection:
+		// resolved, so that the credentials of earlier versions keep working.
+		klog.V(2).Infof("Selected OVH zone %s for %s as resolved by cert-manager, the zones of the account cannot be listed", c.domain, fqdn)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	c.domain = zone
+	err = c.setSubDomain(fqdn)
+	if err != nil {
+		return err
+	}
+	return s.checkPolicies(c)
+}
+
+// checkAccountZone checks, with the checkAccountZone option, that the zone of
+// the challenge is one of the zones of the account, listing them again when
+// it is missing from the cached list. The zones selected among the zones of
+// the account by zoneSelection are not checked again.
+func (s *ovhDNSProviderSolver) checkAccountZone(ctx context.Context, api *ovhAPI, c *challenge) error {
+	if !c.cfg.CheckAccountZone {
+		return nil
+	}
+	for _, refresh := range []bool{false, true} {
+		zones, err := s.zones.list(ctx, api, refresh)
+		if err != nil {
+			return fmt.Errorf("unable to check that %s is a zone of the OVH account: %w", c.domain, err)
+		}
+		for _, zone := range zones {
+			if normalizeName(zone) == normalizeName(c.domain) {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("%s is not a zone of the OVH account, which cannot present its records", c.domain)
+}
+
+// isDelegated returns whether cert-manager followed a CNAME of the
+// _acme-challenge record of the challenge, i.e. its cnameStrategy is Follow
+// and the name is delegated. The challenge requests do not carry the
+// strategy, which is detected from the resolved name instead.
+func isDelegated(ch *v1alpha1.ChallengeRequest) bool {
+	if ch.DNSName == "" {
+		return false
+	}
+	expected := "_acme-challenge." + strings.TrimPrefix(ch.DNSName, "*.")
+	return normalizeName(ch.ResolvedFQDN) != normalizeName(expected)
+}
+
+// challengePrefixPattern matches the prefixes of the challengePrefixes
+// option: one or more labels replacing the _acme-challenge label.
+var challengePrefixPattern = regexp.MustCompile(`^[A-Za-z0-9_]([A-Za-z0-9_-]*[A-Za-z0-9_])?(\.[A-Za-z0-9_]([A-Za-z0-9_-]*[A-Za-z0-9_])?)*$`)
+
+// setSubDomain sets the name of the record of fqdn, relative to the zone of
+// the challenge. When the challengePrefixes option maps the zone to a prefix,
+// the prefix replaces the leading _acme-challenge label of the name, unless
+// the record is the target of a CNAME followed by cert-manager. It fails if
+// the subdomain and the zone do not make up fqdn, before any record is
+// created or deleted at a wrong name.
+func (c *challenge) setSubDomain(fqdn string) error {
+	c.subDomain = getSubDomain(c.domain, fqdn)
+	if err := checkSubDomain(c.domain, c.subDomain, fqdn); err != nil {
+		return err
+	}
+	if c.delegated {
+		return nil
+	}
+	for zone, prefix := range c.cfg.ChallengePrefixes {
+		if normalizeName(zone) != normalizeName(c.domain) {
+			continue
+		}
+		switch {
+		case c.subDomain == "_acme-challenge":
+			c.subDomain = strings.ToLower(prefix)
+		case strings.HasPrefix(c.subDomain, "_acme-challenge."):
+			c.subDomain = strings.ToLower(prefix) + strings.TrimPrefix(c.subDomain, "_acme-challenge")
+		}
+		return nil
+	}
+	return nil
+}
+
+// recordKeys returns the keys of the record of the challenge under each zone
+// Present may have selected for fqdn: the zone of the challenge and the other
+// parent domains of fqdn.
+func (c *challenge) recordKeys(fqdn string) []string {
+	keys := []string{c.recordKey()}
+	name := strings.TrimSuffix(fqdn, ".")
+	for name != "" {
+		candidate := *c
+		candidate.domain = name
+		if normalizeName(name) != normalizeName(c.domain) && candidate.setSubDomain(fqdn) == nil {
+			keys = append(keys, candidate.recordKey())
+		}
+		_, name, _ = strings.Cut(name, ".")
+	}
+	return keys
+}
+
+// checkSubDomain checks that subDomain joined with domain, or domain alone for
+// the apex, is fqdn. The case, the trailing dot and the stray dots ignored by
+// getSubDomain do not matter.
+func checkSubDomain(domain, subDomain, fqdn string) error {
+	name := domain
+	if subDomain != "" {
+		name = subDomain + "." + domain
+	}
+	if canonicalName(name) != canonicalName(fqdn) {
+		return fmt.Errorf("computed subdomain %q and zone %q do not make up the record name %q, refusing to manage the record", subDomain, domain, fqdn)
+	}
+	return nil
+}
+
+// canonicalName returns the lower-case name without its leading, trailing and
+// repeated dots.
+func canonicalName(name string) string {
+	return strings.Join(strings.FieldsFunc(strings.ToLower(name), func(r rune) bool { return r == '.' }), ".")
+}
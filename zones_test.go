@@ -0,0 +1,339 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+
+	extapi "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+
+	"github.com/cert-manager/cert-manager/pkg/acme/webhook/apis/acme/v1alpha1"
+)
+
+func TestSelectZone(t *testing.T) {
+	f := newFakeOVH(t, "example.com", "dev.example.com", "example.org")
+	api := f.api()
+	cache := &zoneListCache{}
+
+	tests := []struct {
+		fqdn, mode, zone string
+	}{
+		{"_acme-challenge.www.dev.example.com.", zoneSelectionLongest, "dev.example.com"},
+		{"_acme-challenge.www.dev.example.com.", zoneSelectionShortest, "example.com"},
+		{"_acme-challenge.WWW.Example.com.", zoneSelectionLongest, "example.com"},
+		{"_acme-challenge.notdev.example.com.", zoneSelectionLongest, "example.com"},
+	}
+	for _, test := range tests {
+		zone, err := selectZone(context.Background(), api, cache, test.fqdn, test.mode)
+		if err != nil {
+			t.Errorf("selectZone(%q, %s): %v", test.fqdn, test.mode, err)
+		} else if zone != test.zone {
+			t.Errorf("selectZone(%q, %s) = %q, expected %q", test.fqdn, test.mode, zone, test.zone)
+		}
+	}
+
+	if _, err := selectZone(context.Background(), api, cache, "_acme-challenge.example.net.", zoneSelectionLongest); err == nil {
+		t.Error("expected an error for a zone missing from the account")
+	}
+}
+
+func TestPresentOverlappingZones(t *testing.T) {
+	f := newFakeOVH(t, "example.com", "internal.example.com")
+	records, err := newRecordStore(nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &ovhDNSProviderSolver{records: records, credentialSources: []credentialSource{staticCredentials{creds: ovhCredentials{
+		endpoint:          f.server.URL,
+		applicationKey:    "key",
+		applicationSecret: "secret",
+		consumerKey:       "consumer",
+	}}}}
+	// cert-manager resolves the parent zone when the child zone is not
+	// delegated in the public DNS.
+	ch := &v1alpha1.ChallengeRequest{
+		ResolvedZone:            "example.com.",
+		ResolvedFQDN:            "_acme-challenge.x.internal.example.com.",
+		Key:                     "key",
+		AllowAmbientCredentials: true,
+		Config:                  &extapi.JSON{Raw: []byte(`{"refreshWindow": "0s"}`)},
+	}
+	if err := s.Present(ch); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(f.zoneRecords("example.com")); n != 0 {
+		t.Errorf("expected no record in the parent zone, got %d", n)
+	}
+	presented := f.zoneRecords("internal.example.com")
+	if len(presented) != 1 || presented[0].SubDomain != "_acme-challenge.x" {
+		t.Fatalf("expected the record in the child zone, got %v", presented)
+	}
+
+	// The cleanup looks the record up in the same zone.
+	if err := s.CleanUp(ch); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(f.zoneRecords("internal.example.com")); n != 0 {
+		t.Errorf("expected the record to be deleted from the child zone, got %d records", n)
+	}
+	if n := f.countCalls("GET /domain/zone/example.com/record"); n != 0 {
+		t.Errorf("expected no call to the records of the parent zone, got %d", n)
+	}
+}
+
+func TestPresentZoneListDenied(t *testing.T) {
+	f := newFakeOVH(t, "example.com", "internal.example.com")
+	f.fail("GET /domain/zone", http.StatusForbidden, http.StatusForbidden)
+	records, err := newRecordStore(nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &ovhDNSProviderSolver{records: records, credentialSources: []credentialSource{staticCredentials{creds: ovhCredentials{
+		endpoint:          f.server.URL,
+		applicationKey:    "key",
+		applicationSecret: "secret",
+		consumerKey:       "consumer",
+	}}}}
+	ch := &v1alpha1.ChallengeRequest{
+		ResolvedZone:            "example.com.",
+		ResolvedFQDN:            "_acme-challenge.x.internal.example.com.",
+		Key:                     "key",
+		AllowAmbientCredentials: true,
+		Config:                  &extapi.JSON{Raw: []byte(`{"refreshWindow": "0s"}`)},
+	}
+	logs := captureLogs(t)
+
+	// An API key without the GET /domain/zone right uses the zone resolved
+	// by cert-manager.
+	if err := s.Present(ch); err != nil {
+		t.Fatal(err)
+	}
+	presented := f.zoneRecords("example.com")
+	if len(presented) != 1 || presented[0].SubDomain != "_acme-challenge.x.internal" {
+		t.Fatalf("expected the record in the resolved zone, got %v", presented)
+	}
+	if !strings.Contains(logs.String(), "grant the GET /domain/zone right") {
+		t.Errorf("expected a warning about the missing right: %s", logs)
+	}
+	if err := s.CleanUp(ch); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(f.zoneRecords("example.com")); n != 0 {
+		t.Errorf("expected the record to be deleted from the resolved zone, got %d records", n)
+	}
+	// The denied list is not asked again for every challenge.
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if n := len(f.failures["GET /domain/zone"]); n != 1 {
+		t.Errorf("expected the zones to be listed once, %d denials left of 2", n)
+	}
+}
+
+func TestSelectZoneCachesZoneList(t *testing.T) {
+	f := newFakeOVH(t, "example.com")
+	api := f.api()
+	cache := &zoneListCache{}
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		if _, err := selectZone(ctx, api, cache, "_acme-challenge.example.com.", zoneSelectionLongest); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := f.countCalls("GET /domain/zone"); n != 1 {
+		t.Errorf("zones listed %d times, expected 1", n)
+	}
+
+	// A zone created after the list was cached is found by listing again.
+	f.mu.Lock()
+	f.records["example.org"] = map[int64]ovhZoneRecord{}
+	f.mu.Unlock()
+	zone, err := selectZone(ctx, api, cache, "_acme-challenge.example.org.", zoneSelectionLongest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if zone != "example.org" {
+		t.Errorf("selected zone %q, expected example.org", zone)
+	}
+}
+
+func TestConfiguredZone(t *testing.T) {
+	s := &ovhDNSProviderSolver{}
+	ch := &v1alpha1.ChallengeRequest{
+		ResolvedZone: "example.com.",
+		ResolvedFQDN: "_acme-challenge.www.dev.example.com.",
+		Key:          "key",
+		Config:       &extapi.JSON{Raw: []byte(`{"zone": "Dev.Example.com."}`)},
+	}
+	c, err := s.newChallenge(ch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.domain != "dev.example.com" || c.subDomain != "_acme-challenge.www" {
+		t.Errorf("got zone %q and subdomain %q, expected dev.example.com and _acme-challenge.www", c.domain, c.subDomain)
+	}
+
+	for _, config := range []string{
+		`{"zone": "example.org"}`,
+		`{"zone": "example.com/record"}`,
+		`{"zone": "example.com", "zoneSelection": "longest"}`,
+	} {
+		ch.Config = &extapi.JSON{Raw: []byte(config)}
+		if _, err := s.newChallenge(ch); err == nil {
+			t.Errorf("expected an error for %s", config)
+		}
+	}
+}
+
+func TestCheckAccountZone(t *testing.T) {
+	f := newFakeOVH(t, "example.com")
+	s := &ovhDNSProviderSolver{}
+	ctx := context.Background()
+	ch := &v1alpha1.ChallengeRequest{
+		ResolvedZone: "www.example.com.",
+		ResolvedFQDN: "_acme-challenge.www.example.com.",
+		Key:          "key",
+		Config:       &extapi.JSON{Raw: []byte(`{"zoneSelection": "resolved", "checkAccountZone": true}`)},
+	}
+
+	// cert-manager resolved a zone the account does not manage.
+	c, err := s.newChallenge(ch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.selectZone(ctx, f.api(), ch.ResolvedFQDN, c)
+	if err == nil || !strings.Contains(err.Error(), "www.example.com is not a zone of the OVH account") {
+		t.Errorf("expected the zone to be refused, got %v", err)
+	}
+	if n := f.countCalls("GET /domain/zone"); n != 2 {
+		t.Errorf("expected the zones to be listed again before refusing the zone, got %d calls", n)
+	}
+
+	ch.ResolvedZone = "example.com."
+	c, err = s.newChallenge(ch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.selectZone(ctx, f.api(), ch.ResolvedFQDN, c); err != nil {
+		t.Error(err)
+	}
+	if n := f.countCalls("GET /domain/zone"); n != 2 {
+		t.Errorf("expected the cached list to be used, got %d calls", n)
+	}
+}
+
+func TestChallengePrefixes(t *testing.T) {
+	s := &ovhDNSProviderSolver{}
+	config := `{"zoneSelection": "resolved", "challengePrefixes": {"dev.example.com": "_acme-dev", "example.org.": "_dns01._acme"}}`
+	tests := []struct {
+		zone, fqdn, subDomain string
+	}{
+		{"dev.example.com.", "_acme-challenge.www.dev.example.com.", "_acme-dev.www"},
+		{"Dev.Example.com.", "_acme-challenge.dev.example.com.", "_acme-dev"},
+		{"example.org.", "_acme-challenge.example.org.", "_dns01._acme"},
+		// Zones without a prefix and names without the _acme-challenge
+		// label keep the standard name.
+		{"example.com.", "_acme-challenge.www.example.com.", "_acme-challenge.www"},
+		{"dev.example.com.", "validation.www.dev.example.com.", "validation.www"},
+	}
+	for _, test := range tests {
+		c, err := s.newChallenge(&v1alpha1.ChallengeRequest{
+			ResolvedZone: test.zone,
+			ResolvedFQDN: test.fqdn,
+			Key:          "key",
+			Config:       &extapi.JSON{Raw: []byte(config)},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.subDomain != test.subDomain {
+			t.Errorf("subdomain of %s = %q, expected %q", test.fqdn, c.subDomain, test.subDomain)
+		}
+	}
+
+	if _, err := loadConfig(&extapi.JSON{Raw: []byte(`{"challengePrefixes": {"example.com": "_acme/../"}}`)}); err == nil {
+		t.Error("expected an error for an invalid prefix")
+	}
+}
+
+func TestSetSubDomainChecksName(t *testing.T) {
+	for _, test := range []struct{ domain, fqdn string }{
+		{"example.com", "example.com."},
+		{"example.com", "_acme-challenge.Www.Example.com."},
+		{".example.com.", "_acme-challenge.example.com"},
+		{"example.com", "_acme-challenge..example.com."},
+	} {
+		c := &challenge{domain: test.domain}
+		if err := c.setSubDomain(test.fqdn); err != nil {
+			t.Errorf("unexpected error for %s in zone %s: %v", test.fqdn, test.domain, err)
+		}
+	}
+
+	// A name outside the zone would otherwise be used as the subdomain.
+	c := &challenge{domain: "example.com"}
+	err := c.setSubDomain("_acme-challenge.example.org.")
+	if err == nil {
+		t.Fatalf("expected an error, got subdomain %q", c.subDomain)
+	}
+	for _, part := range []string{`"_acme-challenge.example.org"`, `"example.com"`, `"_acme-challenge.example.org."`} {
+		if !strings.Contains(err.Error(), part) {
+			t.Errorf("expected the error to include %s, got %v", part, err)
+		}
+	}
+}
+
+func TestCNAMEFollow(t *testing.T) {
+	shortenTaskPollInterval(t)
+	f := newFakeOVH(t, "example.com", "acme-delegate.net")
+	s := &ovhDNSProviderSolver{credentialSources: []credentialSource{staticCredentials{creds: ovhCredentials{
+		endpoint:          f.server.URL,
+		applicationKey:    "key",
+		applicationSecret: "secret",
+		consumerKey:       "consumer",
+	}}}}
+	// cert-manager followed the CNAME of _acme-challenge.www.example.com to
+	// _acme-challenge.www.acme-delegate.net: the prefix of the zone of the
+	// target does not apply, since the ACME server queries the CNAME.
+	ch := &v1alpha1.ChallengeRequest{
+		DNSName:                 "*.www.example.com",
+		ResolvedZone:            "acme-delegate.net.",
+		ResolvedFQDN:            "_acme-challenge.www.acme-delegate.net.",
+		Key:                     "key",
+		AllowAmbientCredentials: true,
+		Config:                  &extapi.JSON{Raw: []byte(`{"refreshWindow": "10ms", "challengePrefixes": {"acme-delegate.net": "_acme-dev"}}`)},
+	}
+	if err := s.Present(ch); err != nil {
+		t.Fatal(err)
+	}
+	records := f.zoneRecords("acme-delegate.net")
+	if len(records) != 1 || records[0].SubDomain != "_acme-challenge.www" {
+		t.Errorf("expected the record at the CNAME target, got %v", records)
+	}
+	if records := f.zoneRecords("example.com"); len(records) != 0 {
+		t.Errorf("expected no record in the zone of the CNAME, got %v", records)
+	}
+	if err := s.CleanUp(ch); err != nil {
+		t.Fatal(err)
+	}
+	if records := f.zoneRecords("acme-delegate.net"); len(records) != 0 {
+		t.Errorf("expected the record to be deleted, got %v", records)
+	}
+
+	// Without a CNAME, the prefix applies.
+	ch.DNSName = "www.acme-delegate.net"
+	if c, err := s.newChallenge(ch); err != nil || c.delegated || c.subDomain != "_acme-dev.www" {
+		t.Errorf("expected an undelegated challenge named _acme-dev.www, got %+v, %v", c, err)
+	}
+
+	ch.Config = &extapi.JSON{Raw: []byte(`{"zone": "example.com"}`)}
+	ch.DNSName = "www.example.com"
+	if _, err := s.newChallenge(ch); err == nil || !strings.Contains(err.Error(), "CNAME target") {
+		t.Errorf("expected an error for a CNAME target outside of the configured zone, got %v", err)
+	}
+	ch.Config = nil
+	ch.ResolvedZone = "example.com."
+	if _, err := s.newChallenge(ch); err == nil {
+		t.Error("expected an error for a name outside of the resolved zone")
+	}
+}